@@ -0,0 +1,60 @@
+package buses
+
+import (
+	"context"
+	"fmt"
+	"github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/events"
+	"sort"
+	"sync"
+)
+
+type Health struct {
+	Healthy bool   `json:"healthy"`
+	Status  string `json:"status"`
+	Stats   *Stats `json:"stats,omitempty"`
+}
+
+// Bus is a delivery target for events. Buses register themselves by their config key.
+// Context given to Initialize lives as long as the bus, Close should flush pending deliveries until its context is done
+type Bus interface {
+	Initialize(ctx context.Context, conf *config.Config) error
+	Send(event events.Event)
+	Close(ctx context.Context) error
+	Health() Health
+}
+
+type Factory func() Bus
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]Factory)
+)
+
+// Register makes a bus available under its config key, usually from the bus package's init()
+func Register(key string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, exists := registry[key]; exists {
+		panic(fmt.Sprintf("bus %s is already registered", key))
+	}
+	registry[key] = factory
+}
+
+// Registered returns config keys of all known buses, sorted
+func Registered() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	keys := make([]string, 0, len(registry))
+	for key := range registry {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func factory(key string) Factory {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return registry[key]
+}
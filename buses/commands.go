@@ -0,0 +1,26 @@
+package buses
+
+// Command is a remote control request, like {"command": "mode", "mode": "home"}
+type Command struct {
+	ID      string `json:"id,omitempty"` // COMES BACK IN REPLY, SO THAT CALLER CAN MATCH THEM
+	Command string `json:"command"`
+	Camera  string `json:"camera,omitempty"`
+	Type    string `json:"type,omitempty"` // EVENT TYPE OF TEST EVENT
+	Mode    string `json:"mode,omitempty"` // ARMING MODE
+	Minutes int    `json:"minutes,omitempty"`
+}
+
+type CommandReply struct {
+	ID      string      `json:"id,omitempty"`
+	Command string      `json:"command"`
+	Ok      bool        `json:"ok"`
+	Error   string      `json:"error,omitempty"`
+	Result  interface{} `json:"result,omitempty"`
+}
+
+type CommandHandler func(command Command) CommandReply
+
+// CommandReceiving is implemented by buses that take commands, like MQTT command topic
+type CommandReceiving interface {
+	SetCommandHandler(handler CommandHandler)
+}
@@ -0,0 +1,109 @@
+package buses
+
+import (
+	"context"
+	"fmt"
+	"github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/logging"
+	"sync"
+)
+
+var log = logging.For("buses")
+
+type namedBus struct {
+	key string
+	bus Bus
+}
+
+// Manager holds all enabled buses and dispatches events to them
+type Manager struct {
+	buses []namedBus
+}
+
+// NewManager initializes every registered bus that is enabled in config
+func NewManager(ctx context.Context, conf *config.Config) (*Manager, error) {
+	manager := &Manager{}
+	for _, key := range Registered() {
+		if !conf.IsEnabled(key) {
+			continue
+		}
+		bus := factory(key)()
+		if err := bus.Initialize(ctx, conf); err != nil {
+			return nil, fmt.Errorf("error initializing %s bus: %w", key, err)
+		}
+		log.Debug("bus initialized", "bus", key)
+		manager.buses = append(manager.buses, namedBus{key: key, bus: bus})
+	}
+	return manager, nil
+}
+
+func (manager *Manager) Count() int {
+	return len(manager.buses)
+}
+
+// Get returns enabled bus with config key, nil if it is not enabled
+func (manager *Manager) Get(key string) Bus {
+	for _, item := range manager.buses {
+		if item.key == key {
+			return item.bus
+		}
+	}
+	return nil
+}
+
+func (manager *Manager) Send(event events.Event) {
+	for _, item := range manager.buses {
+		item.bus.Send(event)
+	}
+}
+
+// SendTo sends event to buses that allow says yes to
+func (manager *Manager) SendTo(event events.Event, allow func(key string) bool) {
+	for _, item := range manager.buses {
+		if allow(item.key) {
+			item.bus.Send(event)
+		}
+	}
+}
+
+// SetDeliveryReporter tells reporter about every delivery of buses that can report them
+func (manager *Manager) SetDeliveryReporter(reporter events.DeliveryReporter) {
+	for _, item := range manager.buses {
+		if reporting, ok := item.bus.(DeliveryReporting); ok {
+			reporting.SetDeliveryReporter(reporter)
+		}
+	}
+}
+
+// SetCommandHandler passes commands of buses that can receive them to handler
+func (manager *Manager) SetCommandHandler(handler CommandHandler) {
+	for _, item := range manager.buses {
+		if receiving, ok := item.bus.(CommandReceiving); ok {
+			receiving.SetCommandHandler(handler)
+		}
+	}
+}
+
+func (manager *Manager) Health() map[string]Health {
+	health := make(map[string]Health, len(manager.buses))
+	for _, item := range manager.buses {
+		health[item.key] = item.bus.Health()
+	}
+	return health
+}
+
+// Close closes all buses in parallel, giving them until ctx is done to flush pending deliveries
+func (manager *Manager) Close(ctx context.Context) {
+	waitGroup := sync.WaitGroup{}
+	for _, item := range manager.buses {
+		waitGroup.Add(1)
+		go func(item namedBus) {
+			defer waitGroup.Done()
+			if err := item.bus.Close(ctx); err != nil {
+				log.Error("error closing bus", "bus", item.key, "error", err)
+			}
+		}(item)
+	}
+	waitGroup.Wait()
+}
@@ -0,0 +1,151 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var bufferBucket = []byte("messages")
+
+// message is a publish waiting for broker to come back
+type message struct {
+	Topic   string    `json:"topic"`
+	Payload string    `json:"payload"`
+	Qos     byte      `json:"qos"`
+	Retain  bool      `json:"retain"`
+	EventID string    `json:"eventId,omitempty"` // TO REPORT DELIVERY WHEN IT IS FINALLY SENT
+	Queued  time.Time `json:"queued"`
+}
+
+// buffer is a queue of messages, oldest first. It is not safe for concurrent use, Bus guards it
+type buffer interface {
+	push(message *message) error
+	peek() (*message, error) // NIL IF EMPTY
+	pop() error
+	len() int
+	close() error
+}
+
+type memoryBuffer struct {
+	messages []*message
+}
+
+func (buffer *memoryBuffer) push(message *message) error {
+	buffer.messages = append(buffer.messages, message)
+	return nil
+}
+
+func (buffer *memoryBuffer) peek() (*message, error) {
+	if len(buffer.messages) == 0 {
+		return nil, nil
+	}
+	return buffer.messages[0], nil
+}
+
+func (buffer *memoryBuffer) pop() error {
+	if len(buffer.messages) > 0 {
+		buffer.messages[0] = nil
+		buffer.messages = buffer.messages[1:]
+	}
+	return nil
+}
+
+func (buffer *memoryBuffer) len() int {
+	return len(buffer.messages)
+}
+
+func (buffer *memoryBuffer) close() error {
+	return nil
+}
+
+// diskBuffer keeps messages in a bbolt file, so that they survive restarts
+type diskBuffer struct {
+	db    *bolt.DB
+	count int
+}
+
+func openDiskBuffer(path string) (*diskBuffer, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0640, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	buffer := &diskBuffer{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(bufferBucket)
+		if err != nil {
+			return err
+		}
+		buffer.count = bucket.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return buffer, nil
+}
+
+func (buffer *diskBuffer) push(message *message) error {
+	value, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	err = buffer.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bufferBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, id)
+		return bucket.Put(k, value)
+	})
+	if err == nil {
+		buffer.count++
+	}
+	return err
+}
+
+func (buffer *diskBuffer) peek() (*message, error) {
+	var oldest *message
+	err := buffer.db.View(func(tx *bolt.Tx) error {
+		_, value := tx.Bucket(bufferBucket).Cursor().First()
+		if value == nil {
+			return nil
+		}
+		oldest = &message{}
+		return json.Unmarshal(value, oldest)
+	})
+	return oldest, err
+}
+
+func (buffer *diskBuffer) pop() error {
+	deleted := false
+	err := buffer.db.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(bufferBucket).Cursor()
+		if k, _ := cursor.First(); k == nil {
+			return nil
+		}
+		deleted = true
+		return cursor.Delete()
+	})
+	if err == nil && deleted {
+		buffer.count--
+	}
+	return err
+}
+
+func (buffer *diskBuffer) len() int {
+	return buffer.count
+}
+
+func (buffer *diskBuffer) close() error {
+	return buffer.db.Close()
+}
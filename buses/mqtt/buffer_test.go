@@ -0,0 +1,204 @@
+package mqtt
+
+import (
+	"errors"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type doneToken struct {
+	err error
+}
+
+func (token doneToken) Wait() bool                     { return true }
+func (token doneToken) WaitTimeout(time.Duration) bool { return true }
+func (token doneToken) Error() error                   { return token.err }
+func (token doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// fakeClient records what is published while it is connected
+type fakeClient struct {
+	MQTT.Client
+	lock      sync.Mutex
+	connected bool
+	published []string
+	payloads  []string
+}
+
+func (client *fakeClient) IsConnectionOpen() bool {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.connected
+}
+
+func (client *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if !client.connected {
+		return doneToken{err: errNotConnected}
+	}
+	client.published = append(client.published, topic)
+	if text, ok := payload.(string); ok {
+		client.payloads = append(client.payloads, text)
+	}
+	return doneToken{}
+}
+
+func (client *fakeClient) connect() {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.connected = true
+}
+
+func (client *fakeClient) topics() []string {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return append([]string{}, client.published...)
+}
+
+func newBufferedBus(size int, dropNewest bool) (*Bus, *fakeClient) {
+	client := &fakeClient{}
+	return &Bus{client: client, buffer: &memoryBuffer{}, bufferSize: size, dropNewest: dropNewest}, client
+}
+
+func publishAll(bus *Bus, topics ...string) []error {
+	var errs []error
+	for _, topic := range topics {
+		errs = append(errs, bus.publish(&message{Topic: topic}))
+	}
+	return errs
+}
+
+func TestBufferDropsOldestWhenFull(t *testing.T) {
+	bus, client := newBufferedBus(3, false)
+	for _, err := range publishAll(bus, "1", "2", "3", "4", "5") {
+		if err != nil {
+			t.Errorf("publish returned %v, oldest should make room", err)
+		}
+	}
+	client.connect()
+	bus.flush()
+	if got := client.topics(); !reflect.DeepEqual(got, []string{"3", "4", "5"}) {
+		t.Errorf("flushed %v, want [3 4 5]", got)
+	}
+}
+
+func TestBufferDropsNewestWhenFull(t *testing.T) {
+	bus, client := newBufferedBus(3, true)
+	errs := publishAll(bus, "1", "2", "3", "4")
+	if !errors.Is(errs[3], errBufferFull) {
+		t.Errorf("publish past size returned %v, want errBufferFull", errs[3])
+	}
+	client.connect()
+	bus.flush()
+	if got := client.topics(); !reflect.DeepEqual(got, []string{"1", "2", "3"}) {
+		t.Errorf("flushed %v, want [1 2 3]", got)
+	}
+}
+
+func TestBufferOffDropsWhileDisconnected(t *testing.T) {
+	bus, client := newBufferedBus(0, false)
+	if err := bus.publish(&message{Topic: "1"}); !errors.Is(err, errNotConnected) {
+		t.Errorf("publish returned %v, want errNotConnected", err)
+	}
+	client.connect()
+	bus.flush()
+	if got := client.topics(); len(got) != 0 {
+		t.Errorf("flushed %v, want nothing", got)
+	}
+}
+
+func TestNewMessagesLineUpBehindBuffered(t *testing.T) {
+	bus, client := newBufferedBus(10, false)
+	publishAll(bus, "1", "2")
+	client.connect()
+	// BUFFER IS NOT EMPTY YET, SO THIS ONE WAITS ITS TURN AND STARTS FLUSH
+	if err := bus.publish(&message{Topic: "3"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(client.topics()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := client.topics(); !reflect.DeepEqual(got, []string{"1", "2", "3"}) {
+		t.Errorf("published %v, want [1 2 3]", got)
+	}
+	publishAll(bus, "4")
+	if got := client.topics(); !reflect.DeepEqual(got, []string{"1", "2", "3", "4"}) {
+		t.Errorf("published %v, want [1 2 3 4]", got)
+	}
+}
+
+func TestDiskBufferSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.db")
+	buffer, err := openDiskBuffer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"1", "2", "3"} {
+		if err := buffer.push(&message{Topic: topic, Payload: "payload " + topic, Qos: 1, Retain: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := buffer.pop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := buffer.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buffer, err = openDiskBuffer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.close()
+	if buffer.len() != 2 {
+		t.Fatalf("%d messages after reopen, want 2", buffer.len())
+	}
+	var topics []string
+	for {
+		oldest, err := buffer.peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if oldest == nil {
+			break
+		}
+		if oldest.Payload != "payload "+oldest.Topic || oldest.Qos != 1 || !oldest.Retain {
+			t.Errorf("message is %+v", oldest)
+		}
+		topics = append(topics, oldest.Topic)
+		if err := buffer.pop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(topics, []string{"2", "3"}) || buffer.len() != 0 {
+		t.Errorf("replayed %v with %d left, want [2 3] and none", topics, buffer.len())
+	}
+	if err := buffer.pop(); err != nil || buffer.len() != 0 {
+		t.Errorf("pop of empty buffer returned %v and left length %d", err, buffer.len())
+	}
+}
+
+func TestDiskBufferDropsOldestWhenFull(t *testing.T) {
+	buffer, err := openDiskBuffer(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeClient{}
+	bus := &Bus{client: client, buffer: buffer, bufferSize: 2}
+	defer bus.closeBuffer()
+	publishAll(bus, "1", "2", "3")
+	client.connect()
+	bus.flush()
+	if got := client.topics(); !reflect.DeepEqual(got, []string{"2", "3"}) {
+		t.Errorf("flushed %v, want [2 3]", got)
+	}
+}
@@ -0,0 +1,81 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/toxuin/alarmserver/buses"
+)
+
+// commandQos makes sure broker hands every command over, even if alarm server is reconnecting
+const commandQos = 1
+
+func (mqtt *Bus) SetCommandHandler(handler buses.CommandHandler) {
+	mqtt.commandLock.Lock()
+	defer mqtt.commandLock.Unlock()
+	mqtt.commandHandler = handler
+}
+
+func (mqtt *Bus) commandTopic() string {
+	return mqtt.topicRoot + "/alarmserver/cmd"
+}
+
+func (mqtt *Bus) responseTopic() string {
+	return mqtt.topicRoot + "/alarmserver/response"
+}
+
+// subscribe listens to command topic. Broker forgets subscriptions of clean sessions, so it is done on every connect
+func (mqtt *Bus) subscribe(client MQTT.Client) {
+	token := client.Subscribe(mqtt.commandTopic(), commandQos, func(client MQTT.Client, msg MQTT.Message) {
+		if msg.Retained() {
+			// OR IT WOULD RUN AGAIN ON EVERY RECONNECT
+			log.Warn("ignoring retained command, publish commands without retain flag", "topic", msg.Topic())
+			return
+		}
+		// PAHO WAITS FOR HANDLERS, AND RELOAD CAN TAKE A WHILE
+		go mqtt.handleCommand(msg.Payload())
+	})
+	token.Wait()
+	if token.Error() != nil {
+		log.Error("error subscribing to command topic", "topic", mqtt.commandTopic(), "error", token.Error())
+		return
+	}
+	log.Info("listening for commands", "topic", mqtt.commandTopic())
+}
+
+func (mqtt *Bus) handleCommand(payload []byte) {
+	mqtt.commandLock.RLock()
+	handler := mqtt.commandHandler
+	mqtt.commandLock.RUnlock()
+
+	command, err := parseCommand(payload)
+	var reply buses.CommandReply
+	switch {
+	case err != nil:
+		log.Warn("unable to parse command", "payload", string(payload), "error", err)
+		reply = buses.CommandReply{Error: "unable to parse command: " + err.Error()}
+	case handler == nil:
+		reply = buses.CommandReply{ID: command.ID, Command: command.Command, Error: "not ready for commands yet"}
+	default:
+		reply = handler(command)
+	}
+	response, err := json.Marshal(reply)
+	if err != nil {
+		log.Error("error marshaling command reply", "command", command.Command, "error", err)
+		return
+	}
+	_ = mqtt.publish(&message{Topic: mqtt.responseTopic(), Payload: string(response), Qos: mqtt.qos})
+}
+
+// parseCommand takes JSON like {"command": "mute", "camera": "porch", "minutes": 10},
+// or just command name for commands without arguments, like "status"
+func parseCommand(payload []byte) (buses.Command, error) {
+	payload = bytes.TrimSpace(payload)
+	command := buses.Command{}
+	if len(payload) > 0 && payload[0] == '{' {
+		err := json.Unmarshal(payload, &command)
+		return command, err
+	}
+	command.Command = string(payload)
+	return command, nil
+}
@@ -0,0 +1,105 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"github.com/toxuin/alarmserver/buses"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    buses.Command
+		wantErr bool
+	}{
+		{"bare name", "status", buses.Command{Command: "status"}, false},
+		{"bare name with spaces", "  reload\n", buses.Command{Command: "reload"}, false},
+		{"json", `{"id": "7", "command": "mute", "camera": "porch", "minutes": 10}`,
+			buses.Command{ID: "7", Command: "mute", Camera: "porch", Minutes: 10}, false},
+		{"json with spaces", ` {"command": "mode", "mode": "home"} `, buses.Command{Command: "mode", Mode: "home"}, false},
+		{"empty", "", buses.Command{}, false},
+		{"broken json", `{"command": "arm"`, buses.Command{}, true},
+		{"camera of wrong type", `{"command": "arm", "camera": 5}`, buses.Command{}, true},
+		{"minutes of wrong type", `{"command": "mute", "minutes": "ten"}`, buses.Command{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseCommand([]byte(test.payload))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error is %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("command is %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHandleCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		payload   string
+		noHandler bool
+		want      buses.CommandReply
+	}{
+		{"known command", `{"id": "1", "command": "arm", "camera": "porch"}`, false,
+			buses.CommandReply{ID: "1", Command: "arm", Ok: true, Result: "porch"}},
+		{"bare name", "status", false, buses.CommandReply{Command: "status", Ok: true}},
+		{"unknown command", `{"id": "2", "command": "selfdestruct"}`, false,
+			buses.CommandReply{ID: "2", Command: "selfdestruct", Error: "unknown command"}},
+		{"bad camera", `{"id": "3", "command": "arm", "camera": ["porch"]}`, false,
+			buses.CommandReply{Error: "unable to parse command"}},
+		{"bad json", `{"command": `, false, buses.CommandReply{Error: "unable to parse command"}},
+		{"no handler yet", `{"id": "4", "command": "status"}`, true,
+			buses.CommandReply{ID: "4", Command: "status", Error: "not ready for commands yet"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakeClient{connected: true}
+			bus := &Bus{client: client, buffer: &memoryBuffer{}, topicRoot: "cams"}
+			handled := 0
+			if !test.noHandler {
+				bus.SetCommandHandler(func(command buses.Command) buses.CommandReply {
+					handled++
+					reply := buses.CommandReply{ID: command.ID, Command: command.Command, Ok: true}
+					switch command.Command {
+					case "arm":
+						reply.Result = command.Camera
+					case "status":
+					default:
+						reply.Ok = false
+						reply.Error = "unknown command"
+					}
+					return reply
+				})
+			}
+
+			bus.handleCommand([]byte(test.payload))
+
+			if got := client.topics(); !reflect.DeepEqual(got, []string{"cams/alarmserver/response"}) {
+				t.Fatalf("published to %v, want [cams/alarmserver/response]", got)
+			}
+			var got buses.CommandReply
+			if err := json.Unmarshal([]byte(client.payloads[0]), &got); err != nil {
+				t.Fatalf("reply %q is not JSON: %v", client.payloads[0], err)
+			}
+			if got.ID != test.want.ID || got.Command != test.want.Command || got.Ok != test.want.Ok ||
+				!reflect.DeepEqual(got.Result, test.want.Result) {
+				t.Errorf("reply is %+v, want %+v", got, test.want)
+			}
+			if !strings.HasPrefix(got.Error, test.want.Error) || (test.want.Error == "") != (got.Error == "") {
+				t.Errorf("reply error is %q, want %q", got.Error, test.want.Error)
+			}
+			wantHandled := 1
+			if test.noHandler || strings.HasPrefix(test.want.Error, "unable to parse") {
+				wantHandled = 0
+			}
+			if handled != wantHandled {
+				t.Errorf("handler ran %d times, want %d", handled, wantHandled)
+			}
+		})
+	}
+}
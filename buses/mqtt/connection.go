@@ -0,0 +1,78 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/toxuin/alarmserver/config"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// brokerUrl puts protocol, server, port and websocket path together the way paho wants them
+func brokerUrl(conf config.MqttConfig) (string, error) {
+	protocol := strings.ToLower(conf.Protocol)
+	switch protocol {
+	case "":
+		protocol = "tcp"
+	case "tcp", "ssl", "mqtts", "tls", "ws", "wss":
+	default:
+		return "", fmt.Errorf("unknown MQTT protocol %q, use tcp, ssl, ws or wss", conf.Protocol)
+	}
+	broker := url.URL{Scheme: protocol, Host: net.JoinHostPort(conf.Server, conf.Port)}
+	if protocol == "ws" || protocol == "wss" {
+		broker.Path = conf.Path
+		if broker.Path == "" {
+			broker.Path = "/mqtt"
+		}
+	}
+	return broker.String(), nil
+}
+
+// tlsConfig returns nil if nothing about TLS is configured, so that paho uses its defaults
+func tlsConfig(conf config.MqttTlsConfig) (*tls.Config, error) {
+	if conf == (config.MqttTlsConfig{}) {
+		return nil, nil
+	}
+	tlsConf := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if conf.CaFile != "" {
+		pem, err := os.ReadFile(conf.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", conf.CaFile)
+		}
+		tlsConf.RootCAs = pool
+	}
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		if conf.CertFile == "" || conf.KeyFile == "" {
+			return nil, errors.New("client certificate needs both certFile and keyFile")
+		}
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+// clientId is stable across restarts, so that broker can tell instances apart and keep their sessions
+func clientId(conf config.MqttConfig) string {
+	if conf.ClientId != "" {
+		return conf.ClientId
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "alarmserver"
+	}
+	return "alarmserver-" + hostname
+}
@@ -0,0 +1,239 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/events"
+	"hash/fnv"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	stateOn  = "ON"
+	stateOff = "OFF"
+)
+
+var unsafeIdChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+var manufacturers = map[string]string{
+	events.SourceHikvision: "Hikvision",
+	events.SourceDahua:     "Dahua",
+	events.SourceHisilicon: "HiSilicon",
+}
+
+// discovery announces cameras to Home Assistant. Every camera becomes a device, every event type a binary sensor
+// that is ON while alarm is on. Hikvision and Dahua cameras also get a connectivity sensor, which other sensors
+// use for availability. Sensors have their own state topics with ON and OFF, whatever the event payload is
+type discovery struct {
+	prefix    string
+	topicRoot string
+	offDelay  int             // SECONDS, 0 LEAVES SENSORS ON UNTIL ALARM END
+	alarmEnd  map[string]bool // SOURCES THAT SEND ALARM END, THEIR SENSORS DO NOT NEED OFF DELAY
+	lock      sync.Mutex
+	entities  map[string]*message // ANNOUNCEMENTS BY UNIQUE ID, REPEATED ON EVERY CONNECT
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model"`
+}
+
+type haBinarySensor struct {
+	Name                string   `json:"name"`
+	UniqueId            string   `json:"unique_id"`
+	StateTopic          string   `json:"state_topic"`
+	PayloadOn           string   `json:"payload_on"`
+	PayloadOff          string   `json:"payload_off"`
+	OffDelay            int      `json:"off_delay,omitempty"`
+	DeviceClass         string   `json:"device_class,omitempty"`
+	EntityCategory      string   `json:"entity_category,omitempty"`
+	AvailabilityTopic   string   `json:"availability_topic,omitempty"`
+	PayloadAvailable    string   `json:"payload_available,omitempty"`
+	PayloadNotAvailable string   `json:"payload_not_available,omitempty"`
+	Device              haDevice `json:"device"`
+}
+
+func newDiscovery(conf *config.Config) *discovery {
+	discovery := &discovery{
+		prefix:    strings.TrimSuffix(conf.Mqtt.HomeAssistant.DiscoveryPrefix, "/"),
+		topicRoot: conf.Mqtt.TopicRoot,
+		offDelay:  int(conf.Mqtt.HomeAssistant.OffDelay.Seconds()),
+		alarmEnd: map[string]bool{
+			events.SourceHikvision: conf.Hikvision.AlarmEnd,
+			events.SourceDahua:     conf.Dahua.AlarmEnd,
+			events.SourceHisilicon: conf.Hisilicon.AlarmEnd,
+			events.SourceFtp:       conf.Ftp.AlarmEnd,
+		},
+		entities: make(map[string]*message),
+	}
+	if discovery.prefix == "" {
+		discovery.prefix = "homeassistant"
+	}
+
+	// CONFIGURED CAMERAS SHOW UP BEFORE THEIR FIRST ALARM
+	eventTypes := conf.Mqtt.HomeAssistant.EventTypes
+	if conf.Hikvision.Enabled {
+		for _, camera := range conf.Hikvision.Cams {
+			discovery.addCamera(events.SourceHikvision, camera.Name, eventTypes[events.SourceHikvision])
+		}
+	}
+	if conf.Dahua.Enabled {
+		for _, camera := range conf.Dahua.Cams {
+			// CAMERA SUBSCRIBES TO THESE, UNLESS IT SUBSCRIBES TO "All"
+			var types []string
+			for _, eventType := range camera.Events {
+				if !strings.EqualFold(eventType, "All") {
+					types = append(types, eventType)
+				}
+			}
+			if len(types) == 0 {
+				types = eventTypes[events.SourceDahua]
+			}
+			discovery.addCamera(events.SourceDahua, camera.Name, types)
+		}
+	}
+	return discovery
+}
+
+func (discovery *discovery) addCamera(source string, camera string, eventTypes []string) {
+	discovery.announce(events.Event{Source: source, Camera: camera, Type: events.TypeAvailability})
+	for _, eventType := range eventTypes {
+		discovery.announce(events.Event{Source: source, Camera: camera, Type: eventType})
+	}
+}
+
+// all returns every announcement made so far
+func (discovery *discovery) all() []*message {
+	discovery.lock.Lock()
+	defer discovery.lock.Unlock()
+	announcements := make([]*message, 0, len(discovery.entities))
+	for _, announcement := range discovery.entities {
+		announcements = append(announcements, announcement)
+	}
+	return announcements
+}
+
+// observe returns what to publish for event: announcement of its sensor if it is new, and sensor state
+func (discovery *discovery) observe(event events.Event) []*message {
+	if event.Source == events.SourceTest {
+		// OR EVERY TEST WOULD LEAVE A SENSOR BEHIND IN HOME ASSISTANT
+		return nil
+	}
+	var messages []*message
+	if announcement := discovery.announce(event); announcement != nil {
+		messages = append(messages, announcement)
+	}
+	state := stateOn
+	if event.State == events.StateInactive {
+		state = stateOff
+	}
+	if event.Type == events.TypeAvailability {
+		state = stateOff
+		if event.Message == "online" {
+			state = stateOn
+		}
+	}
+	// CONNECTIVITY IS RETAINED, HOME ASSISTANT NEEDS IT AFTER RESTART TO SHOW OTHER SENSORS AS AVAILABLE
+	messages = append(messages, &message{
+		Topic:   discovery.stateTopic(event.Camera, event.Type),
+		Payload: state,
+		Retain:  event.Type == events.TypeAvailability,
+	})
+	return messages
+}
+
+// announce remembers sensor for event and returns its config message, nil if it was announced already
+func (discovery *discovery) announce(event events.Event) *message {
+	deviceId := "alarmserver_" + sanitizeId(event.Source) + "_" + slug(event.Camera)
+	uniqueId := deviceId + "_" + slug(event.Type)
+	discovery.lock.Lock()
+	defer discovery.lock.Unlock()
+	if _, known := discovery.entities[uniqueId]; known {
+		return nil
+	}
+
+	sensor := haBinarySensor{
+		Name:       event.Type,
+		UniqueId:   uniqueId,
+		StateTopic: discovery.stateTopic(event.Camera, event.Type),
+		PayloadOn:  stateOn,
+		PayloadOff: stateOff,
+		Device: haDevice{
+			Identifiers:  []string{deviceId},
+			Name:         event.Camera,
+			Manufacturer: manufacturers[event.Source],
+			Model:        event.Source,
+		},
+	}
+	streaming := event.Source == events.SourceHikvision || event.Source == events.SourceDahua
+	if event.Type == events.TypeAvailability {
+		sensor.Name = "connection"
+		sensor.DeviceClass = "connectivity"
+		sensor.EntityCategory = "diagnostic"
+	} else {
+		sensor.DeviceClass = deviceClass(event.Type)
+		if !discovery.alarmEnd[event.Source] {
+			sensor.OffDelay = discovery.offDelay
+		}
+		if streaming {
+			sensor.AvailabilityTopic = discovery.stateTopic(event.Camera, events.TypeAvailability)
+			sensor.PayloadAvailable = stateOn
+			sensor.PayloadNotAvailable = stateOff
+		}
+	}
+
+	payload, err := json.Marshal(sensor)
+	if err != nil {
+		log.Error("error marshaling discovery config", "camera", event.Camera, "event", event.Type, "error", err)
+		return nil
+	}
+	announcement := &message{
+		Topic:   discovery.prefix + "/binary_sensor/alarmserver/" + uniqueId + "/config",
+		Payload: string(payload),
+		Qos:     1,
+		Retain:  true,
+	}
+	discovery.entities[uniqueId] = announcement
+	log.Debug("announcing to home assistant", "camera", event.Camera, "event", event.Type)
+	return announcement
+}
+
+func (discovery *discovery) stateTopic(camera string, eventType string) string {
+	return discovery.topicRoot + "/" + slug(camera) + "/" + slug(eventType) + "/state"
+}
+
+// deviceClass guesses Home Assistant device class from event type names cameras use
+func deviceClass(eventType string) string {
+	eventType = strings.ToLower(eventType)
+	switch {
+	case eventType == "vmd" || strings.Contains(eventType, "motion"):
+		return "motion"
+	case strings.Contains(eventType, "videoloss"):
+		return "problem"
+	case strings.Contains(eventType, "tamper") || strings.Contains(eventType, "shelter"):
+		return "tamper"
+	case strings.Contains(eventType, "human") || strings.Contains(eventType, "face"):
+		return "occupancy"
+	}
+	return ""
+}
+
+func sanitizeId(id string) string {
+	return strings.Trim(unsafeIdChars.ReplaceAllString(strings.ToLower(id), "_"), "_")
+}
+
+// slug makes name fit for topics and ids, where slashes, MQTT wildcards and spaces would break them.
+// Names with nothing fit in them, like ones not in latin letters, get a hash of the name instead
+func slug(name string) string {
+	if slugged := sanitizeId(name); slugged != "" {
+		return slugged
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(name))
+	return fmt.Sprintf("%08x", hash.Sum32())
+}
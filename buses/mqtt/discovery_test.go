@@ -0,0 +1,221 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/servers/dahua"
+	"github.com/toxuin/alarmserver/servers/hikvision"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestDiscovery(conf config.Config) *discovery {
+	conf.Mqtt.TopicRoot = "cams"
+	conf.Mqtt.HomeAssistant.Enabled = true
+	return newDiscovery(&conf)
+}
+
+// sensor decodes announcement payload
+func sensor(t *testing.T, announcement *message) haBinarySensor {
+	t.Helper()
+	var sensor haBinarySensor
+	if err := json.Unmarshal([]byte(announcement.Payload), &sensor); err != nil {
+		t.Fatalf("announcement %q is not JSON: %v", announcement.Payload, err)
+	}
+	return sensor
+}
+
+func announcedTopics(discovery *discovery) []string {
+	var topics []string
+	for _, announcement := range discovery.all() {
+		topics = append(topics, announcement.Topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func TestDiscoveryAnnouncesSensorOnFirstEvent(t *testing.T) {
+	conf := config.Config{}
+	conf.Mqtt.HomeAssistant.DiscoveryPrefix = "ha/"
+	conf.Mqtt.HomeAssistant.OffDelay = 30 * time.Second
+	discovery := newTestDiscovery(conf)
+
+	messages := discovery.observe(events.Event{Source: events.SourceFtp, Camera: "Porch", Type: "ftpUpload", State: events.StateActive})
+	if len(messages) != 2 {
+		t.Fatalf("first event made %d messages, want announcement and state", len(messages))
+	}
+	announcement, state := messages[0], messages[1]
+	if want := "ha/binary_sensor/alarmserver/alarmserver_ftp_porch_ftpupload/config"; announcement.Topic != want {
+		t.Errorf("announcement topic is %q, want %q", announcement.Topic, want)
+	}
+	if !announcement.Retain || announcement.Qos != 1 {
+		t.Errorf("announcement is retained %v with qos %d, want retained with qos 1", announcement.Retain, announcement.Qos)
+	}
+	want := haBinarySensor{
+		Name:       "ftpUpload",
+		UniqueId:   "alarmserver_ftp_porch_ftpupload",
+		StateTopic: "cams/porch/ftpupload/state",
+		PayloadOn:  stateOn,
+		PayloadOff: stateOff,
+		OffDelay:   30,
+		Device: haDevice{
+			Identifiers: []string{"alarmserver_ftp_porch"},
+			Name:        "Porch",
+			Model:       events.SourceFtp,
+		},
+	}
+	if got := sensor(t, announcement); !reflect.DeepEqual(got, want) {
+		t.Errorf("sensor is %+v, want %+v", got, want)
+	}
+	if state.Topic != "cams/porch/ftpupload/state" || state.Payload != stateOn || state.Retain {
+		t.Errorf("state is %s %s retained %v, want cams/porch/ftpupload/state ON not retained", state.Topic, state.Payload, state.Retain)
+	}
+
+	messages = discovery.observe(events.Event{Source: events.SourceFtp, Camera: "Porch", Type: "ftpUpload", State: events.StateInactive})
+	if len(messages) != 1 {
+		t.Fatalf("second event made %d messages, want just state", len(messages))
+	}
+	if messages[0].Payload != stateOff {
+		t.Errorf("state of alarm end is %s, want %s", messages[0].Payload, stateOff)
+	}
+}
+
+func TestDiscoveryConfiguredCameras(t *testing.T) {
+	conf := config.Config{}
+	conf.Mqtt.HomeAssistant.OffDelay = 30 * time.Second
+	conf.Mqtt.HomeAssistant.EventTypes = map[string][]string{
+		events.SourceHikvision: {"VMD"},
+		events.SourceDahua:     {"VideoMotion"},
+	}
+	conf.Hikvision.Enabled = true
+	conf.Hikvision.AlarmEnd = true
+	conf.Hikvision.Cams = []hikvision.HikCamera{{Name: "Porch"}}
+	conf.Dahua.Enabled = true
+	conf.Dahua.Cams = []dahua.DhCamera{
+		{Name: "Garage", Events: []string{"All"}},
+		{Name: "Gate", Events: []string{"CrossLineDetection"}},
+	}
+	discovery := newTestDiscovery(conf)
+
+	want := []string{
+		"homeassistant/binary_sensor/alarmserver/alarmserver_dahua_garage_availability/config",
+		"homeassistant/binary_sensor/alarmserver/alarmserver_dahua_garage_videomotion/config",
+		"homeassistant/binary_sensor/alarmserver/alarmserver_dahua_gate_availability/config",
+		"homeassistant/binary_sensor/alarmserver/alarmserver_dahua_gate_crosslinedetection/config",
+		"homeassistant/binary_sensor/alarmserver/alarmserver_hikvision_porch_availability/config",
+		"homeassistant/binary_sensor/alarmserver/alarmserver_hikvision_porch_vmd/config",
+	}
+	if got := announcedTopics(discovery); !reflect.DeepEqual(got, want) {
+		t.Errorf("announced %v, want %v", got, want)
+	}
+
+	sensors := make(map[string]haBinarySensor)
+	for _, announcement := range discovery.all() {
+		sensor := sensor(t, announcement)
+		sensors[sensor.UniqueId] = sensor
+	}
+	connection := sensors["alarmserver_hikvision_porch_availability"]
+	if connection.Name != "connection" || connection.DeviceClass != "connectivity" || connection.EntityCategory != "diagnostic" {
+		t.Errorf("connection sensor is %+v, want diagnostic connectivity sensor named connection", connection)
+	}
+	if connection.AvailabilityTopic != "" {
+		t.Errorf("connection sensor depends on availability topic %q, want none", connection.AvailabilityTopic)
+	}
+
+	motion := sensors["alarmserver_hikvision_porch_vmd"]
+	if motion.DeviceClass != "motion" || motion.Device.Manufacturer != "Hikvision" {
+		t.Errorf("motion sensor is %+v, want motion class made by Hikvision", motion)
+	}
+	if motion.OffDelay != 0 {
+		t.Errorf("off delay of sensor that gets alarm end is %d, want none", motion.OffDelay)
+	}
+	if motion.AvailabilityTopic != "cams/porch/availability/state" || motion.PayloadAvailable != stateOn || motion.PayloadNotAvailable != stateOff {
+		t.Errorf("motion sensor availability is %s %s/%s, want cams/porch/availability/state ON/OFF",
+			motion.AvailabilityTopic, motion.PayloadAvailable, motion.PayloadNotAvailable)
+	}
+	if garage := sensors["alarmserver_dahua_garage_videomotion"]; garage.OffDelay != 30 {
+		t.Errorf("off delay of sensor without alarm end is %d, want 30", garage.OffDelay)
+	}
+}
+
+func TestDiscoveryAvailabilityState(t *testing.T) {
+	discovery := newTestDiscovery(config.Config{})
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{"online", stateOn},
+		{"offline", stateOff},
+		{"connecting", stateOff},
+		{"auth-failed", stateOff},
+	}
+	for _, test := range tests {
+		t.Run(test.message, func(t *testing.T) {
+			messages := discovery.observe(events.Event{Source: events.SourceHikvision, Camera: "porch", Type: events.TypeAvailability, Message: test.message})
+			state := messages[len(messages)-1]
+			if state.Topic != "cams/porch/availability/state" || state.Payload != test.want || !state.Retain {
+				t.Errorf("state is %s %s retained %v, want cams/porch/availability/state %s retained", state.Topic, state.Payload, state.Retain, test.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverySkipsTestEvents(t *testing.T) {
+	discovery := newTestDiscovery(config.Config{})
+	if messages := discovery.observe(events.Event{Source: events.SourceTest, Camera: "porch", Type: "test"}); messages != nil {
+		t.Errorf("test event made %d messages, want none", len(messages))
+	}
+	if announced := discovery.all(); len(announced) != 0 {
+		t.Errorf("test event left %d sensors behind, want none", len(announced))
+	}
+}
+
+func TestSlug(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"porch", "porch"},
+		{"Front Door", "front_door"},
+		{"garage/left", "garage_left"},
+		{"cam+1", "cam_1"},
+		{"#cam#", "cam"},
+		{"  back--yard_2 ", "back--yard_2"},
+		{"gate / side + #", "gate_side"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := slug(test.name); got != test.want {
+				t.Errorf("slug is %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSlugOfNonLatinName(t *testing.T) {
+	first, second := slug("крыльцо"), slug("гараж")
+	if len(first) != 8 || unsafeIdChars.MatchString(first) {
+		t.Errorf("slug of non-latin name is %q, want 8 hex digits", first)
+	}
+	if first == second {
+		t.Errorf("different names have same slug %q", first)
+	}
+	if again := slug("крыльцо"); again != first {
+		t.Errorf("slug changed from %q to %q", first, again)
+	}
+
+	discovery := newTestDiscovery(config.Config{})
+	messages := discovery.observe(events.Event{Source: events.SourceHisilicon, Camera: "крыльцо", Type: "alarm"})
+	if want := "homeassistant/binary_sensor/alarmserver/alarmserver_hisilicon_" + first + "_alarm/config"; messages[0].Topic != want {
+		t.Errorf("announcement topic is %q, want %q", messages[0].Topic, want)
+	}
+	if want := "cams/" + first + "/alarm/state"; messages[1].Topic != want {
+		t.Errorf("state topic is %q, want %q", messages[1].Topic, want)
+	}
+	if name := sensor(t, messages[0]).Device.Name; name != "крыльцо" {
+		t.Errorf("device name is %q, want крыльцо", name)
+	}
+}
@@ -0,0 +1,95 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/events"
+	"strings"
+	"text/template"
+)
+
+const (
+	defaultTopicTemplate = "{{ .TopicRoot }}/{{ .Camera }}/{{ .Event }}"
+	payloadRaw           = "raw"
+	payloadJson          = "json"
+	payloadTemplate      = "template"
+)
+
+// templateFuncs let payload template write JSON, like {{ json .Meta }}
+var templateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+// formatter turns events into topics and payloads, as configured
+type formatter struct {
+	topicRoot string
+	topic     *template.Template
+	format    string
+	payload   *template.Template // ONLY FOR template FORMAT
+}
+
+func newFormatter(conf config.MqttConfig) (*formatter, error) {
+	formatter := &formatter{topicRoot: conf.TopicRoot, format: strings.ToLower(conf.PayloadFormat)}
+	topicTemplate := conf.TopicTemplate
+	if topicTemplate == "" {
+		topicTemplate = defaultTopicTemplate
+	}
+	var err error
+	if formatter.topic, err = template.New("topic").Parse(topicTemplate); err != nil {
+		return nil, fmt.Errorf("unable to parse MQTT topic template: %w", err)
+	}
+	switch formatter.format {
+	case "":
+		formatter.format = payloadRaw
+	case payloadRaw, payloadJson:
+	case payloadTemplate:
+		if conf.PayloadTemplate == "" {
+			return nil, errors.New("MQTT payload format is template, but payloadTemplate is empty")
+		}
+		formatter.payload, err = template.New("payload").Funcs(templateFuncs).Parse(conf.PayloadTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse MQTT payload template: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown MQTT payload format %q, use raw, json or template", conf.PayloadFormat)
+	}
+	return formatter, nil
+}
+
+func (formatter *formatter) topicOf(event events.Event) (string, error) {
+	var topic bytes.Buffer
+	if err := formatter.topic.Execute(&topic, formatter.vars(event)); err != nil {
+		return "", err
+	}
+	return topic.String(), nil
+}
+
+// payloadOf returns what camera sent for raw format, event without raw camera data for json,
+// or whatever payload template makes of it
+func (formatter *formatter) payloadOf(event events.Event) (string, error) {
+	switch formatter.format {
+	case payloadJson:
+		event.Raw = ""
+		payload, err := json.Marshal(event)
+		return string(payload), err
+	case payloadTemplate:
+		var payload bytes.Buffer
+		if err := formatter.payload.Execute(&payload, formatter.vars(event)); err != nil {
+			return "", err
+		}
+		return payload.String(), nil
+	}
+	return event.Message, nil
+}
+
+func (formatter *formatter) vars(event events.Event) map[string]interface{} {
+	vars := event.TemplateVars()
+	vars["TopicRoot"] = formatter.topicRoot
+	return vars
+}
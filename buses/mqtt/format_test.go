@@ -0,0 +1,121 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/events"
+	"strings"
+	"testing"
+)
+
+func testEvent() events.Event {
+	event := events.Event{
+		Source:  events.SourceHikvision,
+		Camera:  "porch",
+		Channel: "1",
+		Type:    "VMD",
+		State:   events.StateActive,
+		Message: "motion",
+		Raw:     "<EventNotificationAlert/>",
+	}
+	event.SetMeta("region", "2")
+	return event
+}
+
+func TestFormatterTopic(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		topic    string
+	}{
+		{"default", "", "cameras/porch/VMD"},
+		{"custom", "{{ .TopicRoot }}/{{ .Source }}/{{ .Camera }}/{{ .Channel }}/{{ .Event }}", "cameras/hikvision/porch/1/VMD"},
+		{"metadata", "alarms/{{ .Camera }}/{{ .Meta.region }}", "alarms/porch/2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			formatter, err := newFormatter(config.MqttConfig{TopicRoot: "cameras", TopicTemplate: test.template})
+			if err != nil {
+				t.Fatal(err)
+			}
+			topic, err := formatter.topicOf(testEvent())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if topic != test.topic {
+				t.Errorf("topic is %q, want %q", topic, test.topic)
+			}
+		})
+	}
+}
+
+func TestFormatterPayload(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		template string
+		payload  string
+	}{
+		{"default is raw", "", "", "motion"},
+		{"raw", "raw", "", "motion"},
+		{"format is case insensitive", "RAW", "", "motion"},
+		{"template", "template", `{{ .Camera }} {{ .State }} {{ json .Meta }}`, `porch active {"region":"2"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			formatter, err := newFormatter(config.MqttConfig{PayloadFormat: test.format, PayloadTemplate: test.template})
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload, err := formatter.payloadOf(testEvent())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if payload != test.payload {
+				t.Errorf("payload is %q, want %q", payload, test.payload)
+			}
+		})
+	}
+}
+
+func TestFormatterJsonPayloadLeavesRawOut(t *testing.T) {
+	formatter, err := newFormatter(config.MqttConfig{PayloadFormat: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := formatter.payloadOf(testEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := events.Event{}
+	if err := json.Unmarshal([]byte(payload), &decoded); err != nil {
+		t.Fatalf("payload is not JSON: %v", err)
+	}
+	if decoded.Camera != "porch" || decoded.Type != "VMD" || decoded.Metadata["region"] != "2" {
+		t.Errorf("payload is %s", payload)
+	}
+	if strings.Contains(payload, "EventNotificationAlert") {
+		t.Errorf("payload has raw camera data: %s", payload)
+	}
+}
+
+func TestNewFormatterBadConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  config.MqttConfig
+		error string
+	}{
+		{"broken topic template", config.MqttConfig{TopicTemplate: "{{ .Camera"}, "topic template"},
+		{"unknown format", config.MqttConfig{PayloadFormat: "xml"}, "unknown MQTT payload format"},
+		{"template without template", config.MqttConfig{PayloadFormat: "template"}, "payloadTemplate is empty"},
+		{"broken payload template", config.MqttConfig{PayloadFormat: "template", PayloadTemplate: "{{ .Camera"}, "payload template"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newFormatter(test.conf)
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("error is %v, want one with %q", err, test.error)
+			}
+		})
+	}
+}
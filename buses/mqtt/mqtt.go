@@ -1,67 +1,413 @@
 package mqtt
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/toxuin/alarmserver/buses"
 	"github.com/toxuin/alarmserver/config"
-	"math/rand"
-	"strconv"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/logging"
+	"github.com/toxuin/alarmserver/metrics"
+	"strings"
+	"sync"
 	"time"
 )
 
+var log = logging.For("mqtt")
+
+var (
+	errNotConnected = errors.New("client not connected")
+	errBufferFull   = errors.New("offline buffer is full, message dropped")
+)
+
+const (
+	connectTimeout    = 5 * time.Second
+	flushPollInterval = 100 * time.Millisecond
+	dropPolicyNewest  = "newest"
+)
+
 type Bus struct {
-	Debug  bool
-	client MQTT.Client
+	topicRoot      string
+	client         MQTT.Client
+	lock           sync.Mutex // GUARDS BUFFER AND KEEPS BUFFERED MESSAGES IN ORDER
+	buffer         buffer
+	bufferSize     int
+	dropNewest     bool
+	qos            byte
+	retain         bool
+	overrides      map[string]config.MqttPublishConfig
+	discovery      *discovery // NIL IF HOME ASSISTANT DISCOVERY IS OFF
+	formatter      *formatter
+	flushing       bool
+	commands       bool // LISTEN ON COMMAND TOPIC
+	commandLock    sync.RWMutex
+	commandHandler buses.CommandHandler
+	stats          buses.StatsCounter
+	buses.Reporter
 }
 
-func (mqtt *Bus) Initialize(config config.MqttConfig) {
-	fmt.Println("Initializing MQTT bus...")
-	mqttOpts := MQTT.NewClientOptions().AddBroker("tcp://" + config.Server + ":" + config.Port)
+func init() {
+	buses.Register("mqtt", func() buses.Bus { return &Bus{} })
+}
+
+func (mqtt *Bus) Initialize(ctx context.Context, conf *config.Config) error {
+	config := conf.Mqtt
+	log.Info("initializing MQTT bus...")
+	broker, err := brokerUrl(config)
+	if err != nil {
+		return err
+	}
+	tlsConf, err := tlsConfig(config.Tls)
+	if err != nil {
+		return fmt.Errorf("MQTT TLS: %w", err)
+	}
+	if err := checkQos(config); err != nil {
+		return err
+	}
+	if mqtt.formatter, err = newFormatter(config); err != nil {
+		return err
+	}
+	mqtt.topicRoot = config.TopicRoot
+	mqtt.qos = byte(config.Qos)
+	mqtt.retain = config.Retain
+	mqtt.overrides = config.Overrides
+	mqtt.commands = config.Commands
+	if config.HomeAssistant.Enabled {
+		mqtt.discovery = newDiscovery(conf)
+	}
+	mqtt.bufferSize = config.Buffer.Size
+	mqtt.dropNewest = strings.EqualFold(config.Buffer.DropPolicy, dropPolicyNewest)
+	if config.Buffer.Path != "" {
+		diskBuffer, err := openDiskBuffer(config.Buffer.Path)
+		if err != nil {
+			return fmt.Errorf("unable to open MQTT buffer %s: %w", config.Buffer.Path, err)
+		}
+		if diskBuffer.len() > 0 {
+			log.Info("found buffered messages from last run", "count", diskBuffer.len())
+		}
+		mqtt.buffer = diskBuffer
+	} else {
+		mqtt.buffer = &memoryBuffer{}
+	}
+	metrics.MqttBuffered(mqtt.buffer.len())
+
+	mqttOpts := MQTT.NewClientOptions().AddBroker(broker)
+	if tlsConf != nil {
+		mqttOpts.SetTLSConfig(tlsConf)
+	}
 	mqttOpts.SetUsername(config.Username)
 	if config.Password != "" {
 		mqttOpts.SetPassword(config.Password)
 	}
 	mqttOpts.SetAutoReconnect(true)
 	mqttOpts.SetMaxReconnectInterval(10 * time.Second)
+	// KEEP TRYING IF BROKER IS DOWN AT START, EVENTS ARE BUFFERED MEANWHILE
+	mqttOpts.SetConnectRetry(true)
+	mqttOpts.SetConnectRetryInterval(10 * time.Second)
 
-	mqttOpts.SetClientID("alarmserver-go-" + strconv.Itoa(rand.Intn(100)))
+	mqttOpts.SetClientID(clientId(config))
 	mqttOpts.SetKeepAlive(2 * time.Second)
 	mqttOpts.SetPingTimeout(1 * time.Second)
-	mqttOpts.SetWill(config.TopicRoot+"/alarmserver", `{ "status": "down" }`, 0, false)
+	mqttOpts.SetWill(config.TopicRoot+"/alarmserver", `{ "status": "down" }`, mqtt.qos, mqtt.retain)
 
 	mqttOpts.OnConnect = func(client MQTT.Client) {
-		fmt.Printf("MQTT: CONNECTED TO %s\n", config.Server)
-		mqtt.SendMessage(config.TopicRoot+"/alarmserver", `{ "status": "up" }`)
+		log.Info("connected", "broker", broker)
+		metrics.MqttConnected(true)
+		// STATUS GOES FIRST, IT IS ABOUT NOW. BUFFERED MESSAGES ARE ABOUT THE PAST
+		_ = mqtt.deliver(&message{
+			Topic:   config.TopicRoot + "/alarmserver",
+			Payload: `{ "status": "up" }`,
+			Qos:     mqtt.qos,
+			Retain:  mqtt.retain,
+		})
+		if mqtt.discovery != nil {
+			// BROKER MIGHT HAVE LOST RETAINED ANNOUNCEMENTS, AND NEW CAMERAS MIGHT HAVE COME UP WHILE OFFLINE
+			for _, announcement := range mqtt.discovery.all() {
+				_ = mqtt.deliver(announcement)
+			}
+		}
+		if mqtt.commands {
+			mqtt.subscribe(client)
+		}
+		mqtt.flush()
 	}
 
 	mqttOpts.SetConnectionLostHandler(func(client MQTT.Client, err error) {
-		fmt.Printf("MQTT ERROR - connection lost: %+v\n", err)
+		log.Error("connection lost", "error", err)
+		metrics.MqttConnected(false)
 	})
 	mqttOpts.SetReconnectingHandler(func(client MQTT.Client, options *MQTT.ClientOptions) {
-		fmt.Println("MQTT: ...trying to reconnect...")
+		log.Info("trying to reconnect...")
 	})
 
 	mqttOpts.DefaultPublishHandler = func(client MQTT.Client, msg MQTT.Message) {
-		if mqtt.Debug {
-			fmt.Printf("  MQTT: TOPIC: %s\n  MQTT: MESSAGE: %s\n", msg.Topic(), msg.Payload())
-		}
+		log.Debug("received message", "topic", msg.Topic(), "message", string(msg.Payload()))
 	}
 
 	mqtt.client = MQTT.NewClient(mqttOpts)
-	if token := mqtt.client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+	token := mqtt.client.Connect()
+	select {
+	case <-token.Done():
+		err = token.Error()
+	case <-time.After(connectTimeout):
+		log.Warn("broker is not reachable yet, buffering messages until it is", "server", config.Server)
+	case <-ctx.Done():
+		mqtt.client.Disconnect(0)
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = mqtt.buffer.close()
+	}
+	return err
+}
+
+func (mqtt *Bus) Send(event events.Event) {
+	qos, retain := mqtt.publishOptions(event.Type)
+	topic, err := mqtt.formatter.topicOf(event)
+	if err != nil {
+		log.Error("error rendering topic template", "camera", event.Camera, "event", event.Type, "error", err)
+		mqtt.drop(&message{Topic: topic, EventID: event.ID}, err)
+		return
+	}
+	payload, err := mqtt.formatter.payloadOf(event)
+	if err != nil {
+		log.Error("error rendering payload", "camera", event.Camera, "event", event.Type, "error", err)
+		mqtt.drop(&message{Topic: topic, EventID: event.ID}, err)
+		return
+	}
+	_ = mqtt.publish(&message{Topic: topic, Payload: payload, Qos: qos, Retain: retain, EventID: event.ID})
+	if mqtt.discovery != nil {
+		for _, haMessage := range mqtt.discovery.observe(event) {
+			if haMessage.Qos < qos {
+				haMessage.Qos = qos
+			}
+			_ = mqtt.publish(haMessage)
+		}
+	}
+}
+
+// publishOptions returns QoS and retain flag for event type, from overrides if there are any
+func (mqtt *Bus) publishOptions(eventType string) (byte, bool) {
+	qos, retain := mqtt.qos, mqtt.retain
+	// AVAILABILITY IS RETAINED, SO THAT NEW SUBSCRIBERS KNOW IF CAMERA IS ONLINE RIGHT AWAY
+	if eventType == events.TypeAvailability {
+		retain = true
+	}
+	if override, found := mqtt.overrides[strings.ToLower(eventType)]; found {
+		if override.Qos != nil {
+			qos = byte(*override.Qos)
+		}
+		if override.Retain != nil {
+			retain = *override.Retain
+		}
+	}
+	return qos, retain
+}
+
+func checkQos(conf config.MqttConfig) error {
+	if conf.Qos < 0 || conf.Qos > 2 {
+		return fmt.Errorf("MQTT qos must be 0, 1 or 2, not %d", conf.Qos)
+	}
+	for eventType, override := range conf.Overrides {
+		if override.Qos != nil && (*override.Qos < 0 || *override.Qos > 2) {
+			return fmt.Errorf("MQTT qos for %s must be 0, 1 or 2, not %d", eventType, *override.Qos)
+		}
+	}
+	return nil
+}
+
+func (mqtt *Bus) Health() buses.Health {
+	mqtt.lock.Lock()
+	buffered := mqtt.buffer.len()
+	mqtt.lock.Unlock()
+	if mqtt.client == nil || !mqtt.client.IsConnectionOpen() {
+		return buses.Health{
+			Healthy: false,
+			Status:  fmt.Sprintf("disconnected, %d buffered", buffered),
+			Stats:   mqtt.stats.Snapshot(),
+		}
 	}
+	status := "connected"
+	if buffered > 0 {
+		status = fmt.Sprintf("connected, flushing %d buffered", buffered)
+	}
+	return buses.Health{Healthy: true, Status: status, Stats: mqtt.stats.Snapshot()}
 }
 
-func (mqtt *Bus) SendMessage(topic string, payload interface{}) {
-	if !mqtt.client.IsConnected() {
-		fmt.Println("MQTT: CLIENT NOT CONNECTED")
+// Close flushes buffer if connected, announces that alarm server is going down and disconnects,
+// giving up when ctx is done
+func (mqtt *Bus) Close(ctx context.Context) error {
+	if mqtt.client == nil {
+		return nil
+	}
+	defer mqtt.closeBuffer()
+	if mqtt.client.IsConnectionOpen() {
+		mqtt.waitFlushed(ctx)
+		token := mqtt.client.Publish(mqtt.topicRoot+"/alarmserver", mqtt.qos, mqtt.retain, `{ "status": "down" }`)
+		select {
+		case <-token.Done():
+			if token.Error() != nil {
+				log.Error("error publishing offline status", "error", token.Error())
+			}
+		case <-ctx.Done():
+			log.Warn("shutdown deadline reached before offline status was published")
+		}
+	}
+	mqtt.client.Disconnect(250)
+	metrics.MqttConnected(false)
+	return nil
+}
+
+func (mqtt *Bus) waitFlushed(ctx context.Context) {
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+	for {
+		mqtt.lock.Lock()
+		buffered := mqtt.buffer.len()
+		mqtt.lock.Unlock()
+		if buffered == 0 || !mqtt.client.IsConnectionOpen() {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (mqtt *Bus) closeBuffer() {
+	mqtt.lock.Lock()
+	defer mqtt.lock.Unlock()
+	if buffered := mqtt.buffer.len(); buffered > 0 {
+		if _, onDisk := mqtt.buffer.(*diskBuffer); onDisk {
+			log.Info("buffered messages are kept for next start", "count", buffered)
+		} else {
+			log.Warn("buffered messages are lost", "count", buffered)
+		}
+	}
+	if err := mqtt.buffer.close(); err != nil {
+		log.Error("error closing buffer", "error", err)
+	}
+}
+
+// publish sends message right away, or buffers it if broker is not there or older messages are still waiting.
+// Returns error if message was dropped
+func (mqtt *Bus) publish(message *message) error {
+	mqtt.lock.Lock()
+	if mqtt.buffer.len() == 0 && mqtt.client.IsConnectionOpen() {
+		mqtt.lock.Unlock()
+		err := mqtt.deliver(message)
+		if err == nil || mqtt.client.IsConnectionOpen() {
+			return err
+		}
+		// CONNECTION DROPPED WHILE SENDING, BUFFER IT AFTER ALL
+		mqtt.lock.Lock()
+	}
+	defer mqtt.lock.Unlock()
+	err := mqtt.enqueue(message)
+	if err == nil && mqtt.client.IsConnectionOpen() {
+		go mqtt.flush() // PREVIOUS FLUSH MIGHT HAVE GIVEN UP
+	}
+	return err
+}
+
+// enqueue adds message to buffer, dropping oldest or this one if it is full. Lock must be held
+func (mqtt *Bus) enqueue(message *message) error {
+	if mqtt.bufferSize <= 0 {
+		log.Warn("client not connected, dropping message", "topic", message.Topic)
+		mqtt.drop(message, errNotConnected)
+		return errNotConnected
+	}
+	if mqtt.buffer.len() >= mqtt.bufferSize {
+		if mqtt.dropNewest {
+			log.Warn("offline buffer is full, dropping message", "topic", message.Topic)
+			mqtt.drop(message, errBufferFull)
+			return errBufferFull
+		}
+		oldest, err := mqtt.buffer.peek()
+		if err == nil && oldest != nil {
+			err = mqtt.buffer.pop()
+		}
+		if err != nil {
+			log.Error("error dropping oldest buffered message", "error", err)
+			mqtt.drop(message, err)
+			return err
+		}
+		log.Warn("offline buffer is full, dropping oldest message", "topic", oldest.Topic)
+		mqtt.drop(oldest, errBufferFull)
+	}
+	message.Queued = time.Now()
+	if err := mqtt.buffer.push(message); err != nil {
+		log.Error("error buffering message", "topic", message.Topic, "error", err)
+		mqtt.drop(message, err)
+		return err
+	}
+	metrics.MqttBuffered(mqtt.buffer.len())
+	log.Debug("buffered message", "topic", message.Topic, "buffered", mqtt.buffer.len())
+	return nil
+}
+
+func (mqtt *Bus) drop(message *message, err error) {
+	mqtt.stats.Failed(err)
+	mqtt.Report(message.EventID, events.Delivery{Bus: "mqtt", Target: message.Topic, Attempt: 1}, err)
+}
+
+// flush sends buffered messages in order, until buffer is empty or connection is gone
+func (mqtt *Bus) flush() {
+	mqtt.lock.Lock()
+	if mqtt.flushing {
+		mqtt.lock.Unlock()
 		return
 	}
-	if token := mqtt.client.Publish(topic, 0, false, payload); token.Wait() && token.Error() != nil {
-		fmt.Printf("MQTT ERROR, %s\n", token.Error())
+	mqtt.flushing = true
+	mqtt.lock.Unlock()
+	defer func() {
+		mqtt.lock.Lock()
+		mqtt.flushing = false
+		mqtt.lock.Unlock()
+	}()
+
+	flushed := 0
+	for mqtt.client.IsConnectionOpen() {
+		// LOCK IS HELD WHILE SENDING, SO THAT NEW MESSAGES LINE UP BEHIND AND OLDEST ONE IS NOT DROPPED MEANWHILE
+		mqtt.lock.Lock()
+		oldest, err := mqtt.buffer.peek()
+		if err == nil && oldest != nil {
+			if err = mqtt.deliver(oldest); err == nil {
+				err = mqtt.buffer.pop()
+			}
+		}
+		metrics.MqttBuffered(mqtt.buffer.len())
+		mqtt.lock.Unlock()
+		if err != nil {
+			log.Warn("flushing buffer interrupted", "flushed", flushed, "error", err)
+			return
+		}
+		if oldest == nil {
+			break
+		}
+		flushed++
+	}
+	if flushed > 0 {
+		log.Info("flushed buffered messages", "count", flushed)
 	}
-	if mqtt.Debug {
-		fmt.Printf("MQTT: Sent message to %s\n", topic)
+}
+
+// deliver publishes message and reports how it went
+func (mqtt *Bus) deliver(message *message) error {
+	token := mqtt.client.Publish(message.Topic, message.Qos, message.Retain, message.Payload)
+	token.Wait()
+	err := token.Error()
+	if err != nil {
+		log.Error("error publishing message", "topic", message.Topic, "error", err)
+		mqtt.stats.Failed(err)
+	} else {
+		mqtt.stats.Delivered()
+		log.Debug("sent message", "topic", message.Topic)
 	}
+	mqtt.Report(message.EventID, events.Delivery{Bus: "mqtt", Target: message.Topic, Attempt: 1}, err)
+	return err
 }
@@ -0,0 +1,32 @@
+package buses
+
+import (
+	"errors"
+	"github.com/toxuin/alarmserver/events"
+	"time"
+)
+
+var ErrUnknownItem = errors.New("no such outbox item")
+
+// OutboxItem is an event waiting for delivery to one target, or one that was given up on
+type OutboxItem struct {
+	ID          string       `json:"id"`
+	Target      string       `json:"target"`
+	Event       events.Event `json:"event"`
+	Attempts    int          `json:"attempts"`
+	Created     time.Time    `json:"created"`
+	NextAttempt *time.Time   `json:"nextAttempt,omitempty"`
+	LastStatus  int          `json:"lastStatus,omitempty"`
+	LastError   string       `json:"lastError,omitempty"`
+}
+
+// Outbox is implemented by buses that keep undelivered events until they get through
+type Outbox interface {
+	Pending() ([]OutboxItem, error)
+	DeadLetters() ([]OutboxItem, error)
+	// Replay sends dead letter with ID again, as if it was new
+	Replay(id string) error
+	// ReplayAll sends all dead letters again and returns how many there were
+	ReplayAll() (int, error)
+	Discard(id string) error
+}
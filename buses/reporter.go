@@ -0,0 +1,42 @@
+package buses
+
+import (
+	"github.com/toxuin/alarmserver/events"
+	"sync"
+	"time"
+)
+
+// DeliveryReporting is implemented by buses that can tell whether each event got delivered
+type DeliveryReporting interface {
+	SetDeliveryReporter(reporter events.DeliveryReporter)
+}
+
+// Reporter is meant to be embedded into buses to implement DeliveryReporting
+type Reporter struct {
+	lock     sync.RWMutex
+	reporter events.DeliveryReporter
+}
+
+func (reporter *Reporter) SetDeliveryReporter(deliveryReporter events.DeliveryReporter) {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	reporter.reporter = deliveryReporter
+}
+
+// Report passes delivery on, if there is anyone to listen and event has ID. Error makes delivery failed
+func (reporter *Reporter) Report(eventID string, delivery events.Delivery, err error) {
+	reporter.lock.RLock()
+	deliveryReporter := reporter.reporter
+	reporter.lock.RUnlock()
+	if deliveryReporter == nil || eventID == "" {
+		return
+	}
+	if delivery.Time.IsZero() {
+		delivery.Time = time.Now()
+	}
+	delivery.Success = err == nil
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	deliveryReporter(eventID, delivery)
+}
@@ -0,0 +1,46 @@
+package buses
+
+import (
+	"sync"
+	"time"
+)
+
+type Stats struct {
+	Delivered   uint64     `json:"delivered"`
+	Failed      uint64     `json:"failed"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+	LastSentAt  *time.Time `json:"lastSentAt,omitempty"`
+}
+
+// StatsCounter counts deliveries of a bus, embed it and report Snapshot in Health
+type StatsCounter struct {
+	lock  sync.Mutex
+	stats Stats
+}
+
+func (counter *StatsCounter) Delivered() {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	counter.stats.Delivered++
+	now := time.Now()
+	counter.stats.LastSentAt = &now
+}
+
+func (counter *StatsCounter) Failed(err error) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	counter.stats.Failed++
+	now := time.Now()
+	counter.stats.LastErrorAt = &now
+	if err != nil {
+		counter.stats.LastError = err.Error()
+	}
+}
+
+func (counter *StatsCounter) Snapshot() *Stats {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	stats := counter.stats
+	return &stats
+}
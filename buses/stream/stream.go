@@ -0,0 +1,315 @@
+package stream
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/toxuin/alarmserver/buses"
+	"github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/logging"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logging.For("stream")
+
+var errSlowClient = errors.New("client is too slow, event dropped")
+
+const (
+	keepAliveInterval = 15 * time.Second
+	writeTimeout      = 10 * time.Second
+)
+
+// Bus streams events to HTTP clients over Server-Sent Events, or over WebSocket if client asks to upgrade.
+// It is an http.Handler, served by HTTP listener
+type Bus struct {
+	token          string
+	allowedOrigins []string
+	bufferSize     int
+	ctx            context.Context
+	cancel         context.CancelFunc
+	upgrader       websocket.Upgrader
+	lock           sync.RWMutex
+	clients        map[*subscriber]struct{}
+	stats          buses.StatsCounter
+}
+
+type subscriber struct {
+	filter filter
+	events chan events.Event
+}
+
+// filter is what client asked for in query string. Empty list matches everything
+type filter struct {
+	sources []string
+	cameras []string
+	types   []string
+}
+
+func init() {
+	buses.Register("stream", func() buses.Bus { return &Bus{} })
+}
+
+func (stream *Bus) Initialize(ctx context.Context, appConf *config.Config) error {
+	conf := appConf.Stream
+	log.Info("initializing event stream bus...")
+	stream.ctx, stream.cancel = context.WithCancel(ctx)
+	stream.token = conf.Token
+	stream.allowedOrigins = conf.AllowedOrigins
+	stream.bufferSize = conf.BufferSize
+	if stream.bufferSize <= 0 {
+		stream.bufferSize = 64 // DEFAULT BUFFER SIZE
+	}
+	stream.upgrader = websocket.Upgrader{
+		HandshakeTimeout: writeTimeout,
+		CheckOrigin:      stream.originAllowed,
+	}
+	stream.clients = make(map[*subscriber]struct{})
+	return nil
+}
+
+func (stream *Bus) Send(event events.Event) {
+	stream.lock.RLock()
+	defer stream.lock.RUnlock()
+	for client := range stream.clients {
+		if !client.filter.matches(event) {
+			continue
+		}
+		// NEVER LET ONE SLOW CLIENT HOLD UP EVENTS
+		select {
+		case client.events <- event:
+		default:
+			stream.stats.Failed(errSlowClient)
+		}
+	}
+}
+
+func (stream *Bus) Health() buses.Health {
+	stream.lock.RLock()
+	defer stream.lock.RUnlock()
+	return buses.Health{
+		Healthy: true,
+		Status:  fmt.Sprintf("%d clients", len(stream.clients)),
+		Stats:   stream.stats.Snapshot(),
+	}
+}
+
+// Close disconnects all clients
+func (stream *Bus) Close(ctx context.Context) error {
+	if stream.cancel != nil {
+		stream.cancel()
+	}
+	return nil
+}
+
+func (stream *Bus) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if !stream.authorized(request) {
+		writer.Header().Set("WWW-Authenticate", `Bearer realm="alarmserver"`)
+		http.Error(writer, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !stream.originAllowed(request) {
+		http.Error(writer, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if websocket.IsWebSocketUpgrade(request) {
+		stream.serveWebSocket(writer, request)
+		return
+	}
+	stream.serveEventSource(writer, request)
+}
+
+// authorized checks token in headers, or in "token" query parameter because browsers cannot set headers
+// on EventSource and WebSocket
+func (stream *Bus) authorized(request *http.Request) bool {
+	if stream.token == "" {
+		return true
+	}
+	token := request.URL.Query().Get("token")
+	if headerToken := request.Header.Get("X-Api-Token"); headerToken != "" {
+		token = headerToken
+	}
+	if bearer, found := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer "); found {
+		token = bearer
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(stream.token)) == 1
+}
+
+// originAllowed lets in clients that are not browsers, same origin pages and allowedOrigins from config
+func (stream *Bus) originAllowed(request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range stream.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	originUrl, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(originUrl.Host, request.Host)
+}
+
+func (stream *Bus) subscribe(request *http.Request) *subscriber {
+	query := request.URL.Query()
+	client := &subscriber{
+		filter: filter{
+			sources: queryList(query, "source"),
+			cameras: queryList(query, "camera"),
+			types:   queryList(query, "type"),
+		},
+		events: make(chan events.Event, stream.bufferSize),
+	}
+	stream.lock.Lock()
+	stream.clients[client] = struct{}{}
+	stream.lock.Unlock()
+	log.Debug("client connected", "remoteAddress", request.RemoteAddr, "query", request.URL.RawQuery)
+	return client
+}
+
+func (stream *Bus) unsubscribe(request *http.Request, client *subscriber) {
+	stream.lock.Lock()
+	delete(stream.clients, client)
+	stream.lock.Unlock()
+	log.Debug("client disconnected", "remoteAddress", request.RemoteAddr)
+}
+
+func (stream *Bus) serveEventSource(writer http.ResponseWriter, request *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	if origin := request.Header.Get("Origin"); origin != "" {
+		writer.Header().Set("Access-Control-Allow-Origin", origin)
+		writer.Header().Set("Vary", "Origin")
+	}
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.Header().Set("X-Accel-Buffering", "no") // KEEP NGINX FROM BUFFERING THE STREAM
+	writer.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprint(writer, ": connected\n\n")
+	flusher.Flush()
+
+	client := stream.subscribe(request)
+	defer stream.unsubscribe(request, client)
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case <-stream.ctx.Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event := <-client.events:
+			payload, err := json.Marshal(event)
+			if err != nil {
+				log.Error("error marshaling event to JSON", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(writer, "data: %s\n\n", payload); err != nil {
+				stream.stats.Failed(err)
+				return
+			}
+			flusher.Flush()
+			stream.stats.Delivered()
+		}
+	}
+}
+
+func (stream *Bus) serveWebSocket(writer http.ResponseWriter, request *http.Request) {
+	conn, err := stream.upgrader.Upgrade(writer, request, nil)
+	if err != nil {
+		// UPGRADER HAS ALREADY RESPONDED WITH AN ERROR
+		log.Debug("websocket upgrade failed", "remoteAddress", request.RemoteAddr, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	client := stream.subscribe(request)
+	defer stream.unsubscribe(request, client)
+
+	// CLIENTS HAVE NOTHING TO SAY, READING ONLY NOTICES THEM GOING AWAY
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(512)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-request.Context().Done():
+			return
+		case <-stream.ctx.Done():
+			message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "alarm server is shutting down")
+			_ = conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeTimeout))
+			return
+		case <-keepAlive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
+		case event := <-client.events:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := conn.WriteJSON(event); err != nil {
+				stream.stats.Failed(err)
+				return
+			}
+			stream.stats.Delivered()
+		}
+	}
+}
+
+func (filter filter) matches(event events.Event) bool {
+	return matchesAny(filter.sources, event.Source) &&
+		matchesAny(filter.cameras, event.Camera) &&
+		matchesAny(filter.types, event.Type)
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryList reads parameter that can be repeated or comma-separated, like ?camera=a,b&camera=c
+func queryList(query url.Values, key string) []string {
+	var values []string
+	for _, param := range query[key] {
+		for _, value := range strings.Split(param, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
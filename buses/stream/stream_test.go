@@ -0,0 +1,252 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/events"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStream(t *testing.T, token string, bufferSize int) (*Bus, *httptest.Server) {
+	t.Helper()
+	stream := &Bus{}
+	conf := &config.Config{Stream: config.StreamConfig{Enabled: true, Token: token, BufferSize: bufferSize}}
+	if err := stream.Initialize(context.Background(), conf); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(stream)
+	t.Cleanup(func() {
+		_ = stream.Close(context.Background())
+		server.Close()
+	})
+	return stream, server
+}
+
+func (stream *Bus) clientCount() int {
+	stream.lock.RLock()
+	defer stream.lock.RUnlock()
+	return len(stream.clients)
+}
+
+func waitForClients(t *testing.T, stream *Bus, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for stream.clientCount() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream has %d clients, want %d", stream.clientCount(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// connect opens event stream and reads past its greeting, so that client is subscribed once it returns
+func connect(t *testing.T, ctx context.Context, url string, headers map[string]string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = response.Body.Close() })
+	reader := bufio.NewReader(response.Body)
+	if response.StatusCode == http.StatusOK {
+		if greeting, err := reader.ReadString('\n'); err != nil || greeting != ": connected\n" {
+			t.Fatalf("stream starts with %q and error %v, want connected comment", greeting, err)
+		}
+	}
+	return response, reader
+}
+
+// readEvent returns next event on event stream
+func readEvent(t *testing.T, reader *bufio.Reader) events.Event {
+	t.Helper()
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading stream: %v", err)
+		}
+		if data, found := strings.CutPrefix(line, "data: "); found {
+			var event events.Event
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Fatalf("event %q is not JSON: %v", data, err)
+			}
+			return event
+		}
+	}
+}
+
+func TestStreamToken(t *testing.T) {
+	stream, server := newTestStream(t, "secret", 0)
+	tests := []struct {
+		name    string
+		query   string
+		headers map[string]string
+		want    int
+	}{
+		{"no token", "", nil, http.StatusUnauthorized},
+		{"wrong query token", "?token=guess", nil, http.StatusUnauthorized},
+		{"wrong header token", "", map[string]string{"X-Api-Token": "guess"}, http.StatusUnauthorized},
+		{"wrong bearer", "?token=secret", map[string]string{"Authorization": "Bearer guess"}, http.StatusUnauthorized},
+		{"query token", "?token=secret", nil, http.StatusOK},
+		{"header token", "", map[string]string{"X-Api-Token": "secret"}, http.StatusOK},
+		{"bearer token", "?token=guess", map[string]string{"Authorization": "Bearer secret"}, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			response, _ := connect(t, ctx, server.URL+test.query, test.headers)
+			if response.StatusCode != test.want {
+				t.Errorf("status is %d, want %d", response.StatusCode, test.want)
+			}
+			if test.want == http.StatusOK && response.Header.Get("Content-Type") != "text/event-stream" {
+				t.Errorf("content type is %q, want text/event-stream", response.Header.Get("Content-Type"))
+			}
+			cancel()
+			waitForClients(t, stream, 0)
+		})
+	}
+
+	dialer := websocket.Dialer{}
+	wsUrl := "ws" + strings.TrimPrefix(server.URL, "http")
+	if _, response, err := dialer.Dial(wsUrl, nil); err == nil || response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("websocket without token connected with error %v, want 401", err)
+	}
+	conn, _, err := dialer.Dial(wsUrl+"?token=secret", nil)
+	if err != nil {
+		t.Fatalf("websocket with token did not connect: %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestStreamWithoutTokenLetsAnyoneIn(t *testing.T) {
+	_, server := newTestStream(t, "", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if response, _ := connect(t, ctx, server.URL, nil); response.StatusCode != http.StatusOK {
+		t.Errorf("status is %d, want %d", response.StatusCode, http.StatusOK)
+	}
+}
+
+func TestStreamDeliversFilteredEvents(t *testing.T) {
+	stream, server := newTestStream(t, "", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, reader := connect(t, ctx, server.URL+"?camera=porch,gate&type=VMD", nil)
+	waitForClients(t, stream, 1)
+
+	stream.Send(events.Event{Camera: "garage", Type: "VMD", Message: "other camera"})
+	stream.Send(events.Event{Camera: "Porch", Type: "linedetection", Message: "other type"})
+	stream.Send(events.Event{Camera: "Porch", Type: "vmd", Message: "wanted"})
+	if event := readEvent(t, reader); event.Message != "wanted" {
+		t.Errorf("client got %q, want only wanted event", event.Message)
+	}
+}
+
+func TestStreamDropsEventsOfSlowClient(t *testing.T) {
+	stream, server := newTestStream(t, "", 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, reader := connect(t, ctx, server.URL, nil)
+	waitForClients(t, stream, 1)
+	// NEVER READS ITS EVENTS
+	slow := stream.subscribe(httptest.NewRequest(http.MethodGet, "/", nil))
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < 5; i++ {
+			stream.Send(events.Event{Camera: "porch", Message: string(rune('1' + i))})
+			// LET FAST CLIENT KEEP UP, ITS BUFFER IS TINY TOO
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow client held up Send")
+	}
+
+	for _, want := range []string{"1", "2", "3", "4", "5"} {
+		if event := readEvent(t, reader); event.Message != want {
+			t.Errorf("fast client got %q, want %q", event.Message, want)
+		}
+	}
+	if queued := len(slow.events); queued != 2 {
+		t.Errorf("slow client has %d events queued, want 2", queued)
+	}
+	if first := <-slow.events; first.Message != "1" {
+		t.Errorf("slow client kept %q first, want oldest event 1", first.Message)
+	}
+	if failed := stream.Health().Stats.Failed; failed != 3 {
+		t.Errorf("%d events counted as failed, want 3 dropped", failed)
+	}
+}
+
+func TestStreamForgetsClientsThatLeave(t *testing.T) {
+	stream, server := newTestStream(t, "", 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	connect(t, ctx, server.URL, nil)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForClients(t, stream, 2)
+	if status := stream.Health().Status; status != "2 clients" {
+		t.Errorf("health status is %q, want 2 clients", status)
+	}
+
+	cancel()
+	waitForClients(t, stream, 1)
+	_ = conn.Close()
+	waitForClients(t, stream, 0)
+	// NOBODY IS LEFT TO FALL BEHIND
+	stream.Send(events.Event{Camera: "porch"})
+	if failed := stream.Health().Stats.Failed; failed != 0 {
+		t.Errorf("%d events failed after clients left, want none", failed)
+	}
+}
+
+func TestStreamCloseDisconnectsClients(t *testing.T) {
+	stream, server := newTestStream(t, "", 0)
+	_, reader := connect(t, context.Background(), server.URL, nil)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitForClients(t, stream, 2)
+
+	_ = stream.Close(context.Background())
+	waitForClients(t, stream, 0)
+	ended := make(chan struct{})
+	go func() {
+		defer close(ended)
+		_, _ = io.Copy(io.Discard, reader)
+	}()
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Error("event stream is still open after Close")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("websocket read returned %v, want going away close", err)
+	}
+}
@@ -0,0 +1,311 @@
+package webhooks
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/toxuin/alarmserver/buses"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var (
+	pendingBucket = []byte("pending")
+	deadBucket    = []byte("dead")
+	dueBucket     = []byte("due") // PENDING JOBS BY NEXT ATTEMPT, SO THAT DISPATCHER READS ONLY WHAT IS DUE
+)
+
+// job is a payload waiting to be delivered to one webhook
+type job struct {
+	ID          uint64         `json:"id"`
+	Webhook     string         `json:"webhook"` // SEE webhookKey
+	Payload     WebhookPayload `json:"payload"`
+	Attempts    int            `json:"attempts"`
+	Created     time.Time      `json:"created"`
+	NextAttempt time.Time      `json:"nextAttempt"`
+	LastStatus  int            `json:"lastStatus,omitempty"`
+	LastError   string         `json:"lastError,omitempty"`
+}
+
+func (job *job) item(dead bool) buses.OutboxItem {
+	item := buses.OutboxItem{
+		ID:         strconv.FormatUint(job.ID, 10),
+		Target:     job.Webhook,
+		Event:      job.Payload.Event,
+		Attempts:   job.Attempts,
+		Created:    job.Created,
+		LastStatus: job.LastStatus,
+		LastError:  job.LastError,
+	}
+	if !dead {
+		nextAttempt := job.NextAttempt
+		item.NextAttempt = &nextAttempt
+	}
+	return item
+}
+
+// outbox keeps jobs in a bbolt file, so that they survive restarts
+type outbox struct {
+	db             *bolt.DB
+	maxDeadLetters int
+}
+
+func openOutbox(path string, maxDeadLetters int) (*outbox, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0640, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{pendingBucket, deadBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return rebuildDue(tx)
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &outbox{db: db, maxDeadLetters: maxDeadLetters}, nil
+}
+
+func (outbox *outbox) close() error {
+	return outbox.db.Close()
+}
+
+// add stores new job and sets its ID
+func (outbox *outbox) add(job *job) error {
+	return outbox.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(pendingBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		job.ID = id
+		return putPending(tx, job)
+	})
+}
+
+// update saves job that is still pending after failed attempt
+func (outbox *outbox) update(job *job) error {
+	return outbox.db.Update(func(tx *bolt.Tx) error {
+		return putPending(tx, job)
+	})
+}
+
+// done removes delivered job
+func (outbox *outbox) done(job *job) error {
+	return outbox.db.Update(func(tx *bolt.Tx) error {
+		return deletePending(tx, job.ID)
+	})
+}
+
+// bury moves job that will not be retried to dead letters, dropping oldest ones past maxDeadLetters
+func (outbox *outbox) bury(job *job) error {
+	return outbox.db.Update(func(tx *bolt.Tx) error {
+		if err := deletePending(tx, job.ID); err != nil {
+			return err
+		}
+		dead := tx.Bucket(deadBucket)
+		if err := putJob(dead, job); err != nil {
+			return err
+		}
+		if outbox.maxDeadLetters <= 0 {
+			return nil
+		}
+		// STATS DO NOT SEE WRITES OF THIS TRANSACTION, SO KEYS ARE COUNTED
+		var keys [][]byte
+		cursor := dead.Cursor()
+		for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+			keys = append(keys, k)
+		}
+		if len(keys) <= outbox.maxDeadLetters {
+			return nil
+		}
+		for _, k := range keys[:len(keys)-outbox.maxDeadLetters] {
+			if err := dead.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// revive moves dead letters with given IDs back to pending as fresh jobs, all of them if ids is nil
+func (outbox *outbox) revive(ids []uint64) (int, error) {
+	revived := 0
+	err := outbox.db.Update(func(tx *bolt.Tx) error {
+		dead := tx.Bucket(deadBucket)
+		if ids == nil {
+			_ = dead.ForEach(func(k, _ []byte) error {
+				ids = append(ids, binary.BigEndian.Uint64(k))
+				return nil
+			})
+		}
+		for _, id := range ids {
+			value := dead.Get(key(id))
+			if value == nil {
+				return buses.ErrUnknownItem
+			}
+			revivedJob := &job{}
+			if err := json.Unmarshal(value, revivedJob); err != nil {
+				return err
+			}
+			revivedJob.Attempts = 0
+			revivedJob.NextAttempt = time.Now()
+			if err := putPending(tx, revivedJob); err != nil {
+				return err
+			}
+			if err := dead.Delete(key(id)); err != nil {
+				return err
+			}
+			revived++
+		}
+		return nil
+	})
+	return revived, err
+}
+
+func (outbox *outbox) discard(id uint64) error {
+	return outbox.db.Update(func(tx *bolt.Tx) error {
+		dead := tx.Bucket(deadBucket)
+		if dead.Get(key(id)) == nil {
+			return buses.ErrUnknownItem
+		}
+		return dead.Delete(key(id))
+	})
+}
+
+// get returns pending job, nil if it is not pending anymore
+func (outbox *outbox) get(id uint64) (*job, error) {
+	var storedJob *job
+	err := outbox.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(pendingBucket).Get(key(id))
+		if value == nil {
+			return nil
+		}
+		storedJob = &job{}
+		return json.Unmarshal(value, storedJob)
+	})
+	return storedJob, err
+}
+
+// due returns IDs of pending jobs due at now, earliest first, and when the next one that is not due yet will be.
+// Zero time if there is none
+func (outbox *outbox) due(now time.Time) ([]uint64, time.Time, error) {
+	var ids []uint64
+	var next time.Time
+	err := outbox.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(dueBucket).Cursor()
+		for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+			at := time.Unix(0, int64(binary.BigEndian.Uint64(k[:8])))
+			if at.After(now) {
+				next = at
+				break
+			}
+			ids = append(ids, binary.BigEndian.Uint64(k[8:]))
+		}
+		return nil
+	})
+	return ids, next, err
+}
+
+// list returns all jobs in bucket, oldest first
+func (outbox *outbox) list(bucketName []byte) ([]*job, error) {
+	var jobs []*job
+	err := outbox.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).ForEach(func(_, value []byte) error {
+			storedJob := &job{}
+			if err := json.Unmarshal(value, storedJob); err != nil {
+				return err
+			}
+			jobs = append(jobs, storedJob)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+func (outbox *outbox) count(bucketName []byte) int {
+	count := 0
+	_ = outbox.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(bucketName).Stats().KeyN
+		return nil
+	})
+	return count
+}
+
+// putPending saves pending job and moves it to its place in due index
+func putPending(tx *bolt.Tx, job *job) error {
+	if err := deletePending(tx, job.ID); err != nil {
+		return err
+	}
+	if err := putJob(tx.Bucket(pendingBucket), job); err != nil {
+		return err
+	}
+	return tx.Bucket(dueBucket).Put(dueKey(job), nil)
+}
+
+// deletePending removes pending job and its entry in due index, if there is one
+func deletePending(tx *bolt.Tx, id uint64) error {
+	pending := tx.Bucket(pendingBucket)
+	value := pending.Get(key(id))
+	if value == nil {
+		return nil
+	}
+	storedJob := &job{}
+	if err := json.Unmarshal(value, storedJob); err == nil {
+		if err := tx.Bucket(dueBucket).Delete(dueKey(storedJob)); err != nil {
+			return err
+		}
+	}
+	return pending.Delete(key(id))
+}
+
+// rebuildDue makes due index from pending jobs, in case it is missing or was left behind by older version
+func rebuildDue(tx *bolt.Tx) error {
+	if tx.Bucket(dueBucket) != nil {
+		if err := tx.DeleteBucket(dueBucket); err != nil {
+			return err
+		}
+	}
+	due, err := tx.CreateBucket(dueBucket)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(pendingBucket).ForEach(func(_, value []byte) error {
+		storedJob := &job{}
+		if err := json.Unmarshal(value, storedJob); err != nil {
+			return err
+		}
+		return due.Put(dueKey(storedJob), nil)
+	})
+}
+
+func putJob(bucket *bolt.Bucket, job *job) error {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key(job.ID), value)
+}
+
+func key(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+// dueKey sorts by next attempt, then by ID
+func dueKey(job *job) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(job.NextAttempt.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], job.ID)
+	return k
+}
@@ -0,0 +1,103 @@
+package webhooks
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOutboxDueIsEarliestFirst(t *testing.T) {
+	outbox, err := openOutbox(outboxPath(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.close()
+	now := time.Now()
+	later := &job{NextAttempt: now.Add(time.Hour)}
+	soon := &job{NextAttempt: now.Add(time.Minute)}
+	late := &job{NextAttempt: now.Add(-time.Second)}
+	early := &job{NextAttempt: now.Add(-time.Minute)}
+	for _, added := range []*job{later, soon, late, early} {
+		if err := outbox.add(added); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	due, next, err := outbox.due(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(due, []uint64{early.ID, late.ID}) {
+		t.Errorf("due are %v, want %v", due, []uint64{early.ID, late.ID})
+	}
+	if !next.Equal(soon.NextAttempt) {
+		t.Errorf("next is %s, want %s", next, soon.NextAttempt)
+	}
+
+	// RESCHEDULED AND FINISHED JOBS LEAVE THEIR OLD PLACE
+	early.NextAttempt = now.Add(2 * time.Hour)
+	if err := outbox.update(early); err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.done(late); err != nil {
+		t.Fatal(err)
+	}
+	due, next, _ = outbox.due(now.Add(90 * time.Minute))
+	if !reflect.DeepEqual(due, []uint64{soon.ID, later.ID}) || !next.Equal(early.NextAttempt) {
+		t.Errorf("due are %v and next is %s, want %v and %s", due, next, []uint64{soon.ID, later.ID}, early.NextAttempt)
+	}
+}
+
+func TestOutboxKeepsJobsAcrossReopen(t *testing.T) {
+	path := outboxPath(t)
+	outbox, err := openOutbox(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := &job{Webhook: "POST http://example.com/", NextAttempt: time.Now()}
+	dead := &job{Webhook: "POST http://example.com/", NextAttempt: time.Now()}
+	_ = outbox.add(pending)
+	_ = outbox.add(dead)
+	_ = outbox.bury(dead)
+	if err := outbox.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	outbox, err = openOutbox(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.close()
+	due, _, _ := outbox.due(time.Now())
+	if !reflect.DeepEqual(due, []uint64{pending.ID}) {
+		t.Errorf("due after reopen are %v, want %v", due, []uint64{pending.ID})
+	}
+	if outbox.count(deadBucket) != 1 {
+		t.Errorf("%d dead letters after reopen, want 1", outbox.count(deadBucket))
+	}
+}
+
+func TestOutboxDropsOldestDeadLetters(t *testing.T) {
+	outbox, err := openOutbox(outboxPath(t), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.close()
+	var jobs []*job
+	for i := 0; i < 3; i++ {
+		added := &job{NextAttempt: time.Now()}
+		_ = outbox.add(added)
+		_ = outbox.bury(added)
+		jobs = append(jobs, added)
+	}
+	dead, _ := outbox.list(deadBucket)
+	if len(dead) != 2 || dead[0].ID != jobs[1].ID || dead[1].ID != jobs[2].ID {
+		t.Errorf("dead letters are %v, want last 2 of them", dead)
+	}
+	if outbox.count(pendingBucket) != 0 {
+		t.Error("buried jobs are still pending")
+	}
+	if due, _, _ := outbox.due(time.Now()); len(due) != 0 {
+		t.Errorf("buried jobs are still due: %v", due)
+	}
+}
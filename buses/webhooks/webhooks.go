@@ -2,85 +2,458 @@ package webhooks
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/toxuin/alarmserver/buses"
 	"github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/logging"
+	"github.com/toxuin/alarmserver/metrics"
+	"github.com/toxuin/alarmserver/retry"
 	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
+var log = logging.For("webhooks")
+
+const (
+	requestTimeout        = 30 * time.Second
+	maxParallelDeliveries = 8
+	shutdownPollInterval  = 100 * time.Millisecond
+	retryJitter           = 0.2
+)
+
+var defaultRetry = config.RetryConfig{
+	MaxAttempts:  10,
+	InitialDelay: 5 * time.Second,
+	MaxDelay:     10 * time.Minute,
+	RetryOn:      []int{408, 425, 429, 500, 502, 503, 504},
+}
+
+var errWebhookRemoved = errors.New("webhook is not in config anymore")
+
 type Bus struct {
-	Debug    bool
-	webhooks []config.WebhookConfig
-	client   *http.Client
+	webhooks   []*webhook
+	byKey      map[string]*webhook
+	client     *http.Client
+	ctx        context.Context // CANCELLED WHEN BUS IS CLOSED, ABORTS REQUESTS
+	cancel     context.CancelFunc
+	outbox     *outbox
+	wake       chan struct{}
+	slots      chan struct{}
+	lock       sync.Mutex
+	delivering map[uint64]bool // JOBS IN FLIGHT, SO THAT DISPATCHER DOES NOT PICK THEM UP TWICE
+	inFlight   sync.WaitGroup
+	stopLoop   context.CancelFunc
+	loopDone   chan struct{}
+	stats      buses.StatsCounter
+	buses.Reporter
+}
+
+// webhook is a configured webhook with its retry policy worked out
+type webhook struct {
+	config.WebhookConfig
+	key         string
+	maxAttempts int
+	backoff     retry.Policy
+	retryOn     map[int]bool
 }
 
 type WebhookPayload struct {
-	CameraName string `json:"cameraName"`
-	EventType  string `json:"eventType"`
-	Extra      string `json:"extra"`
+	CameraName string       `json:"cameraName"`
+	EventType  string       `json:"eventType"`
+	Extra      string       `json:"extra"`
+	Event      events.Event `json:"event"`
 }
 
-func (webhooks *Bus) Initialize(conf config.WebhooksConfig) {
-	fmt.Println("Initializing Webhook bus...")
-	webhooks.client = &http.Client{}
-	webhooks.webhooks = conf.Items
-	// SET DEFAULT VALUES
-	for index, item := range webhooks.webhooks {
+// permanentError is a failure that retrying will not fix, like a broken template
+type permanentError struct {
+	error
+}
+
+func (err permanentError) Unwrap() error {
+	return err.error
+}
+
+func init() {
+	buses.Register("webhooks", func() buses.Bus { return &Bus{} })
+}
+
+func (webhooks *Bus) Initialize(ctx context.Context, appConf *config.Config) error {
+	webhooks.ctx, webhooks.cancel = context.WithCancel(ctx)
+	conf := appConf.Webhooks
+	log.Info("initializing webhook bus...")
+	webhooks.client = &http.Client{Timeout: requestTimeout}
+
+	items := conf.Items
+	for _, url := range conf.Urls {
+		items = append(items, config.WebhookConfig{Url: url})
+	}
+	webhooks.byKey = make(map[string]*webhook)
+	for _, item := range items {
+		// SET DEFAULT VALUES
 		if item.Method == "" {
 			item.Method = http.MethodPost
 		}
-		webhooks.webhooks[index] = item
+		hook := newWebhook(item, conf.Retry)
+		webhooks.webhooks = append(webhooks.webhooks, hook)
+		if _, exists := webhooks.byKey[hook.key]; exists {
+			log.Warn("duplicate webhook, retries go to the first one", "method", item.Method, "url", item.Url)
+			continue
+		}
+		webhooks.byKey[hook.key] = hook
 	}
 
-	for _, url := range conf.Urls {
-		basicWebhook := config.WebhookConfig{
-			Url:    url,
-			Method: http.MethodPost,
+	var err error
+	webhooks.outbox, err = openOutbox(conf.Outbox.Path, conf.Outbox.MaxDeadLetters)
+	if err != nil {
+		webhooks.cancel()
+		return fmt.Errorf("unable to open webhook outbox %s: %w", conf.Outbox.Path, err)
+	}
+	if pending := webhooks.outbox.count(pendingBucket); pending > 0 {
+		log.Info("resuming deliveries from outbox", "pending", pending)
+	}
+	webhooks.updateMetrics()
+
+	webhooks.wake = make(chan struct{}, 1)
+	webhooks.slots = make(chan struct{}, maxParallelDeliveries)
+	webhooks.delivering = make(map[uint64]bool)
+	var loopCtx context.Context
+	loopCtx, webhooks.stopLoop = context.WithCancel(webhooks.ctx)
+	webhooks.loopDone = make(chan struct{})
+	go webhooks.dispatchLoop(loopCtx)
+	return nil
+}
+
+// newWebhook merges retry settings of webhook over ones for all webhooks, and both over defaults
+func newWebhook(conf config.WebhookConfig, common config.RetryConfig) *webhook {
+	settings := defaultRetry
+	for _, override := range []*config.RetryConfig{&common, conf.Retry} {
+		if override == nil {
+			continue
+		}
+		if override.MaxAttempts > 0 {
+			settings.MaxAttempts = override.MaxAttempts
+		}
+		if override.InitialDelay > 0 {
+			settings.InitialDelay = override.InitialDelay
+		}
+		if override.MaxDelay > 0 {
+			settings.MaxDelay = override.MaxDelay
 		}
-		webhooks.webhooks = append(webhooks.webhooks, basicWebhook)
+		if override.RetryOn != nil {
+			settings.RetryOn = override.RetryOn
+		}
+	}
+	hook := &webhook{
+		WebhookConfig: conf,
+		key:           conf.Method + " " + conf.Url,
+		maxAttempts:   settings.MaxAttempts,
+		backoff: retry.Policy{
+			InitialDelay: settings.InitialDelay,
+			MaxDelay:     settings.MaxDelay,
+			Jitter:       retryJitter,
+		},
+		retryOn: make(map[int]bool),
+	}
+	for _, status := range settings.RetryOn {
+		hook.retryOn[status] = true
 	}
+	return hook
 }
 
-func (webhooks *Bus) SendMessage(cameraName string, eventType string, extra string) {
-	for _, webhook := range webhooks.webhooks {
-		payload := WebhookPayload{CameraName: cameraName, EventType: eventType, Extra: extra}
-		go webhooks.send(webhook, payload)
+func (hook *webhook) retryable(status int, err error) bool {
+	var permanent permanentError
+	if errors.As(err, &permanent) {
+		return false
 	}
+	return status == 0 || hook.retryOn[status]
 }
 
-func (webhooks *Bus) send(webhook config.WebhookConfig, payload WebhookPayload) {
-	payloadJson, err := json.Marshal(payload)
+func (webhooks *Bus) Health() buses.Health {
+	return buses.Health{
+		Healthy: true,
+		Status: fmt.Sprintf("%d webhooks, %d pending, %d dead letters", len(webhooks.webhooks),
+			webhooks.outbox.count(pendingBucket), webhooks.outbox.count(deadBucket)),
+		Stats: webhooks.stats.Snapshot(),
+	}
+}
+
+// Close keeps delivering what is due until outbox is drained or ctx is done. Whatever is left
+// stays in outbox for the next start
+func (webhooks *Bus) Close(ctx context.Context) error {
+	defer func() {
+		webhooks.stopLoop()
+		<-webhooks.loopDone
+		webhooks.cancel()
+		webhooks.inFlight.Wait() // CANCELLED REQUESTS RETURN RIGHT AWAY
+		if err := webhooks.outbox.close(); err != nil {
+			log.Error("error closing outbox", "error", err)
+		}
+	}()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for !webhooks.drained() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Warn("shutdown deadline reached, leaving deliveries in outbox",
+				"pending", webhooks.outbox.count(pendingBucket))
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// drained tells if nothing is being delivered and nothing is due. Retries that are due later do not count
+func (webhooks *Bus) drained() bool {
+	webhooks.lock.Lock()
+	delivering := len(webhooks.delivering)
+	webhooks.lock.Unlock()
+	if delivering > 0 {
+		return false
+	}
+	due, _, err := webhooks.outbox.due(time.Now())
+	return err != nil || len(due) == 0
+}
+
+// Send puts payload for every webhook into outbox, dispatcher takes it from there
+func (webhooks *Bus) Send(event events.Event) {
+	payload := WebhookPayload{
+		CameraName: event.Camera,
+		EventType:  event.Type,
+		Extra:      event.Message,
+		Event:      event,
+	}
+	now := time.Now()
+	for _, hook := range webhooks.webhooks {
+		newJob := &job{Webhook: hook.key, Payload: payload, Created: now, NextAttempt: now}
+		if err := webhooks.outbox.add(newJob); err != nil {
+			log.Error("error adding delivery to outbox", "url", hook.Url, "error", err)
+			webhooks.stats.Failed(err)
+			webhooks.Report(event.ID, events.Delivery{Bus: "webhooks", Target: hook.Url}, err)
+		}
+	}
+	webhooks.updateMetrics()
+	webhooks.notify()
+}
+
+// notify wakes up dispatcher, without blocking if it is awake already
+func (webhooks *Bus) notify() {
+	select {
+	case webhooks.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (webhooks *Bus) dispatchLoop(ctx context.Context) {
+	defer close(webhooks.loopDone)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		next := webhooks.dispatch()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-webhooks.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// dispatch starts delivering jobs that are due, earliest first, as many as there are free slots.
+// Returns when the next job that is not due yet will be, zero time if there is none
+func (webhooks *Bus) dispatch() time.Time {
+	now := time.Now()
+	due, next, err := webhooks.outbox.due(now)
 	if err != nil {
-		fmt.Println("WEBHOOKS: Error marshaling payload to JSON", err)
+		log.Error("error reading outbox", "error", err)
+		return now.Add(defaultRetry.InitialDelay)
+	}
+	for _, id := range due {
+		webhooks.lock.Lock()
+		busy := webhooks.delivering[id]
+		webhooks.lock.Unlock()
+		if busy {
+			continue
+		}
+		// DELIVERY THAT JUST FINISHED COULD HAVE CHANGED THE JOB SINCE DUE LIST WAS READ
+		pendingJob, err := webhooks.outbox.get(id)
+		if err != nil || pendingJob == nil || pendingJob.NextAttempt.After(now) {
+			continue
+		}
+		hook := webhooks.byKey[pendingJob.Webhook]
+		if hook == nil {
+			pendingJob.LastError = errWebhookRemoved.Error()
+			webhooks.giveUp(pendingJob, errWebhookRemoved)
+			continue
+		}
+		select {
+		case webhooks.slots <- struct{}{}:
+		default:
+			return next // ALL SLOTS BUSY, FINISHED DELIVERIES WAKE DISPATCHER UP
+		}
+		webhooks.lock.Lock()
+		webhooks.delivering[id] = true
+		webhooks.lock.Unlock()
+		webhooks.inFlight.Add(1)
+		go webhooks.deliver(hook, pendingJob)
+	}
+	return next
+}
+
+// deliver makes one attempt and decides what happens to job next
+func (webhooks *Bus) deliver(hook *webhook, pendingJob *job) {
+	defer func() {
+		webhooks.lock.Lock()
+		delete(webhooks.delivering, pendingJob.ID)
+		webhooks.lock.Unlock()
+		<-webhooks.slots
+		webhooks.inFlight.Done()
+		webhooks.updateMetrics()
+		webhooks.notify()
+	}()
+
+	status, err := webhooks.send(hook.WebhookConfig, pendingJob.Payload)
+	if err != nil && webhooks.ctx.Err() != nil {
+		return // CANCELLED BY SHUTDOWN, DOES NOT COUNT AS ATTEMPT
+	}
+	pendingJob.Attempts++
+	pendingJob.LastStatus = status
+	eventID := pendingJob.Payload.Event.ID
+	delivery := events.Delivery{Bus: "webhooks", Target: hook.Url, Status: status, Attempt: pendingJob.Attempts}
+	if err == nil {
+		webhooks.stats.Delivered()
+		webhooks.Report(eventID, delivery, nil)
+		if err := webhooks.outbox.done(pendingJob); err != nil {
+			log.Error("error removing delivered job from outbox", "id", pendingJob.ID, "error", err)
+		}
+		return
+	}
+
+	webhooks.stats.Failed(err)
+	webhooks.Report(eventID, delivery, err)
+	pendingJob.LastError = err.Error()
+	if !hook.retryable(status, err) || pendingJob.Attempts >= hook.maxAttempts {
+		webhooks.giveUp(pendingJob, err)
 		return
 	}
+	delay := hook.backoff.Delay(pendingJob.Attempts - 1)
+	pendingJob.NextAttempt = time.Now().Add(delay)
+	log.Info("will retry webhook", "url", hook.Url, "attempt", pendingJob.Attempts, "in", delay)
+	if err := webhooks.outbox.update(pendingJob); err != nil {
+		log.Error("error updating job in outbox", "id", pendingJob.ID, "error", err)
+	}
+}
+
+// giveUp moves job to dead letters
+func (webhooks *Bus) giveUp(deadJob *job, err error) {
+	log.Error("giving up on webhook delivery", "id", deadJob.ID, "webhook", deadJob.Webhook,
+		"camera", deadJob.Payload.CameraName, "event", deadJob.Payload.EventType,
+		"attempts", deadJob.Attempts, "error", err)
+	if err := webhooks.outbox.bury(deadJob); err != nil {
+		log.Error("error moving job to dead letters", "id", deadJob.ID, "error", err)
+	}
+}
+
+func (webhooks *Bus) updateMetrics() {
+	metrics.WebhookOutbox(webhooks.outbox.count(pendingBucket), webhooks.outbox.count(deadBucket))
+}
+
+func (webhooks *Bus) Pending() ([]buses.OutboxItem, error) {
+	return webhooks.items(pendingBucket, false)
+}
+
+func (webhooks *Bus) DeadLetters() ([]buses.OutboxItem, error) {
+	return webhooks.items(deadBucket, true)
+}
+
+func (webhooks *Bus) items(bucket []byte, dead bool) ([]buses.OutboxItem, error) {
+	jobs, err := webhooks.outbox.list(bucket)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]buses.OutboxItem, 0, len(jobs))
+	for _, storedJob := range jobs {
+		items = append(items, storedJob.item(dead))
+	}
+	return items, nil
+}
+
+func (webhooks *Bus) Replay(id string) error {
+	jobID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return buses.ErrUnknownItem
+	}
+	if _, err := webhooks.outbox.revive([]uint64{jobID}); err != nil {
+		return err
+	}
+	webhooks.updateMetrics()
+	webhooks.notify()
+	return nil
+}
+
+func (webhooks *Bus) ReplayAll() (int, error) {
+	revived, err := webhooks.outbox.revive(nil)
+	if err != nil {
+		return 0, err
+	}
+	webhooks.updateMetrics()
+	webhooks.notify()
+	return revived, nil
+}
 
-	var templateVars = map[string]interface{}{
-		"Camera": payload.CameraName,
-		"Event":  payload.EventType,
-		"Extra":  payload.Extra,
+func (webhooks *Bus) Discard(id string) error {
+	jobID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return buses.ErrUnknownItem
 	}
+	if err := webhooks.outbox.discard(jobID); err != nil {
+		return err
+	}
+	webhooks.updateMetrics()
+	return nil
+}
+
+// send delivers payload to a single webhook. Returns response status code, 0 if there was no response,
+// and error if it was not delivered
+func (webhooks *Bus) send(webhook config.WebhookConfig, payload WebhookPayload) (int, error) {
+	payloadJson, err := json.Marshal(payload)
+	if err != nil {
+		log.Error("error marshaling payload to JSON", "error", err)
+		return 0, permanentError{err}
+	}
+
+	templateVars := payload.Event.TemplateVars()
 
 	// PARSE WEBHOOK URL AS TEMPLATE
 	urlTemplate, err := template.New("webhookUrl").Parse(webhook.Url)
 	if err != nil {
-		fmt.Printf("WEBHOOKS: Error parsing webhook URL as template: %s\n", webhook.Url)
-		if webhooks.Debug {
-			fmt.Println("Webhooks: Error", err)
-		}
-		return
+		log.Error("error parsing webhook URL as template", "url", webhook.Url, "error", err)
+		return 0, permanentError{err}
 	}
 	var urlBuffer bytes.Buffer
 	err = urlTemplate.Execute(&urlBuffer, templateVars)
 	if err != nil {
-		fmt.Printf("WEBHOOKS: Error rendering webhook URL as template: %s\n", webhook.Url)
-		if webhooks.Debug {
-			fmt.Println("Webhooks: Error", err)
-		}
-		return
+		log.Error("error rendering webhook URL as template", "url", webhook.Url, "error", err)
+		return 0, permanentError{err}
 	}
 	url := urlBuffer.String()
 
@@ -89,31 +462,23 @@ func (webhooks *Bus) send(webhook config.WebhookConfig, payload WebhookPayload)
 	if webhook.BodyTemplate != "" {
 		bodyTemplate, err := template.New("payload").Parse(webhook.BodyTemplate)
 		if err != nil {
-			fmt.Printf("WEBHOOKS: Error parsing webhook body as template: %s\n", webhook.Url)
-			if webhooks.Debug {
-				fmt.Println("Webhooks: Error", err)
-			}
-			return
+			log.Error("error parsing webhook body as template", "url", webhook.Url, "error", err)
+			return 0, permanentError{err}
 		}
 
 		var bodyBuffer bytes.Buffer
 		err = bodyTemplate.Execute(&bodyBuffer, templateVars)
 		if err != nil {
-			fmt.Printf("WEBHOOKS: Error rendering webhook body as template: %s\n", webhook.Url)
-			if webhooks.Debug {
-				fmt.Println("Webhooks: Error", err)
-			}
-			return
+			log.Error("error rendering webhook body as template", "url", webhook.Url, "error", err)
+			return 0, permanentError{err}
 		}
 		body = &bodyBuffer
 	}
 
-	request, err := http.NewRequest(webhook.Method, url, body)
+	request, err := http.NewRequestWithContext(webhooks.ctx, webhook.Method, url, body)
 	if err != nil {
-		fmt.Printf("WEBHOOKS: Error creating %s request to %s\n", webhook.Method, webhook.Url)
-		if webhooks.Debug {
-			fmt.Println("Webhooks: Error", err)
-		}
+		log.Error("error creating request", "method", webhook.Method, "url", webhook.Url, "error", err)
+		return 0, permanentError{err}
 	}
 	request.Header.Add("Content-Type", "application/json")
 	if len(webhook.Headers) > 0 {
@@ -126,30 +491,27 @@ func (webhooks *Bus) send(webhook config.WebhookConfig, payload WebhookPayload)
 		}
 	}
 
+	started := time.Now()
 	response, err := webhooks.client.Do(request)
 	if err != nil {
-		fmt.Printf("WEBHOOKS: Error delivering payload %s to %s\n", payloadJson, webhook.Url)
-		if webhooks.Debug {
-			fmt.Println("Webhooks: Error", err)
-		}
-	}
-	if response == nil {
-		fmt.Printf("WEBHOOKS: Got no response from %s\n", webhook.Url)
-		return
+		metrics.WebhookDelivery(webhook.Url, 0, time.Since(started))
+		log.Error("error delivering payload", "url", webhook.Url, "camera", payload.CameraName, "event", payload.EventType, "error", err)
+		log.Debug("undelivered payload", "url", webhook.Url, "payload", string(payloadJson))
+		return 0, err
 	}
-	if response.StatusCode != 200 {
-		fmt.Printf(
-			"WEBHOOKS: Got bad status code delivering payload to %s: %v\n",
-			webhook.Url,
-			response.StatusCode,
-		)
-	}
-	if webhooks.Debug {
+	defer func() {
+		// READ WHAT IS LEFT OF BODY, OR CONNECTION IS NOT REUSED
+		_, _ = io.Copy(io.Discard, response.Body)
+		_ = response.Body.Close()
+	}()
+	metrics.WebhookDelivery(webhook.Url, response.StatusCode, time.Since(started))
+	if log.Enabled(webhooks.ctx, slog.LevelDebug) {
 		bodyBytes, _ := io.ReadAll(response.Body)
-		bodyStr := string(bodyBytes)
-		if len(bodyStr) == 0 {
-			bodyStr = "*empty*"
-		}
-		fmt.Printf("WEBHOOKS: Response body: %s\n", bodyStr)
+		log.Debug("webhook response", "url", webhook.Url, "status", response.StatusCode, "body", string(bodyBytes))
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		log.Warn("bad status code delivering payload", "url", webhook.Url, "status", response.StatusCode)
+		return response.StatusCode, fmt.Errorf("bad status code %d from %s", response.StatusCode, webhook.Url)
 	}
+	return response.StatusCode, nil
 }
@@ -0,0 +1,231 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"github.com/toxuin/alarmserver/buses"
+	"github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/events"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer answers with statuses in order, repeating the last one
+type testServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	statuses []int
+	requests int
+}
+
+func newTestServer(t *testing.T, statuses ...int) *testServer {
+	server := &testServer{statuses: statuses}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		server.lock.Lock()
+		status := server.statuses[min(server.requests, len(server.statuses)-1)]
+		server.requests++
+		server.lock.Unlock()
+		writer.WriteHeader(status)
+		_, _ = writer.Write([]byte("whatever"))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (server *testServer) count() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.requests
+}
+
+func (server *testServer) answer(statuses ...int) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.statuses = statuses
+	server.requests = 0
+}
+
+func newTestBus(t *testing.T, path string, url string, maxAttempts int) *Bus {
+	t.Helper()
+	bus := &Bus{}
+	conf := &config.Config{Webhooks: config.WebhooksConfig{
+		Urls:   []string{url},
+		Retry:  config.RetryConfig{MaxAttempts: maxAttempts, InitialDelay: 10 * time.Millisecond, MaxDelay: 20 * time.Millisecond},
+		Outbox: config.OutboxConfig{Path: path},
+	}}
+	if err := bus.Initialize(context.Background(), conf); err != nil {
+		t.Fatal(err)
+	}
+	return bus
+}
+
+func closeBus(t *testing.T, bus *Bus) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = bus.Close(ctx)
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func outboxPath(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "outbox.db")
+}
+
+var testEvent = events.Event{Source: events.SourceHikvision, Camera: "porch", Type: "VMD", State: events.StateActive}
+
+func TestWebhookAnyTwoHundredIsDelivered(t *testing.T) {
+	for _, status := range []int{200, 201, 202, 204} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			server := newTestServer(t, status)
+			bus := newTestBus(t, outboxPath(t), server.URL, 3)
+			defer closeBus(t, bus)
+
+			bus.Send(testEvent)
+			waitFor(t, "delivery", func() bool { return server.count() == 1 && bus.outbox.count(pendingBucket) == 0 })
+			time.Sleep(50 * time.Millisecond)
+			if server.count() != 1 || bus.outbox.count(deadBucket) != 0 {
+				t.Errorf("got %d requests and %d dead letters, want 1 and 0", server.count(), bus.outbox.count(deadBucket))
+			}
+		})
+	}
+}
+
+func TestWebhookRetriesUntilDelivered(t *testing.T) {
+	server := newTestServer(t, 503, 503, 200)
+	bus := newTestBus(t, outboxPath(t), server.URL, 5)
+	defer closeBus(t, bus)
+
+	bus.Send(testEvent)
+	waitFor(t, "delivery", func() bool { return server.count() == 3 && bus.outbox.count(pendingBucket) == 0 })
+	if bus.outbox.count(deadBucket) != 0 {
+		t.Error("delivered job went to dead letters")
+	}
+}
+
+func TestWebhookGoesToDeadLettersAfterMaxAttempts(t *testing.T) {
+	server := newTestServer(t, 503)
+	bus := newTestBus(t, outboxPath(t), server.URL, 3)
+	defer closeBus(t, bus)
+
+	bus.Send(testEvent)
+	waitFor(t, "dead letter", func() bool { return bus.outbox.count(deadBucket) == 1 })
+	dead, err := bus.DeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dead[0].Attempts != 3 || dead[0].LastStatus != 503 || dead[0].NextAttempt != nil {
+		t.Errorf("dead letter is %+v, want 3 attempts with status 503", dead[0])
+	}
+	if server.count() != 3 || bus.outbox.count(pendingBucket) != 0 {
+		t.Errorf("got %d requests and %d pending, want 3 and 0", server.count(), bus.outbox.count(pendingBucket))
+	}
+}
+
+func TestWebhookDoesNotRetryPermanentFailure(t *testing.T) {
+	server := newTestServer(t, 400)
+	bus := newTestBus(t, outboxPath(t), server.URL, 5)
+	defer closeBus(t, bus)
+
+	bus.Send(testEvent)
+	waitFor(t, "dead letter", func() bool { return bus.outbox.count(deadBucket) == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if server.count() != 1 {
+		t.Errorf("got %d requests, want 1", server.count())
+	}
+}
+
+func TestWebhookReplayAndDiscard(t *testing.T) {
+	server := newTestServer(t, 400)
+	bus := newTestBus(t, outboxPath(t), server.URL, 1)
+	defer closeBus(t, bus)
+
+	for i := 0; i < 3; i++ {
+		bus.Send(testEvent)
+	}
+	waitFor(t, "dead letters", func() bool { return bus.outbox.count(deadBucket) == 3 })
+	dead, _ := bus.DeadLetters()
+	server.answer(200)
+
+	if err := bus.Replay(dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "replay", func() bool { return server.count() == 1 && bus.outbox.count(pendingBucket) == 0 })
+
+	if err := bus.Discard(dead[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if bus.outbox.count(deadBucket) != 1 {
+		t.Errorf("%d dead letters after discard, want 1", bus.outbox.count(deadBucket))
+	}
+	for _, id := range []string{dead[0].ID, dead[1].ID, "nope"} {
+		if err := bus.Replay(id); !errors.Is(err, buses.ErrUnknownItem) {
+			t.Errorf("replay of %s returned %v, want ErrUnknownItem", id, err)
+		}
+		if err := bus.Discard(id); !errors.Is(err, buses.ErrUnknownItem) {
+			t.Errorf("discard of %s returned %v, want ErrUnknownItem", id, err)
+		}
+	}
+
+	revived, err := bus.ReplayAll()
+	if err != nil || revived != 1 {
+		t.Fatalf("replay all revived %d with %v, want 1", revived, err)
+	}
+	waitFor(t, "replay all", func() bool { return server.count() == 2 && bus.outbox.count(pendingBucket) == 0 })
+	if bus.outbox.count(deadBucket) != 0 {
+		t.Error("dead letters left after replaying all")
+	}
+}
+
+func TestWebhookResumesPendingAfterRestart(t *testing.T) {
+	server := newTestServer(t, 200)
+	path := outboxPath(t)
+	outbox, err := openOutbox(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := &job{Webhook: http.MethodPost + " " + server.URL, Payload: WebhookPayload{Event: testEvent}, NextAttempt: time.Now()}
+	if err := outbox.add(left); err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bus := newTestBus(t, path, server.URL, 3)
+	defer closeBus(t, bus)
+	waitFor(t, "delivery of job left by last run", func() bool {
+		return server.count() == 1 && bus.outbox.count(pendingBucket) == 0
+	})
+}
+
+func TestWebhookOfRemovedUrlGoesToDeadLetters(t *testing.T) {
+	server := newTestServer(t, 200)
+	path := outboxPath(t)
+	outbox, err := openOutbox(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = outbox.add(&job{Webhook: "POST http://gone.invalid/", NextAttempt: time.Now()})
+	_ = outbox.close()
+
+	bus := newTestBus(t, path, server.URL, 3)
+	defer closeBus(t, bus)
+	waitFor(t, "dead letter", func() bool { return bus.outbox.count(deadBucket) == 1 })
+	if server.count() != 0 {
+		t.Errorf("got %d requests, want none", server.count())
+	}
+}
@@ -3,64 +3,231 @@ package config
 import (
 	"fmt"
 	"github.com/spf13/viper"
+	"github.com/toxuin/alarmserver/logging"
+	"github.com/toxuin/alarmserver/retry"
 	"github.com/toxuin/alarmserver/servers/dahua"
 	"github.com/toxuin/alarmserver/servers/hikvision"
+	"log/slog"
 	"strings"
+	"time"
 )
 
+var log = logging.For("config")
+
 type Config struct {
-	Debug     bool            `json:"debug"`
-	Mqtt      MqttConfig      `json:"mqtt"`
-	Webhooks  WebhooksConfig  `json:"webhooks"`
-	Hisilicon HisiliconConfig `json:"hisilicon"`
-	Hikvision HikvisionConfig `json:"hikvision"`
-	Dahua     DahuaConfig     `json:"dahua"`
-	Ftp       FtpConfig       `json:"ftp"`
+	Debug           bool            `json:"debug"`
+	Log             logging.Options `json:"log"`
+	ShutdownTimeout time.Duration   `json:"shutdownTimeout"`
+	Http            HttpConfig      `json:"http"`
+	Api             ApiConfig       `json:"api"`
+	Dashboard       DashboardConfig `json:"dashboard"`
+	Store           StoreConfig     `json:"store"`
+	Mqtt            MqttConfig      `json:"mqtt"`
+	Webhooks        WebhooksConfig  `json:"webhooks"`
+	Stream          StreamConfig    `json:"stream"`
+	Arming          ArmingConfig    `json:"arming"`
+	Schedules       SchedulesConfig `json:"schedules"`
+	Hisilicon       HisiliconConfig `json:"hisilicon"`
+	Hikvision       HikvisionConfig `json:"hikvision"`
+	Dahua           DahuaConfig     `json:"dahua"`
+	Ftp             FtpConfig       `json:"ftp"`
+}
+
+type HttpConfig struct {
+	Enabled bool `json:"enabled"`
+	Port    int  `json:"port"`
+}
+
+// ApiConfig is the admin REST API, served by HTTP listener
+type ApiConfig struct {
+	Enabled      bool   `json:"enabled"`
+	Token        string `json:"token"`
+	ReadOnly     bool   `json:"readOnly"`
+	RecentEvents int    `json:"recentEvents"` // EVENTS KEPT PER CAMERA
 }
 
 type MqttConfig struct {
-	Enabled   bool   `json:"enabled"`
-	Server    string `json:"server"`
-	Port      string `json:"port"`
-	Username  string `json:"username"`
-	Password  string `json:"password"`
-	TopicRoot string `json:"topicRoot"`
+	Enabled   bool             `json:"enabled"`
+	Server    string           `json:"server"`
+	Port      string           `json:"port"`
+	Username  string           `json:"username"`
+	Password  string           `json:"password"`
+	TopicRoot string           `json:"topicRoot"`
+	Protocol  string           `json:"protocol"` // tcp, ssl (OR mqtts), ws OR wss
+	Path      string           `json:"path"`     // WEBSOCKET PATH ON BROKER
+	ClientId  string           `json:"clientId"` // EMPTY MEANS alarmserver-<HOSTNAME>
+	Tls       MqttTlsConfig    `json:"tls"`
+	Buffer    MqttBufferConfig `json:"buffer"`
+	Qos       int              `json:"qos"`
+	Retain    bool             `json:"retain"`
+	// QOS AND RETAIN FOR EVENT TYPES THAT NEED DIFFERENT ONES, KEYED BY LOWERCASE EVENT TYPE
+	Overrides     map[string]MqttPublishConfig `json:"overrides"`
+	HomeAssistant HomeAssistantConfig          `json:"homeAssistant"`
+	// GO TEMPLATE WITH SAME VARIABLES AS WEBHOOKS, PLUS .TopicRoot
+	TopicTemplate   string `json:"topicTemplate"`
+	PayloadFormat   string `json:"payloadFormat"` // raw MESSAGE FROM CAMERA, json EVENT OR template
+	PayloadTemplate string `json:"payloadTemplate"`
+	// LISTEN TO <TopicRoot>/alarmserver/cmd. ANYONE WHO CAN PUBLISH THERE CAN DISARM CAMERAS
+	Commands bool `json:"commands"`
+}
+
+// HomeAssistantConfig turns on MQTT discovery, so that cameras show up in Home Assistant as devices
+// with a binary sensor per event type
+type HomeAssistantConfig struct {
+	Enabled         bool          `json:"enabled"`
+	DiscoveryPrefix string        `json:"discoveryPrefix"`
+	OffDelay        time.Duration `json:"offDelay"` // SENSORS TURN OFF AFTER THIS, UNLESS SOURCE SENDS ALARM END
+	// SENSORS TO CREATE FOR CONFIGURED HIKVISION AND DAHUA CAMERAS RIGHT AWAY, KEYED BY SOURCE.
+	// OTHER EVENT TYPES AND DEVICES GET THEIRS WHEN THEY SEND FIRST EVENT
+	EventTypes map[string][]string `json:"eventTypes"`
+}
+
+// MqttPublishConfig overrides what is set, leaves the rest as it is for all messages
+type MqttPublishConfig struct {
+	Qos    *int  `json:"qos"`
+	Retain *bool `json:"retain"`
+}
+
+type MqttTlsConfig struct {
+	CaFile             string `json:"caFile"` // TRUSTED ON TOP OF SYSTEM CAS
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+// MqttBufferConfig is where messages wait while broker is unreachable
+type MqttBufferConfig struct {
+	Size       int    `json:"size"`       // 0 DROPS MESSAGES RIGHT AWAY
+	DropPolicy string `json:"dropPolicy"` // WHAT GOES WHEN IT IS FULL: "oldest" OR "newest"
+	Path       string `json:"path"`       // KEEP IT ON DISK, EMPTY KEEPS IT IN MEMORY
 }
 
 type WebhooksConfig struct {
 	Enabled bool            `json:"enabled"`
 	Items   []WebhookConfig `json:"items"`
 	Urls    []string        `json:"urls"`
+	Retry   RetryConfig     `json:"retry"` // FOR ALL WEBHOOKS, UNLESS THEY HAVE THEIR OWN
+	Outbox  OutboxConfig    `json:"outbox"`
 }
 
 type WebhookConfig struct {
-	Url          string   `json:"url"`
-	Method       string   `json:"method"`
-	Headers      []string `json:"headers"`
-	BodyTemplate string   `json:"bodyTemplate"`
+	Url          string       `json:"url"`
+	Method       string       `json:"method"`
+	Headers      []string     `json:"headers"`
+	BodyTemplate string       `json:"bodyTemplate"`
+	Retry        *RetryConfig `json:"retry"` // OVERRIDES VALUES OF webhooks.retry THAT ARE SET
+}
+
+// RetryConfig controls redelivery of webhooks that failed
+type RetryConfig struct {
+	MaxAttempts  int           `json:"maxAttempts"` // INCLUDING FIRST ONE, THEN IT GOES TO DEAD LETTERS
+	InitialDelay time.Duration `json:"initialDelay"`
+	MaxDelay     time.Duration `json:"maxDelay"`
+	RetryOn      []int         `json:"retryOn"` // STATUS CODES WORTH RETRYING. REQUESTS WITHOUT RESPONSE ARE ALWAYS RETRIED
+}
+
+// OutboxConfig is where webhook deliveries wait until they succeed, surviving restarts
+type OutboxConfig struct {
+	Path           string `json:"path"`
+	MaxDeadLetters int    `json:"maxDeadLetters"` // OLDEST ARE DELETED PAST THIS
+}
+
+// StoreConfig is the on-disk history of all events and their deliveries
+type StoreConfig struct {
+	Enabled   bool          `json:"enabled"`
+	Path      string        `json:"path"`
+	MaxAge    time.Duration `json:"maxAge"`    // 0 KEEPS EVENTS FOREVER
+	MaxEvents int           `json:"maxEvents"` // 0 MEANS NO LIMIT
+}
+
+// DashboardConfig is the web UI, served by HTTP listener. Username and password turn on basic auth
+type DashboardConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// StreamConfig is the live event stream over SSE and WebSocket, served by HTTP listener
+type StreamConfig struct {
+	Enabled        bool     `json:"enabled"`
+	Token          string   `json:"token"`          // EMPTY MEANS ANYONE CAN LISTEN
+	AllowedOrigins []string `json:"allowedOrigins"` // FOR BROWSERS ON OTHER ORIGINS, "*" ALLOWS ALL
+	BufferSize     int      `json:"bufferSize"`     // EVENTS QUEUED PER CLIENT BEFORE IT IS CONSIDERED TOO SLOW
+}
+
+// ArmingConfig is which events go on to buses in each arming mode. Modes can be set for all cameras
+// and for each camera on its own, and survive restarts
+type ArmingConfig struct {
+	Path        string                `json:"path"`        // WHERE MODES ARE KEPT, EMPTY KEEPS THEM IN MEMORY
+	DefaultMode string                `json:"defaultMode"` // MODE ON FIRST START, AND THE ONE arm SWITCHES TO
+	Modes       map[string]ModeConfig `json:"modes"`       // EMPTY MEANS home, away AND night FORWARD ALL
+}
+
+// ModeConfig forwards events that match any of its rules. Mode without rules forwards nothing
+type ModeConfig struct {
+	Forward []ForwardRule `json:"forward"`
+}
+
+// ForwardRule matches events of any of its cameras and event types. Empty list or "*" matches all
+type ForwardRule struct {
+	Cameras []string `json:"cameras"`
+	Events  []string `json:"events"`
+}
+
+// SchedulesConfig limits when events go on to buses, on top of arming mode
+type SchedulesConfig struct {
+	Timezone string           `json:"timezone"` // EMPTY IS LOCAL TIME, SET BY TZ ENV
+	Items    []ScheduleConfig `json:"items"`
+}
+
+// ScheduleConfig lets events of its cameras and types go to its buses only at its times. Empty list or "*" matches all
+type ScheduleConfig struct {
+	Name    string       `json:"name"`
+	Cameras []string     `json:"cameras"`
+	Events  []string     `json:"events"`
+	Buses   []string     `json:"buses"`
+	At      []TimeWindow `json:"at"`
+}
+
+// TimeWindow is a time of day on days of week, like 22:00 to 06:00 on weekdays. Window that goes past midnight
+// belongs to the day it starts on
+type TimeWindow struct {
+	Days []string `json:"days"` // mon, tue... OR weekdays AND weekends. EMPTY MEANS EVERY DAY
+	From string   `json:"from"` // HH:MM, EMPTY MEANS MIDNIGHT
+	To   string   `json:"to"`   // HH:MM, EMPTY MEANS END OF DAY
 }
 
 type HisiliconConfig struct {
-	Enabled bool   `json:"enabled"`
-	Port    string `json:"port"`
+	Enabled      bool          `json:"enabled"`
+	Port         string        `json:"port"`
+	AlarmEnd     bool          `json:"alarmEnd"`
+	AlarmTimeout time.Duration `json:"alarmTimeout"`
 }
 
 type HikvisionConfig struct {
-	Enabled bool                  `json:"enabled"`
-	Cams    []hikvision.HikCamera `json:"cams"`
+	Enabled     bool                  `json:"enabled"`
+	AlarmEnd    bool                  `json:"alarmEnd"`
+	Reconnect   retry.Policy          `json:"reconnect"`
+	IdleTimeout time.Duration         `json:"idleTimeout"`
+	Cams        []hikvision.HikCamera `json:"cams"`
 }
 
 type DahuaConfig struct {
-	Enabled bool             `json:"enabled"`
-	Cams    []dahua.DhCamera `json:"cams"`
+	Enabled     bool             `json:"enabled"`
+	AlarmEnd    bool             `json:"alarmEnd"`
+	Reconnect   retry.Policy     `json:"reconnect"`
+	IdleTimeout time.Duration    `json:"idleTimeout"`
+	Cams        []dahua.DhCamera `json:"cams"`
 }
 
 type FtpConfig struct {
-	Enabled    bool   `json:"enabled"`
-	Port       int    `json:"port"`
-	AllowFiles bool   `json:"allowFiles"`
-	Password   string `json:"password"`
-	RootPath   string `json:"rootPath"`
+	Enabled      bool          `json:"enabled"`
+	Port         int           `json:"port"`
+	AllowFiles   bool          `json:"allowFiles"`
+	Password     string        `json:"password"`
+	RootPath     string        `json:"rootPath"`
+	AlarmEnd     bool          `json:"alarmEnd"`
+	AlarmTimeout time.Duration `json:"alarmTimeout"`
 }
 
 func (c *Config) SetDefaults() {
@@ -71,15 +238,55 @@ func (c *Config) SetDefaults() {
 	viper.AddConfigPath("/config/")
 
 	viper.SetDefault("debug", false)
+	viper.SetDefault("log.format", "text")
+	viper.SetDefault("shutdownTimeout", "10s")
+	viper.SetDefault("reconnect.initialDelay", "1s")
+	viper.SetDefault("reconnect.maxDelay", "2m")
+	viper.SetDefault("reconnect.jitter", 0.2)
+	viper.SetDefault("reconnect.maxAttempts", 0)
+	viper.SetDefault("http.enabled", false)
+	viper.SetDefault("http.port", 8080)
+	viper.SetDefault("api.enabled", false)
+	viper.SetDefault("api.readOnly", true)
+	viper.SetDefault("api.recentEvents", 50)
+	viper.SetDefault("webhooks.outbox.path", "./outbox.db")
+	viper.SetDefault("webhooks.outbox.maxDeadLetters", 1000)
+	viper.SetDefault("store.enabled", false)
+	viper.SetDefault("store.path", "./events.db")
+	viper.SetDefault("store.maxAge", "720h")
+	viper.SetDefault("store.maxEvents", 100000)
+	viper.SetDefault("dashboard.enabled", false)
+	viper.SetDefault("stream.enabled", false)
+	viper.SetDefault("stream.bufferSize", 64)
 	viper.SetDefault("mqtt.port", 1883)
 	viper.SetDefault("mqtt.topicRoot", "camera-alerts")
 	viper.SetDefault("mqtt.server", "mqtt.example.com")
 	viper.SetDefault("mqtt.username", "anonymous")
 	viper.SetDefault("mqtt.password", "")
+	viper.SetDefault("mqtt.protocol", "tcp")
+	viper.SetDefault("mqtt.path", "/mqtt")
+	viper.SetDefault("mqtt.qos", 0)
+	viper.SetDefault("mqtt.retain", false)
+	viper.SetDefault("mqtt.homeAssistant.enabled", false)
+	viper.SetDefault("mqtt.homeAssistant.discoveryPrefix", "homeassistant")
+	viper.SetDefault("mqtt.homeAssistant.offDelay", "30s")
+	viper.SetDefault("mqtt.homeAssistant.eventTypes", map[string][]string{
+		"hikvision": {"VMD"},
+		"dahua":     {"VideoMotion"},
+	})
+	viper.SetDefault("mqtt.topicTemplate", "{{ .TopicRoot }}/{{ .Camera }}/{{ .Event }}")
+	viper.SetDefault("mqtt.payloadFormat", "raw")
+	viper.SetDefault("mqtt.commands", false)
+	viper.SetDefault("mqtt.buffer.size", 1000)
+	viper.SetDefault("mqtt.buffer.dropPolicy", "oldest")
+	viper.SetDefault("arming.path", "./arming.json")
+	viper.SetDefault("arming.defaultMode", "away")
 	viper.SetDefault("hisilicon.enabled", true)
 	viper.SetDefault("hisilicon.port", 15002)
 	viper.SetDefault("hikvision.enabled", false)
+	viper.SetDefault("hikvision.idleTimeout", "60s")
 	viper.SetDefault("dahua.enabled", false)
+	viper.SetDefault("dahua.idleTimeout", "30s")
 	viper.SetDefault("ftp.enabled", false)
 	viper.SetDefault("ftp.port", 21)
 	viper.SetDefault("ftp.allowFiles", true)
@@ -87,11 +294,47 @@ func (c *Config) SetDefaults() {
 	viper.SetDefault("ftp.rootPath", "./ftp")
 
 	_ = viper.BindEnv("debug", "DEBUG")
+	_ = viper.BindEnv("log.level", "LOG_LEVEL")
+	_ = viper.BindEnv("log.format", "LOG_FORMAT")
+	_ = viper.BindEnv("shutdownTimeout", "SHUTDOWN_TIMEOUT")
+	_ = viper.BindEnv("http.enabled", "HTTP_ENABLED")
+	_ = viper.BindEnv("http.port", "HTTP_PORT")
+	_ = viper.BindEnv("api.enabled", "API_ENABLED")
+	_ = viper.BindEnv("api.token", "API_TOKEN")
+	_ = viper.BindEnv("api.readOnly", "API_READ_ONLY")
+	_ = viper.BindEnv("webhooks.outbox.path", "WEBHOOKS_OUTBOX_PATH")
+	_ = viper.BindEnv("store.enabled", "STORE_ENABLED")
+	_ = viper.BindEnv("store.path", "STORE_PATH")
+	_ = viper.BindEnv("store.maxAge", "STORE_MAX_AGE")
+	_ = viper.BindEnv("store.maxEvents", "STORE_MAX_EVENTS")
+	_ = viper.BindEnv("dashboard.enabled", "DASHBOARD_ENABLED")
+	_ = viper.BindEnv("dashboard.username", "DASHBOARD_USERNAME")
+	_ = viper.BindEnv("dashboard.password", "DASHBOARD_PASSWORD")
+	_ = viper.BindEnv("stream.enabled", "STREAM_ENABLED")
+	_ = viper.BindEnv("stream.token", "STREAM_TOKEN")
 	_ = viper.BindEnv("mqtt.port", "MQTT_PORT")
 	_ = viper.BindEnv("mqtt.topicRoot", "MQTT_TOPIC_ROOT")
 	_ = viper.BindEnv("mqtt.server", "MQTT_SERVER")
 	_ = viper.BindEnv("mqtt.username", "MQTT_USERNAME")
 	_ = viper.BindEnv("mqtt.password", "MQTT_PASSWORD")
+	_ = viper.BindEnv("mqtt.protocol", "MQTT_PROTOCOL")
+	_ = viper.BindEnv("mqtt.clientId", "MQTT_CLIENT_ID")
+	_ = viper.BindEnv("mqtt.tls.caFile", "MQTT_TLS_CA_FILE")
+	_ = viper.BindEnv("mqtt.tls.certFile", "MQTT_TLS_CERT_FILE")
+	_ = viper.BindEnv("mqtt.tls.keyFile", "MQTT_TLS_KEY_FILE")
+	_ = viper.BindEnv("mqtt.tls.insecureSkipVerify", "MQTT_TLS_INSECURE_SKIP_VERIFY")
+	_ = viper.BindEnv("mqtt.qos", "MQTT_QOS")
+	_ = viper.BindEnv("mqtt.retain", "MQTT_RETAIN")
+	_ = viper.BindEnv("mqtt.homeAssistant.enabled", "MQTT_HOME_ASSISTANT_ENABLED")
+	_ = viper.BindEnv("mqtt.homeAssistant.discoveryPrefix", "MQTT_HOME_ASSISTANT_DISCOVERY_PREFIX")
+	_ = viper.BindEnv("mqtt.topicTemplate", "MQTT_TOPIC_TEMPLATE")
+	_ = viper.BindEnv("mqtt.payloadFormat", "MQTT_PAYLOAD_FORMAT")
+	_ = viper.BindEnv("mqtt.commands", "MQTT_COMMANDS")
+	_ = viper.BindEnv("mqtt.buffer.size", "MQTT_BUFFER_SIZE")
+	_ = viper.BindEnv("mqtt.buffer.path", "MQTT_BUFFER_PATH")
+	_ = viper.BindEnv("arming.path", "ARMING_PATH")
+	_ = viper.BindEnv("arming.defaultMode", "ARMING_DEFAULT_MODE")
+	_ = viper.BindEnv("schedules.timezone", "SCHEDULES_TIMEZONE")
 	_ = viper.BindEnv("hisilicon.enabled", "HISILICON_ENABLED")
 	_ = viper.BindEnv("hisilicon.port", "HISILICON_PORT", "TCP_PORT")
 	_ = viper.BindEnv("hikvision.enabled", "HIKVISION_ENABLED")
@@ -107,7 +350,7 @@ func (c *Config) SetDefaults() {
 	err := viper.ReadInConfig()
 	if err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			fmt.Println("Config file not found, writing default config...")
+			log.Warn("config file not found, writing default config...")
 			err := viper.SafeWriteConfig()
 			if err != nil {
 				panic(fmt.Errorf("error saving default config file: %s \n", err))
@@ -120,18 +363,66 @@ func (c *Config) SetDefaults() {
 
 func (c *Config) Load() *Config {
 	myConfig := Config{
-		Debug:     viper.GetBool("debug"),
+		Debug: viper.GetBool("debug"),
+		Log: logging.Options{
+			Level:  viper.GetString("log.level"),
+			Format: viper.GetString("log.format"),
+			Levels: viper.GetStringMapString("log.levels"),
+		},
+		ShutdownTimeout: viper.GetDuration("shutdownTimeout"),
+		Http: HttpConfig{
+			Enabled: viper.GetBool("http.enabled"),
+			Port:    viper.GetInt("http.port"),
+		},
+		Api: ApiConfig{
+			Enabled:      viper.GetBool("api.enabled"),
+			Token:        viper.GetString("api.token"),
+			ReadOnly:     viper.GetBool("api.readOnly"),
+			RecentEvents: viper.GetInt("api.recentEvents"),
+		},
+		Store: StoreConfig{
+			Enabled:   viper.GetBool("store.enabled"),
+			Path:      viper.GetString("store.path"),
+			MaxAge:    viper.GetDuration("store.maxAge"),
+			MaxEvents: viper.GetInt("store.maxEvents"),
+		},
+		Dashboard: DashboardConfig{
+			Enabled:  viper.GetBool("dashboard.enabled"),
+			Username: viper.GetString("dashboard.username"),
+			Password: viper.GetString("dashboard.password"),
+		},
+		Stream: StreamConfig{
+			Enabled:        viper.GetBool("stream.enabled"),
+			Token:          viper.GetString("stream.token"),
+			AllowedOrigins: viper.GetStringSlice("stream.allowedOrigins"),
+			BufferSize:     viper.GetInt("stream.bufferSize"),
+		},
+		Arming: ArmingConfig{
+			Path:        viper.GetString("arming.path"),
+			DefaultMode: viper.GetString("arming.defaultMode"),
+		},
 		Mqtt:      MqttConfig{},
 		Webhooks:  WebhooksConfig{},
 		Hisilicon: HisiliconConfig{},
 		Hikvision: HikvisionConfig{
-			Enabled: viper.GetBool("hikvision.enabled"),
+			Enabled:     viper.GetBool("hikvision.enabled"),
+			AlarmEnd:    viper.GetBool("hikvision.alarmEnd"),
+			Reconnect:   loadReconnectPolicy("hikvision"),
+			IdleTimeout: viper.GetDuration("hikvision.idleTimeout"),
 		},
 		Dahua: DahuaConfig{
-			Enabled: viper.GetBool("dahua.enabled"),
+			Enabled:     viper.GetBool("dahua.enabled"),
+			AlarmEnd:    viper.GetBool("dahua.alarmEnd"),
+			Reconnect:   loadReconnectPolicy("dahua"),
+			IdleTimeout: viper.GetDuration("dahua.idleTimeout"),
 		},
 	}
 
+	// OLD debug FLAG IS A SHORTHAND FOR DEBUG LOG LEVEL
+	if myConfig.Log.Level == "" && myConfig.Debug {
+		myConfig.Log.Level = "debug"
+	}
+
 	if viper.IsSet("mqtt") {
 		err := viper.Sub("mqtt").Unmarshal(&myConfig.Mqtt)
 		if err != nil {
@@ -144,6 +435,50 @@ func (c *Config) Load() *Config {
 			panic(fmt.Errorf("unable to decode webhooks config, %v", err))
 		}
 	}
+	// SUB-CONFIG DOES NOT SEE DEFAULTS AND ENV
+	myConfig.Mqtt.Protocol = viper.GetString("mqtt.protocol")
+	myConfig.Mqtt.Path = viper.GetString("mqtt.path")
+	myConfig.Mqtt.ClientId = viper.GetString("mqtt.clientId")
+	myConfig.Mqtt.Commands = viper.GetBool("mqtt.commands")
+	myConfig.Mqtt.Qos = viper.GetInt("mqtt.qos")
+	myConfig.Mqtt.Retain = viper.GetBool("mqtt.retain")
+	myConfig.Mqtt.TopicTemplate = viper.GetString("mqtt.topicTemplate")
+	myConfig.Mqtt.PayloadFormat = viper.GetString("mqtt.payloadFormat")
+	myConfig.Mqtt.HomeAssistant = HomeAssistantConfig{
+		Enabled:         viper.GetBool("mqtt.homeAssistant.enabled"),
+		DiscoveryPrefix: viper.GetString("mqtt.homeAssistant.discoveryPrefix"),
+		OffDelay:        viper.GetDuration("mqtt.homeAssistant.offDelay"),
+		EventTypes:      viper.GetStringMapStringSlice("mqtt.homeAssistant.eventTypes"),
+	}
+	myConfig.Mqtt.Tls = MqttTlsConfig{
+		CaFile:             viper.GetString("mqtt.tls.caFile"),
+		CertFile:           viper.GetString("mqtt.tls.certFile"),
+		KeyFile:            viper.GetString("mqtt.tls.keyFile"),
+		InsecureSkipVerify: viper.GetBool("mqtt.tls.insecureSkipVerify"),
+	}
+	myConfig.Mqtt.Buffer = MqttBufferConfig{
+		Size:       viper.GetInt("mqtt.buffer.size"),
+		DropPolicy: viper.GetString("mqtt.buffer.dropPolicy"),
+		Path:       viper.GetString("mqtt.buffer.path"),
+	}
+	myConfig.Webhooks.Outbox = OutboxConfig{
+		Path:           viper.GetString("webhooks.outbox.path"),
+		MaxDeadLetters: viper.GetInt("webhooks.outbox.maxDeadLetters"),
+	}
+	if viper.IsSet("arming.modes") {
+		err := viper.UnmarshalKey("arming.modes", &myConfig.Arming.Modes)
+		if err != nil {
+			panic(fmt.Errorf("unable to decode arming modes, %v", err))
+		}
+	}
+	if viper.IsSet("schedules") {
+		err := viper.Sub("schedules").Unmarshal(&myConfig.Schedules)
+		if err != nil {
+			panic(fmt.Errorf("unable to decode schedules config, %v", err))
+		}
+	}
+	// SUB-CONFIG DOES NOT SEE ENV
+	myConfig.Schedules.Timezone = viper.GetString("schedules.timezone")
 	if viper.IsSet("hisilicon") {
 		err := viper.Sub("hisilicon").Unmarshal(&myConfig.Hisilicon)
 		if err != nil {
@@ -157,10 +492,6 @@ func (c *Config) Load() *Config {
 		}
 	}
 
-	if !myConfig.Mqtt.Enabled && !myConfig.Webhooks.Enabled {
-		panic("Both MQTT and Webhook buses are disabled. Nothing to do!")
-	}
-
 	if !myConfig.Hisilicon.Enabled && !myConfig.Hikvision.Enabled && !myConfig.Dahua.Enabled && !myConfig.Ftp.Enabled {
 		panic("No Servers are enabled. Nothing to do!")
 	}
@@ -190,21 +521,6 @@ func (c *Config) Load() *Config {
 				if camConfig.GetBool("rawTcp") {
 					camera.BrokenHttp = true
 				}
-				if myConfig.Debug {
-					fmt.Printf("Added Hikvision camera:\n"+
-						"  name: %s \n"+
-						"  url: %s \n"+
-						"  username: %s \n"+
-						"  password set: %t\n"+
-						"  rawRcp: %t\n",
-						camera.Name,
-						camera.Url,
-						camera.Username,
-						camera.Password != "",
-						camera.BrokenHttp,
-					)
-				}
-
 				myConfig.Hikvision.Cams = append(myConfig.Hikvision.Cams, camera)
 			}
 		}
@@ -239,7 +555,6 @@ func (c *Config) Load() *Config {
 				channel = camConfig.GetString("channel")
 			}
 			camera := dahua.DhCamera{
-				Debug:    myConfig.Debug,
 				Name:     camName,
 				Url:      url,
 				Username: camConfig.GetString("username"),
@@ -248,64 +563,155 @@ func (c *Config) Load() *Config {
 				Events:   eventsFilter,
 			}
 
-			if myConfig.Debug {
-				fmt.Printf("Added Dahua camera:\n"+
-					"  name: %s \n"+
-					"  url: %s \n"+
-					"  username: %s \n"+
-					"  password set: %t\n",
-					camera.Name,
-					camera.Url,
-					camera.Username,
-					camera.Password != "",
-				)
-			}
-
 			myConfig.Dahua.Cams = append(myConfig.Dahua.Cams, camera)
 		}
 	}
 	return &myConfig
 }
 
+// Reload reads config file again. Unlike Load, it returns an error instead of panicking when config is broken
+func (c *Config) Reload() (newConfig *Config, err error) {
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			newConfig, err = nil, fmt.Errorf("%v", recovered)
+		}
+	}()
+	return c.Load(), nil
+}
+
+// loadReconnectPolicy reads top-level "reconnect" section, overridden by "<server>.reconnect" values if present
+func loadReconnectPolicy(server string) retry.Policy {
+	get := func(key string) string {
+		if viper.IsSet(server + ".reconnect." + key) {
+			return server + ".reconnect." + key
+		}
+		return "reconnect." + key
+	}
+	return retry.Policy{
+		InitialDelay: viper.GetDuration(get("initialDelay")),
+		MaxDelay:     viper.GetDuration(get("maxDelay")),
+		Jitter:       viper.GetFloat64(get("jitter")),
+		MaxAttempts:  viper.GetInt(get("maxAttempts")),
+	}
+}
+
+// IsEnabled reports whether config section under key has "enabled: true"
+func (c *Config) IsEnabled(key string) bool {
+	return viper.GetBool(key + ".enabled")
+}
+
+// UnmarshalKey decodes config section under key into target, for buses and servers that bring their own config
+func (c *Config) UnmarshalKey(key string, target interface{}) error {
+	if !viper.IsSet(key) {
+		return nil
+	}
+	return viper.Sub(key).Unmarshal(target)
+}
+
+// Printout logs loaded config at debug level, without any passwords
 func (c *Config) Printout() {
-	fmt.Printf("CONFIG:\n"+
-		"  SERVER: Hisilicon - enabled: %t\n"+
-		"    port: %s\n"+
-		"  SERVER: Hikvision - enabled: %t\n"+
-		"    camera count: %d\n"+
-		"  SERVER Dahua enabled: %t\n"+
-		"    camera count: %d\n"+
-		"  SERVER: FTP - enabled: %t\n"+
-		"    port: %d\n"+
-		"    files allowed: %t\n"+
-		"    password set: %t\n"+
-		"    root path: %s\n"+
-		"  BUS: MQTT - enabled: %t\n"+
-		"    port: %s\n"+
-		"    topicRoot: %s\n"+
-		"    server: %s\n"+
-		"    username: %s\n"+
-		"    password set: %t\n"+
-		"  BUS: Webhooks - enabled: %t\n"+
-		"    count: %d\n",
-		c.Hisilicon.Enabled,
-		c.Hisilicon.Port,
-		c.Hikvision.Enabled,
-		len(c.Hikvision.Cams),
-		c.Dahua.Enabled,
-		len(c.Dahua.Cams),
-		c.Ftp.Enabled,
-		c.Ftp.Port,
-		c.Ftp.AllowFiles,
-		c.Ftp.Password != "",
-		c.Ftp.RootPath,
-		c.Mqtt.Enabled,
-		c.Mqtt.Port,
-		c.Mqtt.TopicRoot,
-		c.Mqtt.Server,
-		c.Mqtt.Username,
-		c.Mqtt.Password != "",
-		c.Webhooks.Enabled,
-		len(c.Webhooks.Items)+len(c.Webhooks.Urls),
+	hikvisionCams := make([]any, 0, len(c.Hikvision.Cams))
+	for _, camera := range c.Hikvision.Cams {
+		hikvisionCams = append(hikvisionCams, slog.Group(camera.Name,
+			"url", camera.Url,
+			"username", camera.Username,
+			"passwordSet", camera.Password != "",
+			"rawTcp", camera.BrokenHttp,
+		))
+	}
+	dahuaCams := make([]any, 0, len(c.Dahua.Cams))
+	for _, camera := range c.Dahua.Cams {
+		dahuaCams = append(dahuaCams, slog.Group(camera.Name,
+			"url", camera.Url,
+			"username", camera.Username,
+			"passwordSet", camera.Password != "",
+		))
+	}
+	log.Debug("config loaded",
+		slog.Group("hisilicon",
+			"enabled", c.Hisilicon.Enabled,
+			"port", c.Hisilicon.Port,
+		),
+		slog.Group("hikvision",
+			"enabled", c.Hikvision.Enabled,
+			slog.Group("cams", hikvisionCams...),
+		),
+		slog.Group("dahua",
+			"enabled", c.Dahua.Enabled,
+			slog.Group("cams", dahuaCams...),
+		),
+		slog.Group("ftp",
+			"enabled", c.Ftp.Enabled,
+			"port", c.Ftp.Port,
+			"filesAllowed", c.Ftp.AllowFiles,
+			"passwordSet", c.Ftp.Password != "",
+			"rootPath", c.Ftp.RootPath,
+		),
+		slog.Group("http",
+			"enabled", c.Http.Enabled,
+			"port", c.Http.Port,
+		),
+		slog.Group("api",
+			"enabled", c.Api.Enabled,
+			"tokenSet", c.Api.Token != "",
+			"readOnly", c.Api.ReadOnly,
+			"recentEvents", c.Api.RecentEvents,
+		),
+		slog.Group("mqtt",
+			"enabled", c.Mqtt.Enabled,
+			"port", c.Mqtt.Port,
+			"topicRoot", c.Mqtt.TopicRoot,
+			"server", c.Mqtt.Server,
+			"username", c.Mqtt.Username,
+			"passwordSet", c.Mqtt.Password != "",
+			"protocol", c.Mqtt.Protocol,
+			"clientId", c.Mqtt.ClientId,
+			"tlsCaFile", c.Mqtt.Tls.CaFile,
+			"tlsCertFile", c.Mqtt.Tls.CertFile,
+			"tlsInsecureSkipVerify", c.Mqtt.Tls.InsecureSkipVerify,
+			"qos", c.Mqtt.Qos,
+			"retain", c.Mqtt.Retain,
+			"overrides", len(c.Mqtt.Overrides),
+			"homeAssistant", c.Mqtt.HomeAssistant.Enabled,
+			"topicTemplate", c.Mqtt.TopicTemplate,
+			"payloadFormat", c.Mqtt.PayloadFormat,
+			"commands", c.Mqtt.Commands,
+			"bufferSize", c.Mqtt.Buffer.Size,
+			"bufferPath", c.Mqtt.Buffer.Path,
+		),
+		slog.Group("webhooks",
+			"enabled", c.Webhooks.Enabled,
+			"count", len(c.Webhooks.Items)+len(c.Webhooks.Urls),
+			"outbox", c.Webhooks.Outbox.Path,
+		),
+		slog.Group("store",
+			"enabled", c.Store.Enabled,
+			"path", c.Store.Path,
+			"maxAge", c.Store.MaxAge,
+			"maxEvents", c.Store.MaxEvents,
+		),
+		slog.Group("dashboard",
+			"enabled", c.Dashboard.Enabled,
+			"username", c.Dashboard.Username,
+			"passwordSet", c.Dashboard.Password != "",
+		),
+		slog.Group("stream",
+			"enabled", c.Stream.Enabled,
+			"tokenSet", c.Stream.Token != "",
+			"allowedOrigins", c.Stream.AllowedOrigins,
+			"bufferSize", c.Stream.BufferSize,
+		),
+		slog.Group("arming",
+			"path", c.Arming.Path,
+			"defaultMode", c.Arming.DefaultMode,
+			"modes", len(c.Arming.Modes),
+		),
+		slog.Group("schedules",
+			"timezone", c.Schedules.Timezone,
+			"count", len(c.Schedules.Items),
+		),
 	)
 }
@@ -0,0 +1,133 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"github.com/toxuin/alarmserver/buses"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/logging"
+	"github.com/toxuin/alarmserver/servers"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logging.For("control")
+
+const (
+	CommandArm    = "arm"
+	CommandDisarm = "disarm"
+	CommandMode   = "mode"
+	CommandMute   = "mute"
+	CommandUnmute = "unmute"
+	CommandTest   = "test"
+	CommandStatus = "status"
+	CommandReload = "reload"
+)
+
+const defaultTestCamera = "alarmserver"
+
+// Controller carries out commands that come from buses
+type Controller struct {
+	Router    *Router
+	Schedules *Schedules
+	Servers   *servers.Supervisor
+	Buses     *buses.Manager
+	Handler   events.Handler // TEST EVENTS GO HERE, SAME AS EVENTS OF SERVERS
+	Reload    func() error   // RE-READS CONFIG AND RESTARTS ALARM SERVERS WITH IT
+	lock      sync.Mutex     // ONE RELOAD AT A TIME
+}
+
+type status struct {
+	Servers   map[string]servers.Status `json:"servers"`
+	Buses     map[string]buses.Health   `json:"buses"`
+	Routing   RouterState               `json:"routing"`
+	Schedules []ScheduleState           `json:"schedules"`
+}
+
+type muteResult struct {
+	Camera string    `json:"camera"`
+	Until  time.Time `json:"until"`
+}
+
+// Handle is a buses.CommandHandler
+func (controller *Controller) Handle(command buses.Command) buses.CommandReply {
+	command.Command = strings.ToLower(strings.TrimSpace(command.Command))
+	log.Info("received command", "command", command.Command, "camera", command.Camera)
+	result, err := controller.run(command)
+	reply := buses.CommandReply{ID: command.ID, Command: command.Command, Ok: err == nil, Result: result}
+	if err != nil {
+		log.Warn("command failed", "command", command.Command, "error", err)
+		reply.Error = err.Error()
+	}
+	return reply
+}
+
+func (controller *Controller) run(command buses.Command) (interface{}, error) {
+	switch command.Command {
+	case CommandArm:
+		return controller.routing(controller.Router.Arm(command.Camera))
+	case CommandDisarm:
+		return controller.routing(controller.Router.Disarm(command.Camera))
+	case CommandMode:
+		if command.Mode == "" {
+			return nil, errors.New("no mode given")
+		}
+		return controller.routing(controller.Router.SetMode(command.Camera, command.Mode))
+	case CommandMute:
+		if command.Minutes <= 0 {
+			return nil, errors.New("minutes must be more than 0")
+		}
+		until, err := controller.Router.Mute(command.Camera, time.Duration(command.Minutes)*time.Minute)
+		return muteResult{Camera: cameraKey(command.Camera), Until: until}, err
+	case CommandUnmute:
+		return controller.routing(controller.Router.Unmute(command.Camera))
+	case CommandTest:
+		return controller.test(command), nil
+	case CommandStatus:
+		return status{
+			Servers:   controller.Servers.Statuses(),
+			Buses:     controller.Buses.Health(),
+			Routing:   controller.Router.State(),
+			Schedules: controller.Schedules.State(time.Now()),
+		}, nil
+	case CommandReload:
+		if controller.Reload == nil {
+			return nil, errors.New("reload is not available")
+		}
+		controller.lock.Lock()
+		defer controller.lock.Unlock()
+		if err := controller.Reload(); err != nil {
+			return nil, err
+		}
+		return controller.Servers.Statuses(), nil
+	case "":
+		return nil, errors.New("no command given")
+	}
+	return nil, fmt.Errorf("unknown command %q", command.Command)
+}
+
+// routing replies with routing state after change, and error if change did not go well
+func (controller *Controller) routing(err error) (interface{}, error) {
+	return controller.Router.State(), err
+}
+
+// test sends an event through all buses, whatever the mode
+func (controller *Controller) test(command buses.Command) events.Event {
+	event := events.Event{
+		Source:  events.SourceTest,
+		Camera:  command.Camera,
+		Type:    command.Type,
+		State:   events.StateActive,
+		Time:    time.Now(),
+		Message: "test",
+	}
+	if event.Camera == "" {
+		event.Camera = defaultTestCamera
+	}
+	if event.Type == "" {
+		event.Type = CommandTest
+	}
+	controller.Handler(event)
+	return event
+}
@@ -0,0 +1,172 @@
+package control
+
+import (
+	"errors"
+	"github.com/toxuin/alarmserver/buses"
+	"github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/servers"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestController(t *testing.T) (*Controller, *[]events.Event) {
+	t.Helper()
+	schedules, err := NewSchedules(config.SchedulesConfig{})
+	if err != nil {
+		t.Fatalf("NewSchedules: %v", err)
+	}
+	var sent []events.Event
+	controller := &Controller{
+		Router:    newTestRouter(t),
+		Schedules: schedules,
+		Servers:   &servers.Supervisor{},
+		Buses:     &buses.Manager{},
+		Handler: func(event events.Event) {
+			sent = append(sent, event)
+		},
+	}
+	return controller, &sent
+}
+
+func TestControllerCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		command buses.Command
+		wantErr string
+		check   func(t *testing.T, state RouterState)
+	}{
+		{"arm", buses.Command{Command: "arm"}, "", func(t *testing.T, state RouterState) {
+			if state.Mode != "away" {
+				t.Errorf("mode is %q, want away", state.Mode)
+			}
+		}},
+		{"disarm camera", buses.Command{Command: "disarm", Camera: "Porch"}, "", func(t *testing.T, state RouterState) {
+			if state.Cameras["porch"] != ModeDisarmed {
+				t.Errorf("porch mode is %q, want %s", state.Cameras["porch"], ModeDisarmed)
+			}
+		}},
+		{"disarm all", buses.Command{Command: "disarm", Camera: AllCameras}, "", func(t *testing.T, state RouterState) {
+			if state.Mode != ModeDisarmed {
+				t.Errorf("mode is %q, want %s", state.Mode, ModeDisarmed)
+			}
+		}},
+		{"mode", buses.Command{Command: " MODE ", Mode: "Home"}, "", func(t *testing.T, state RouterState) {
+			if state.Mode != "home" {
+				t.Errorf("mode is %q, want home", state.Mode)
+			}
+		}},
+		{"mute", buses.Command{Command: "mute", Camera: "porch", Minutes: 10}, "", func(t *testing.T, state RouterState) {
+			if until := time.Until(state.Muted["porch"]); until <= 9*time.Minute || until > 10*time.Minute {
+				t.Errorf("porch is muted for %v, want 10m", until)
+			}
+		}},
+		{"unmute", buses.Command{Command: "unmute", Camera: "porch"}, "", func(t *testing.T, state RouterState) {
+			if len(state.Muted) != 0 {
+				t.Errorf("muted cameras are %v, want none", state.Muted)
+			}
+		}},
+		{"status", buses.Command{Command: "status"}, "", nil},
+		{"empty command", buses.Command{}, "no command given", nil},
+		{"unknown command", buses.Command{Command: "selfdestruct"}, `unknown command "selfdestruct"`, nil},
+		{"mode without mode", buses.Command{Command: "mode", Camera: "porch"}, "no mode given", nil},
+		{"unknown mode", buses.Command{Command: "mode", Mode: "party"}, "unknown mode", nil},
+		{"mute without minutes", buses.Command{Command: "mute", Camera: "porch"}, "minutes must be more than 0", nil},
+		{"mute for negative minutes", buses.Command{Command: "mute", Camera: "porch", Minutes: -5}, "minutes must be more than 0", nil},
+		{"reload without reloader", buses.Command{Command: "reload"}, "reload is not available", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			controller, _ := newTestController(t)
+			test.command.ID = "42"
+			reply := controller.Handle(test.command)
+			if reply.ID != "42" {
+				t.Errorf("reply ID is %q, want 42", reply.ID)
+			}
+			if reply.Ok != (test.wantErr == "") {
+				t.Errorf("reply ok is %v with error %q, want error %q", reply.Ok, reply.Error, test.wantErr)
+			}
+			if !strings.Contains(reply.Error, test.wantErr) {
+				t.Errorf("reply error is %q, want %q", reply.Error, test.wantErr)
+			}
+			if test.check != nil {
+				test.check(t, controller.Router.State())
+			}
+		})
+	}
+}
+
+func TestControllerBadCameraChangesNothing(t *testing.T) {
+	controller, _ := newTestController(t)
+	before := controller.Router.State()
+	for _, command := range []buses.Command{
+		{Command: "mode", Camera: "porch", Mode: "party"},
+		{Command: "mute", Camera: "porch"},
+		{Command: "mode", Camera: "porch"},
+	} {
+		if reply := controller.Handle(command); reply.Ok {
+			t.Errorf("%s command for porch succeeded, want error", command.Command)
+		}
+	}
+	after := controller.Router.State()
+	if len(after.Cameras) != 0 || len(after.Muted) != 0 || after.Mode != before.Mode {
+		t.Errorf("failed commands changed state to %+v", after)
+	}
+}
+
+func TestControllerCommandForUnseenCamera(t *testing.T) {
+	// CAMERA CAN BE DISARMED BEFORE ITS FIRST EVENT, FTP AND HISILICON ONES ARE NOT KNOWN UNTIL THEN
+	controller, _ := newTestController(t)
+	if reply := controller.Handle(buses.Command{Command: "disarm", Camera: "Shed"}); !reply.Ok {
+		t.Fatalf("disarm of unseen camera failed: %s", reply.Error)
+	}
+	if controller.Router.Allow(alarm("shed", events.StateActive)) {
+		t.Error("alarm of disarmed camera went through")
+	}
+	if !controller.Router.Allow(alarm("porch", events.StateActive)) {
+		t.Error("alarm of other camera was held back")
+	}
+}
+
+func TestControllerTestCommand(t *testing.T) {
+	controller, sent := newTestController(t)
+
+	reply := controller.Handle(buses.Command{Command: "test"})
+	if !reply.Ok {
+		t.Fatalf("test command failed: %s", reply.Error)
+	}
+	reply = controller.Handle(buses.Command{Command: "test", Camera: "porch", Type: "VMD"})
+	if !reply.Ok {
+		t.Fatalf("test command failed: %s", reply.Error)
+	}
+	if len(*sent) != 2 {
+		t.Fatalf("sent %d test events, want 2", len(*sent))
+	}
+	first, second := (*sent)[0], (*sent)[1]
+	if first.Source != events.SourceTest || first.Camera != defaultTestCamera || first.Type != CommandTest {
+		t.Errorf("default test event is %s/%s/%s, want %s/%s/%s",
+			first.Source, first.Camera, first.Type, events.SourceTest, defaultTestCamera, CommandTest)
+	}
+	if second.Camera != "porch" || second.Type != "VMD" {
+		t.Errorf("test event is %s/%s, want porch/VMD", second.Camera, second.Type)
+	}
+}
+
+func TestControllerReload(t *testing.T) {
+	controller, _ := newTestController(t)
+	reloads := 0
+	controller.Reload = func() error {
+		reloads++
+		if reloads > 1 {
+			return errors.New("bad config")
+		}
+		return nil
+	}
+	if reply := controller.Handle(buses.Command{Command: "reload"}); !reply.Ok {
+		t.Errorf("reload failed: %s", reply.Error)
+	}
+	if reply := controller.Handle(buses.Command{Command: "reload"}); reply.Ok || reply.Error != "bad config" {
+		t.Errorf("failed reload replied ok %v with error %q, want bad config", reply.Ok, reply.Error)
+	}
+}
@@ -0,0 +1,318 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/events"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wildcard = "*"
+	// AllCameras stands for every camera in arm, disarm, mode and mute commands
+	AllCameras   = wildcard
+	ModeDisarmed = "disarmed"
+)
+
+var ErrUnknownMode = errors.New("unknown mode")
+
+// defaultModes are there when config has none. They forward everything, disarmed is always added and forwards nothing
+var defaultModes = map[string]config.ModeConfig{
+	"home":  {Forward: []config.ForwardRule{{}}},
+	"away":  {Forward: []config.ForwardRule{{}}},
+	"night": {Forward: []config.ForwardRule{{}}},
+}
+
+// Router decides which events go on to buses, by arming mode of their camera. Cameras follow global mode,
+// unless they are given their own, and can be muted for a while. Events held back are still recorded,
+// just not forwarded. Modes and mutes are saved on every change, so that they survive restarts
+type Router struct {
+	lock        sync.Mutex
+	modes       map[string]config.ModeConfig
+	defaultMode string
+	path        string // EMPTY KEEPS STATE IN MEMORY
+	state       armingState
+	forwarded   map[events.Key]bool // ALARMS THAT WENT ON, SO THAT THEIR ENDS DO TOO
+}
+
+// armingState is what gets saved. Cameras are keyed by lowercase name, same as in config
+type armingState struct {
+	Mode    string               `json:"mode"`
+	Cameras map[string]string    `json:"cameras"` // MODES OF CAMERAS THAT DO NOT FOLLOW GLOBAL ONE
+	Muted   map[string]time.Time `json:"muted"`   // UNTIL WHEN
+}
+
+type RouterState struct {
+	Mode    string               `json:"mode"`
+	Cameras map[string]string    `json:"cameras"`
+	Muted   map[string]time.Time `json:"muted"`
+	Modes   []string             `json:"modes"`
+}
+
+// NewRouter picks up modes saved by last run, or starts in default mode
+func NewRouter(conf config.ArmingConfig) (*Router, error) {
+	configured := conf.Modes
+	if len(configured) == 0 {
+		configured = defaultModes
+	}
+	router := &Router{
+		modes:       make(map[string]config.ModeConfig, len(configured)+1),
+		defaultMode: strings.ToLower(conf.DefaultMode),
+		path:        conf.Path,
+		forwarded:   make(map[events.Key]bool),
+	}
+	for name, mode := range configured {
+		router.modes[strings.ToLower(name)] = mode
+	}
+	if _, found := router.modes[ModeDisarmed]; !found {
+		router.modes[ModeDisarmed] = config.ModeConfig{}
+	}
+	if _, found := router.modes[router.defaultMode]; !found {
+		return nil, fmt.Errorf("arming default mode %q is not one of modes", conf.DefaultMode)
+	}
+	router.state = armingState{
+		Mode:    router.defaultMode,
+		Cameras: make(map[string]string),
+		Muted:   make(map[string]time.Time),
+	}
+	if router.path != "" {
+		router.load()
+	}
+	log.Info("arming mode", "mode", router.state.Mode, "cameras", len(router.state.Cameras))
+	return router, nil
+}
+
+// load reads saved state. Broken or outdated one is not a reason to stay down, alarm server starts in default mode
+func (router *Router) load() {
+	data, err := os.ReadFile(router.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	saved := armingState{}
+	if err == nil {
+		err = json.Unmarshal(data, &saved)
+	}
+	if err != nil {
+		log.Error("unable to read arming state, starting in default mode", "path", router.path, "error", err)
+		return
+	}
+	if _, found := router.modes[saved.Mode]; found {
+		router.state.Mode = saved.Mode
+	} else {
+		log.Warn("saved mode is gone from config, starting in default mode", "mode", saved.Mode)
+	}
+	for camera, mode := range saved.Cameras {
+		if _, found := router.modes[mode]; !found {
+			log.Warn("saved camera mode is gone from config, camera follows global mode", "camera", camera, "mode", mode)
+			continue
+		}
+		router.state.Cameras[camera] = mode
+	}
+	for camera, until := range saved.Muted {
+		router.state.Muted[camera] = until
+	}
+}
+
+// save writes state next to where it goes and moves it there, so that crash does not leave half of it. Lock must be held
+func (router *Router) save() error {
+	if router.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(router.state, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(router.path), 0750)
+	}
+	if err == nil {
+		err = os.WriteFile(router.path+".tmp", data, 0640)
+	}
+	if err == nil {
+		err = os.Rename(router.path+".tmp", router.path)
+	}
+	if err != nil {
+		log.Error("unable to save arming state", "path", router.path, "error", err)
+		return fmt.Errorf("unable to save arming state, it will be lost on restart: %w", err)
+	}
+	return nil
+}
+
+// Allow tells if event should be sent to buses. Availability and test events always are, and so are ends
+// of alarms that were sent, or buses would keep them on forever
+func (router *Router) Allow(event events.Event) bool {
+	if event.Type == events.TypeAvailability || event.Source == events.SourceTest {
+		return true
+	}
+	key := events.KeyOf(event)
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	if event.State == events.StateInactive && router.forwarded[key] {
+		delete(router.forwarded, key)
+		return true
+	}
+	if !router.allows(event) {
+		return false
+	}
+	if event.State == events.StateActive {
+		router.forwarded[key] = true
+	}
+	return true
+}
+
+// allows tells if mode of event's camera forwards it. Lock must be held
+func (router *Router) allows(event events.Event) bool {
+	camera := strings.ToLower(event.Camera)
+	now := time.Now()
+	if router.isMuted(AllCameras, now) || router.isMuted(camera, now) {
+		return false
+	}
+	mode, found := router.state.Cameras[camera]
+	if !found {
+		mode = router.state.Mode
+	}
+	return forwards(router.modes[mode], event)
+}
+
+// isMuted forgets mutes that are over. Lock must be held
+func (router *Router) isMuted(camera string, now time.Time) bool {
+	until, muted := router.state.Muted[camera]
+	if muted && !now.Before(until) {
+		delete(router.state.Muted, camera)
+		return false
+	}
+	return muted
+}
+
+func forwards(mode config.ModeConfig, event events.Event) bool {
+	for _, rule := range mode.Forward {
+		if matchesAny(rule.Cameras, event.Camera) && matchesAny(rule.Events, event.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(names []string, name string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, candidate := range names {
+		if candidate == wildcard || strings.EqualFold(candidate, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetMode switches camera to mode, or all cameras that do not have their own
+func (router *Router) SetMode(camera string, mode string) error {
+	mode = strings.ToLower(mode)
+	if _, found := router.modes[mode]; !found {
+		return fmt.Errorf("%w %q", ErrUnknownMode, mode)
+	}
+	camera = cameraKey(camera)
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	if camera == AllCameras {
+		router.state.Mode = mode
+	} else {
+		router.state.Cameras[camera] = mode
+	}
+	log.Info("arming mode changed", "camera", camera, "mode", mode)
+	return router.save()
+}
+
+// ResetMode makes camera follow global mode again
+func (router *Router) ResetMode(camera string) error {
+	camera = cameraKey(camera)
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	delete(router.state.Cameras, camera)
+	log.Info("camera follows global mode", "camera", camera, "mode", router.state.Mode)
+	return router.save()
+}
+
+// Arm switches all cameras to default mode, dropping their own modes. Camera on its own follows global mode again,
+// or goes to default mode if global one is disarmed
+func (router *Router) Arm(camera string) error {
+	camera = cameraKey(camera)
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	switch {
+	case camera == AllCameras:
+		router.state.Mode = router.defaultMode
+		router.state.Cameras = make(map[string]string)
+	case router.state.Mode == ModeDisarmed:
+		router.state.Cameras[camera] = router.defaultMode
+	default:
+		delete(router.state.Cameras, camera)
+	}
+	log.Info("armed", "camera", camera)
+	return router.save()
+}
+
+func (router *Router) Disarm(camera string) error {
+	return router.SetMode(camera, ModeDisarmed)
+}
+
+// Mute holds events of camera back for duration, whatever the mode. Returns when it ends
+func (router *Router) Mute(camera string, duration time.Duration) (time.Time, error) {
+	camera = cameraKey(camera)
+	until := time.Now().Add(duration)
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	router.state.Muted[camera] = until
+	log.Info("muted", "camera", camera, "until", until)
+	return until, router.save()
+}
+
+func (router *Router) Unmute(camera string) error {
+	camera = cameraKey(camera)
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	if camera == AllCameras {
+		router.state.Muted = make(map[string]time.Time)
+	} else {
+		delete(router.state.Muted, camera)
+	}
+	log.Info("unmuted", "camera", camera)
+	return router.save()
+}
+
+func (router *Router) State() RouterState {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	state := RouterState{
+		Mode:    router.state.Mode,
+		Cameras: make(map[string]string, len(router.state.Cameras)),
+		Muted:   make(map[string]time.Time),
+		Modes:   make([]string, 0, len(router.modes)),
+	}
+	for camera, mode := range router.state.Cameras {
+		state.Cameras[camera] = mode
+	}
+	now := time.Now()
+	for camera, until := range router.state.Muted {
+		if router.isMuted(camera, now) {
+			state.Muted[camera] = until
+		}
+	}
+	for mode := range router.modes {
+		state.Modes = append(state.Modes, mode)
+	}
+	sort.Strings(state.Modes)
+	return state
+}
+
+// cameraKey is how camera is kept in state. Empty means all cameras
+func cameraKey(camera string) string {
+	if camera == "" {
+		return AllCameras
+	}
+	return strings.ToLower(camera)
+}
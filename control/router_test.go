@@ -0,0 +1,94 @@
+package control
+
+import (
+	"github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/events"
+	"testing"
+	"time"
+)
+
+func newTestRouter(t *testing.T) *Router {
+	t.Helper()
+	router, err := NewRouter(config.ArmingConfig{DefaultMode: "away"})
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	return router
+}
+
+func alarm(camera string, state events.State) events.Event {
+	event := events.Event{Camera: camera, Channel: "1", Type: "VMD", State: state}
+	event.SetMeta("region", "1")
+	return event
+}
+
+func TestRouterForwardsEndOfForwardedAlarm(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(router *Router) error
+	}{
+		{"disarm all", func(router *Router) error { return router.Disarm("") }},
+		{"disarm camera", func(router *Router) error { return router.Disarm("Porch") }},
+		{"mute", func(router *Router) error {
+			_, err := router.Mute("porch", time.Minute)
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := newTestRouter(t)
+			if !router.Allow(alarm("Porch", events.StateActive)) {
+				t.Fatal("start of alarm was held back while armed")
+			}
+			if err := test.change(router); err != nil {
+				t.Fatal(err)
+			}
+			if router.Allow(alarm("Porch", events.StateActive)) {
+				t.Error("new alarm went through after change")
+			}
+			if !router.Allow(alarm("Porch", events.StateInactive)) {
+				t.Error("end of forwarded alarm was held back")
+			}
+			if router.Allow(alarm("Porch", events.StateInactive)) {
+				t.Error("second end went through, it was forwarded already")
+			}
+		})
+	}
+}
+
+func TestRouterHoldsEndOfHeldAlarm(t *testing.T) {
+	router := newTestRouter(t)
+	if err := router.Disarm(""); err != nil {
+		t.Fatal(err)
+	}
+	if router.Allow(alarm("Porch", events.StateActive)) {
+		t.Fatal("start went through while disarmed")
+	}
+	if err := router.Arm(""); err != nil {
+		t.Fatal(err)
+	}
+	if !router.Allow(alarm("Porch", events.StateInactive)) {
+		t.Error("end is held back while armed")
+	}
+	other := alarm("Porch", events.StateInactive)
+	other.SetMeta("region", "2")
+	if err := router.Disarm(""); err != nil {
+		t.Fatal(err)
+	}
+	if router.Allow(other) {
+		t.Error("end of alarm that never went through was forwarded")
+	}
+}
+
+func TestRouterAlwaysAllowsAvailabilityAndTest(t *testing.T) {
+	router := newTestRouter(t)
+	if err := router.Disarm(""); err != nil {
+		t.Fatal(err)
+	}
+	if !router.Allow(events.Event{Camera: "porch", Type: events.TypeAvailability}) {
+		t.Error("availability event was held back")
+	}
+	if !router.Allow(events.Event{Camera: "porch", Type: "VMD", Source: events.SourceTest}) {
+		t.Error("test event was held back")
+	}
+}
@@ -0,0 +1,208 @@
+package control
+
+import (
+	"fmt"
+	"github.com/toxuin/alarmserver/buses"
+	"github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/events"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // DOCKER IMAGE IS FROM SCRATCH, IT HAS NO ZONEINFO
+)
+
+const (
+	day        = 24 * time.Hour
+	timeLayout = "15:04"
+)
+
+var dayNames = map[string][]time.Weekday{
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"sun":      {time.Sunday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+// Schedules let events go to buses only at certain times. Every schedule that matches event and bus
+// has to be open for event to go there
+type Schedules struct {
+	location  *time.Location
+	items     []schedule
+	lock      sync.Mutex
+	forwarded map[string]map[events.Key]bool // ALARMS THAT WENT ON TO EACH BUS, SO THAT THEIR ENDS DO TOO
+}
+
+type schedule struct {
+	name    string
+	cameras []string
+	events  []string
+	buses   []string
+	windows []window
+}
+
+// window is open from and to time of day on its days. If to is before from, it closes next day
+type window struct {
+	days [7]bool // BY time.Weekday
+	from time.Duration
+	to   time.Duration
+}
+
+type ScheduleState struct {
+	Name string `json:"name"`
+	Open bool   `json:"open"`
+}
+
+func NewSchedules(conf config.SchedulesConfig) (*Schedules, error) {
+	schedules := &Schedules{location: time.Local, forwarded: make(map[string]map[events.Key]bool)}
+	if conf.Timezone != "" {
+		location, err := time.LoadLocation(conf.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown schedules timezone %q: %w", conf.Timezone, err)
+		}
+		schedules.location = location
+	}
+	known := make(map[string]bool)
+	for _, key := range buses.Registered() {
+		known[key] = true
+	}
+	for i, item := range conf.Items {
+		name := item.Name
+		if name == "" {
+			name = fmt.Sprintf("schedule %d", i+1)
+		}
+		for _, bus := range item.Buses {
+			if bus != wildcard && !known[strings.ToLower(bus)] {
+				return nil, fmt.Errorf("%s: unknown bus %q, use one of %s", name, bus, strings.Join(buses.Registered(), ", "))
+			}
+		}
+		if len(item.At) == 0 {
+			return nil, fmt.Errorf("%s: no times given, it would never let anything through", name)
+		}
+		parsed := schedule{name: name, cameras: item.Cameras, events: item.Events, buses: item.Buses}
+		for _, at := range item.At {
+			window, err := parseWindow(at)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			parsed.windows = append(parsed.windows, window)
+		}
+		schedules.items = append(schedules.items, parsed)
+	}
+	if len(schedules.items) > 0 {
+		log.Info("schedules loaded", "count", len(schedules.items), "timezone", schedules.location.String())
+	}
+	return schedules, nil
+}
+
+func parseWindow(conf config.TimeWindow) (window, error) {
+	parsed := window{to: day}
+	if len(conf.Days) == 0 {
+		for weekday := range parsed.days {
+			parsed.days[weekday] = true
+		}
+	}
+	for _, name := range conf.Days {
+		weekdays, found := dayNames[strings.ToLower(name)]
+		if !found {
+			return parsed, fmt.Errorf("unknown day %q, use mon, tue, wed, thu, fri, sat, sun, weekdays or weekends", name)
+		}
+		for _, weekday := range weekdays {
+			parsed.days[weekday] = true
+		}
+	}
+	var err error
+	if conf.From != "" {
+		if parsed.from, err = parseTimeOfDay(conf.From); err != nil {
+			return parsed, err
+		}
+	}
+	if conf.To != "" && conf.To != "24:00" {
+		if parsed.to, err = parseTimeOfDay(conf.To); err != nil {
+			return parsed, err
+		}
+	}
+	if parsed.from == parsed.to {
+		return parsed, fmt.Errorf("window from %s to %s is empty", conf.From, conf.To)
+	}
+	return parsed, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse(timeLayout, value)
+	if err != nil {
+		return 0, fmt.Errorf("time of day must be like 22:00, not %q", value)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// Allow tells if event can go to bus at now. Availability and test events always can, and so can ends
+// of alarms that went to that bus, or it would keep them on after window closes
+func (schedules *Schedules) Allow(event events.Event, bus string, now time.Time) bool {
+	if len(schedules.items) == 0 || event.Type == events.TypeAvailability || event.Source == events.SourceTest {
+		return true
+	}
+	key := events.KeyOf(event)
+	schedules.lock.Lock()
+	defer schedules.lock.Unlock()
+	if event.State == events.StateInactive && schedules.forwarded[bus][key] {
+		delete(schedules.forwarded[bus], key)
+		return true
+	}
+	now = now.In(schedules.location)
+	for _, item := range schedules.items {
+		if !matchesAny(item.cameras, event.Camera) || !matchesAny(item.events, event.Type) || !matchesAny(item.buses, bus) {
+			continue
+		}
+		if !item.open(now) {
+			log.Debug("event held back by schedule", "schedule", item.name, "camera", event.Camera, "event", event.Type, "bus", bus)
+			return false
+		}
+	}
+	if event.State == events.StateActive {
+		if schedules.forwarded[bus] == nil {
+			schedules.forwarded[bus] = make(map[events.Key]bool)
+		}
+		schedules.forwarded[bus][key] = true
+	}
+	return true
+}
+
+func (schedules *Schedules) State(now time.Time) []ScheduleState {
+	now = now.In(schedules.location)
+	states := make([]ScheduleState, 0, len(schedules.items))
+	for _, item := range schedules.items {
+		states = append(states, ScheduleState{Name: item.name, Open: item.open(now)})
+	}
+	return states
+}
+
+func (item schedule) open(now time.Time) bool {
+	for _, window := range item.windows {
+		if window.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (window window) contains(now time.Time) bool {
+	// BY THE CLOCK, SO THAT DAYLIGHT SAVING DAYS DO NOT SHIFT WINDOWS
+	sinceMidnight := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute +
+		time.Duration(now.Second())*time.Second
+	if window.from < window.to {
+		return window.days[now.Weekday()] && sinceMidnight >= window.from && sinceMidnight < window.to
+	}
+	// PAST MIDNIGHT: EVENING IS ON WINDOW'S DAY, MORNING ON THE ONE AFTER IT
+	if sinceMidnight >= window.from {
+		return window.days[now.Weekday()]
+	}
+	if sinceMidnight < window.to {
+		return window.days[(now.Weekday()+6)%7]
+	}
+	return false
+}
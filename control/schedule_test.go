@@ -0,0 +1,119 @@
+package control
+
+import (
+	"github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/events"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 2024-01-01 IS MONDAY
+func at(day int, hour int, minute int, location *time.Location) time.Time {
+	return time.Date(2024, time.January, day, hour, minute, 0, 0, location)
+}
+
+func newTestSchedules(t *testing.T, timezone string, windows ...config.TimeWindow) *Schedules {
+	t.Helper()
+	schedules, err := NewSchedules(config.SchedulesConfig{
+		Timezone: timezone,
+		Items:    []config.ScheduleConfig{{Name: "test", At: windows}},
+	})
+	if err != nil {
+		t.Fatalf("NewSchedules: %v", err)
+	}
+	return schedules
+}
+
+func TestSchedulesWindows(t *testing.T) {
+	tests := []struct {
+		name     string
+		timezone string
+		window   config.TimeWindow
+		now      time.Time
+		open     bool
+	}{
+		{"inside window", "UTC", config.TimeWindow{From: "09:00", To: "17:00"}, at(1, 12, 0, time.UTC), true},
+		{"at start", "UTC", config.TimeWindow{From: "09:00", To: "17:00"}, at(1, 9, 0, time.UTC), true},
+		{"at end", "UTC", config.TimeWindow{From: "09:00", To: "17:00"}, at(1, 17, 0, time.UTC), false},
+		{"before start", "UTC", config.TimeWindow{From: "09:00", To: "17:00"}, at(1, 8, 59, time.UTC), false},
+		{"whole day", "UTC", config.TimeWindow{}, at(1, 0, 0, time.UTC), true},
+		{"until end of day", "UTC", config.TimeWindow{From: "22:00", To: "24:00"}, at(1, 23, 59, time.UTC), true},
+		{"other day", "UTC", config.TimeWindow{Days: []string{"tue"}}, at(1, 12, 0, time.UTC), false},
+		{"weekdays", "UTC", config.TimeWindow{Days: []string{"weekdays"}}, at(5, 12, 0, time.UTC), true},
+		{"weekends", "UTC", config.TimeWindow{Days: []string{"Weekends"}}, at(5, 12, 0, time.UTC), false},
+		{"past midnight, evening", "UTC", config.TimeWindow{From: "22:00", To: "06:00"}, at(1, 23, 0, time.UTC), true},
+		{"past midnight, morning", "UTC", config.TimeWindow{From: "22:00", To: "06:00"}, at(2, 5, 59, time.UTC), true},
+		{"past midnight, day", "UTC", config.TimeWindow{From: "22:00", To: "06:00"}, at(2, 6, 0, time.UTC), false},
+		{"past midnight, morning after window day", "UTC",
+			config.TimeWindow{Days: []string{"mon"}, From: "22:00", To: "06:00"}, at(2, 3, 0, time.UTC), true},
+		{"past midnight, morning of window day", "UTC",
+			config.TimeWindow{Days: []string{"mon"}, From: "22:00", To: "06:00"}, at(1, 3, 0, time.UTC), false},
+		{"past midnight, sunday into monday", "UTC",
+			config.TimeWindow{Days: []string{"sun"}, From: "22:00", To: "06:00"}, at(8, 3, 0, time.UTC), true},
+		{"past midnight, saturday into sunday", "UTC",
+			config.TimeWindow{Days: []string{"sun"}, From: "22:00", To: "06:00"}, at(7, 3, 0, time.UTC), false},
+		{"timezone, open there", "America/New_York",
+			config.TimeWindow{From: "09:00", To: "17:00"}, at(1, 20, 0, time.UTC), true},
+		{"timezone, closed there", "America/New_York",
+			config.TimeWindow{From: "09:00", To: "17:00"}, at(1, 23, 0, time.UTC), false},
+		{"timezone, next day there", "Europe/Berlin",
+			config.TimeWindow{Days: []string{"mon"}, From: "00:00", To: "01:00"}, at(7, 23, 30, time.UTC), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedules := newTestSchedules(t, test.timezone, test.window)
+			if open := schedules.State(test.now)[0].Open; open != test.open {
+				t.Errorf("open at %s is %v, want %v", test.now, open, test.open)
+			}
+			if allowed := schedules.Allow(alarm("porch", events.StateActive), "mqtt", test.now); allowed != test.open {
+				t.Errorf("allowed at %s is %v, want %v", test.now, allowed, test.open)
+			}
+		})
+	}
+}
+
+func TestNewSchedulesBadInput(t *testing.T) {
+	tests := []struct {
+		name     string
+		timezone string
+		item     config.ScheduleConfig
+		error    string
+	}{
+		{"unknown timezone", "Mars/Olympus", config.ScheduleConfig{At: []config.TimeWindow{{}}}, "unknown schedules timezone"},
+		{"no times", "", config.ScheduleConfig{}, "no times given"},
+		{"bad from", "", config.ScheduleConfig{At: []config.TimeWindow{{From: "10pm"}}}, "time of day must be like"},
+		{"bad to", "", config.ScheduleConfig{At: []config.TimeWindow{{To: "25:00"}}}, "time of day must be like"},
+		{"unknown day", "", config.ScheduleConfig{At: []config.TimeWindow{{Days: []string{"monday"}}}}, "unknown day"},
+		{"empty window", "", config.ScheduleConfig{At: []config.TimeWindow{{From: "10:00", To: "10:00"}}}, "is empty"},
+		{"unknown bus", "", config.ScheduleConfig{Buses: []string{"pigeon"}, At: []config.TimeWindow{{}}}, "unknown bus"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewSchedules(config.SchedulesConfig{Timezone: test.timezone, Items: []config.ScheduleConfig{test.item}})
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("error is %v, want one with %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestSchedulesForwardEndOfDeliveredAlarm(t *testing.T) {
+	schedules := newTestSchedules(t, "UTC", config.TimeWindow{From: "22:00", To: "06:00"})
+	if !schedules.Allow(alarm("porch", events.StateActive), "mqtt", at(1, 5, 59, time.UTC)) {
+		t.Fatal("start was held back while window is open")
+	}
+	closed := at(1, 6, 1, time.UTC)
+	if schedules.Allow(alarm("porch", events.StateActive), "mqtt", closed) {
+		t.Error("start went through after window closed")
+	}
+	if schedules.Allow(alarm("porch", events.StateInactive), "webhooks", closed) {
+		t.Error("end went to bus that did not get the start")
+	}
+	if !schedules.Allow(alarm("porch", events.StateInactive), "mqtt", closed) {
+		t.Error("end was held back from bus that got the start")
+	}
+	if schedules.Allow(alarm("porch", events.StateInactive), "mqtt", closed) {
+		t.Error("second end went through, it was delivered already")
+	}
+}
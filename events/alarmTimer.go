@@ -0,0 +1,97 @@
+package events
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+type pendingAlarm struct {
+	event   Event
+	started time.Time
+	timer   *time.Timer
+}
+
+// AlarmTimer emits synthetic end events for sources that never tell when alarm is over.
+// Alarm is considered ended when no new events with same Key came for Timeout
+type AlarmTimer struct {
+	Timeout time.Duration
+	Handler Handler
+	lock    sync.Mutex
+	pending map[Key]*pendingAlarm
+}
+
+// Touch (re)starts the end timer for event's alarm. Inactive events end the alarm right away,
+// in which case their Duration is filled in and no synthetic end event will be sent
+func (alarmTimer *AlarmTimer) Touch(event *Event) {
+	alarmTimer.lock.Lock()
+	defer alarmTimer.lock.Unlock()
+	if alarmTimer.pending == nil {
+		alarmTimer.pending = make(map[Key]*pendingAlarm)
+	}
+
+	key := KeyOf(*event)
+	alarm, exists := alarmTimer.pending[key]
+
+	if event.State == StateInactive {
+		if exists {
+			alarm.timer.Stop()
+			delete(alarmTimer.pending, key)
+			event.Duration = event.Time.Sub(alarm.started).Seconds()
+		}
+		return
+	}
+
+	if exists {
+		alarm.event = *event
+		alarm.timer.Reset(alarmTimer.Timeout)
+		return
+	}
+
+	alarm = &pendingAlarm{event: *event, started: event.Time}
+	alarm.timer = time.AfterFunc(alarmTimer.Timeout, func() {
+		alarmTimer.expire(key, alarm)
+	})
+	alarmTimer.pending[key] = alarm
+}
+
+func (alarmTimer *AlarmTimer) expire(key Key, alarm *pendingAlarm) {
+	alarmTimer.lock.Lock()
+	if alarmTimer.pending[key] != alarm {
+		// ALARM WAS ENDED OR RESTARTED IN THE MEANTIME
+		alarmTimer.lock.Unlock()
+		return
+	}
+	delete(alarmTimer.pending, key)
+	alarmTimer.lock.Unlock()
+
+	alarmTimer.Handler(alarm.endEvent(time.Now()))
+}
+
+// Flush sends end events for all alarms that are still active, used on shutdown
+func (alarmTimer *AlarmTimer) Flush() {
+	alarmTimer.lock.Lock()
+	pending := alarmTimer.pending
+	alarmTimer.pending = nil
+	alarmTimer.lock.Unlock()
+
+	now := time.Now()
+	for _, alarm := range pending {
+		if alarm.timer.Stop() {
+			alarmTimer.Handler(alarm.endEvent(now))
+		}
+	}
+}
+
+func (alarm *pendingAlarm) endEvent(now time.Time) Event {
+	event := alarm.event
+	// START EVENT IS STILL OUT THERE, BEING ENCODED AND STORED. IT MUST NOT SEE END'S METADATA
+	event.Metadata = maps.Clone(alarm.event.Metadata)
+	event.State = StateInactive
+	event.Message = string(StateInactive)
+	event.Time = now
+	event.Duration = now.Sub(alarm.started).Seconds()
+	event.Attachments = nil
+	event.SetMeta("synthetic", "true")
+	return event
+}
@@ -0,0 +1,119 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestTimer(timeout time.Duration) (*AlarmTimer, chan Event) {
+	ended := make(chan Event, 10)
+	return &AlarmTimer{Timeout: timeout, Handler: func(event Event) { ended <- event }}, ended
+}
+
+func expectNoEnd(t *testing.T, ended chan Event, wait time.Duration) {
+	t.Helper()
+	select {
+	case event := <-ended:
+		t.Fatalf("unexpected end event %+v", event)
+	case <-time.After(wait):
+	}
+}
+
+func expectEnd(t *testing.T, ended chan Event, wait time.Duration) Event {
+	t.Helper()
+	select {
+	case event := <-ended:
+		return event
+	case <-time.After(wait):
+		t.Fatal("no end event")
+	}
+	return Event{}
+}
+
+func TestAlarmTimerEndsQuietAlarm(t *testing.T) {
+	alarmTimer, ended := newTestTimer(20 * time.Millisecond)
+	start := Event{Camera: "porch", Type: "VMD", State: StateActive, Time: time.Now(), Message: "motion",
+		Attachments: []Attachment{{Name: "snapshot.jpg"}}}
+	alarmTimer.Touch(&start)
+
+	end := expectEnd(t, ended, time.Second)
+	if end.State != StateInactive || end.Camera != "porch" || end.Type != "VMD" {
+		t.Errorf("end event is %+v", end)
+	}
+	if end.Metadata["synthetic"] != "true" {
+		t.Error("end event is not marked synthetic")
+	}
+	if end.Attachments != nil {
+		t.Error("end event carries attachments of start")
+	}
+	if end.Duration < 0.02 {
+		t.Errorf("duration is %f, want at least timeout", end.Duration)
+	}
+	expectNoEnd(t, ended, 50*time.Millisecond)
+}
+
+func TestAlarmTimerTouchPostponesEnd(t *testing.T) {
+	alarmTimer, ended := newTestTimer(60 * time.Millisecond)
+	event := Event{Camera: "porch", Type: "VMD", State: StateActive, Time: time.Now()}
+	alarmTimer.Touch(&event)
+	time.Sleep(40 * time.Millisecond)
+	again := event
+	again.Time = time.Now()
+	alarmTimer.Touch(&again)
+	expectNoEnd(t, ended, 40*time.Millisecond)
+	expectEnd(t, ended, time.Second)
+}
+
+func TestAlarmTimerKeepsAlarmsApart(t *testing.T) {
+	alarmTimer, ended := newTestTimer(20 * time.Millisecond)
+	for _, eventType := range []string{"VMD", "linedetection"} {
+		event := Event{Camera: "porch", Type: eventType, State: StateActive, Time: time.Now()}
+		alarmTimer.Touch(&event)
+	}
+	types := map[string]bool{}
+	types[expectEnd(t, ended, time.Second).Type] = true
+	types[expectEnd(t, ended, time.Second).Type] = true
+	if !types["VMD"] || !types["linedetection"] {
+		t.Errorf("ended %v, want both alarms", types)
+	}
+}
+
+func TestAlarmTimerInactiveEndsRightAway(t *testing.T) {
+	alarmTimer, ended := newTestTimer(20 * time.Millisecond)
+	started := time.Now()
+	start := Event{Camera: "porch", Type: "VMD", State: StateActive, Time: started}
+	alarmTimer.Touch(&start)
+	stop := Event{Camera: "porch", Type: "VMD", State: StateInactive, Time: started.Add(5 * time.Second)}
+	alarmTimer.Touch(&stop)
+	if stop.Duration != 5 {
+		t.Errorf("duration is %f, want 5", stop.Duration)
+	}
+	expectNoEnd(t, ended, 50*time.Millisecond)
+}
+
+func TestAlarmTimerFlush(t *testing.T) {
+	alarmTimer, ended := newTestTimer(time.Hour)
+	event := Event{Camera: "porch", Type: "VMD", State: StateActive, Time: time.Now()}
+	alarmTimer.Touch(&event)
+	alarmTimer.Flush()
+	if end := expectEnd(t, ended, time.Second); end.State != StateInactive {
+		t.Errorf("flushed event is %+v", end)
+	}
+	alarmTimer.Flush()
+	expectNoEnd(t, ended, 10*time.Millisecond)
+}
+
+func TestAlarmTimerLeavesStartMetadataAlone(t *testing.T) {
+	alarmTimer, ended := newTestTimer(10 * time.Millisecond)
+	start := Event{Camera: "porch", Type: "VMD", State: StateActive, Time: time.Now()}
+	start.SetMeta("region", "1")
+	alarmTimer.Touch(&start)
+
+	end := expectEnd(t, ended, time.Second)
+	if end.Metadata["synthetic"] != "true" || end.Metadata["region"] != "1" {
+		t.Errorf("end metadata is %v, want region and synthetic", end.Metadata)
+	}
+	if _, found := start.Metadata["synthetic"]; found || len(start.Metadata) != 1 {
+		t.Errorf("start metadata changed to %v", start.Metadata)
+	}
+}
@@ -0,0 +1,19 @@
+package events
+
+import (
+	"time"
+)
+
+// Delivery is the outcome of one attempt to deliver an event to one target of a bus
+type Delivery struct {
+	Bus     string    `json:"bus"`
+	Target  string    `json:"target,omitempty"` // WEBHOOK URL OR MQTT TOPIC
+	Success bool      `json:"success"`
+	Status  int       `json:"status,omitempty"` // HTTP STATUS CODE OF WEBHOOKS
+	Error   string    `json:"error,omitempty"`
+	Attempt int       `json:"attempt,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// DeliveryReporter is told about deliveries of events that have ID
+type DeliveryReporter func(eventID string, delivery Delivery)
@@ -0,0 +1,59 @@
+package events
+
+import (
+	"time"
+)
+
+type State string
+
+const (
+	StateActive   State = "active"
+	StateInactive State = "inactive"
+)
+
+// SOURCE PROTOCOLS
+const (
+	SourceHikvision = "hikvision"
+	SourceDahua     = "dahua"
+	SourceHisilicon = "hisilicon"
+	SourceFtp       = "ftp"
+	SourceTest      = "test" // TEST EVENTS, REQUESTED OVER COMMAND TOPIC
+)
+
+// TypeAvailability events are sent by streaming sources when camera connection changes.
+// Their Message is connection state: connecting, online, offline or auth-failed
+const TypeAvailability = "availability"
+
+type Attachment struct {
+	Name        string `json:"name"`
+	Path        string `json:"path,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// Event is a normalized alarm, emitted by all servers and consumed by all buses
+type Event struct {
+	ID          string            `json:"id,omitempty"` // SET BY EVENT STORE, EMPTY IF IT IS NOT ENABLED
+	Source      string            `json:"source"`
+	Camera      string            `json:"camera"`
+	Channel     string            `json:"channel,omitempty"`
+	Type        string            `json:"type"`
+	State       State             `json:"state"`
+	Time        time.Time         `json:"time"`
+	Duration    float64           `json:"duration,omitempty"` // SECONDS ALARM WAS ACTIVE, ONLY ON END EVENTS
+	Message     string            `json:"message"`
+	Raw         string            `json:"raw,omitempty"`
+	Attachments []Attachment      `json:"attachments,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+type Handler func(event Event)
+
+func (event *Event) SetMeta(key string, value string) {
+	if value == "" {
+		return
+	}
+	if event.Metadata == nil {
+		event.Metadata = make(map[string]string)
+	}
+	event.Metadata[key] = value
+}
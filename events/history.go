@@ -0,0 +1,74 @@
+package events
+
+import (
+	"sort"
+	"sync"
+)
+
+// History keeps last Size events of every camera in memory
+type History struct {
+	Size     int
+	lock     sync.RWMutex
+	byCamera map[string][]Event
+}
+
+func (history *History) Add(event Event) {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	if history.byCamera == nil {
+		history.byCamera = make(map[string][]Event)
+	}
+	size := history.Size
+	if size <= 0 {
+		size = 50 // DEFAULT HISTORY SIZE
+	}
+	cameraEvents := append(history.byCamera[event.Camera], event)
+	if len(cameraEvents) > size {
+		cameraEvents = cameraEvents[len(cameraEvents)-size:]
+	}
+	history.byCamera[event.Camera] = cameraEvents
+}
+
+// Get returns up to limit latest events of camera, newest first. Zero limit means all of them
+func (history *History) Get(camera string, limit int) []Event {
+	history.lock.RLock()
+	defer history.lock.RUnlock()
+	cameraEvents := history.byCamera[camera]
+	if limit <= 0 || limit > len(cameraEvents) {
+		limit = len(cameraEvents)
+	}
+	result := make([]Event, 0, limit)
+	for i := len(cameraEvents) - 1; i >= len(cameraEvents)-limit; i-- {
+		result = append(result, cameraEvents[i])
+	}
+	return result
+}
+
+// Recent returns up to limit latest events of all cameras, newest first. Zero limit means all of them
+func (history *History) Recent(limit int) []Event {
+	history.lock.RLock()
+	var result []Event
+	for _, cameraEvents := range history.byCamera {
+		result = append(result, cameraEvents...)
+	}
+	history.lock.RUnlock()
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time.After(result[j].Time)
+	})
+	if limit > 0 && limit < len(result) {
+		result = result[:limit]
+	}
+	return result
+}
+
+// Cameras returns names of all cameras that sent events, sorted
+func (history *History) Cameras() []string {
+	history.lock.RLock()
+	defer history.lock.RUnlock()
+	cameras := make([]string, 0, len(history.byCamera))
+	for camera := range history.byCamera {
+		cameras = append(cameras, camera)
+	}
+	sort.Strings(cameras)
+	return cameras
+}
@@ -0,0 +1,64 @@
+package events
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func messages(events []Event) []string {
+	result := make([]string, 0, len(events))
+	for _, event := range events {
+		result = append(result, event.Message)
+	}
+	return result
+}
+
+func TestHistoryKeepsLatestPerCamera(t *testing.T) {
+	history := History{Size: 2}
+	for _, message := range []string{"1", "2", "3"} {
+		history.Add(Event{Camera: "porch", Message: message})
+	}
+	history.Add(Event{Camera: "garage", Message: "g"})
+
+	if got := messages(history.Get("porch", 0)); !reflect.DeepEqual(got, []string{"3", "2"}) {
+		t.Errorf("porch history is %v, want [3 2]", got)
+	}
+	if got := messages(history.Get("porch", 1)); !reflect.DeepEqual(got, []string{"3"}) {
+		t.Errorf("porch history limited to 1 is %v, want [3]", got)
+	}
+	if got := messages(history.Get("garage", 10)); !reflect.DeepEqual(got, []string{"g"}) {
+		t.Errorf("garage history is %v, want [g]", got)
+	}
+	if got := history.Get("attic", 0); len(got) != 0 {
+		t.Errorf("history of unknown camera is %v, want none", got)
+	}
+}
+
+func TestHistoryDefaultSize(t *testing.T) {
+	history := History{}
+	for i := 0; i < 60; i++ {
+		history.Add(Event{Camera: "porch"})
+	}
+	if got := len(history.Get("porch", 0)); got != 50 {
+		t.Errorf("history keeps %d events, want 50", got)
+	}
+}
+
+func TestHistoryRecentIsNewestFirst(t *testing.T) {
+	history := History{}
+	now := time.Now()
+	history.Add(Event{Camera: "porch", Message: "old", Time: now.Add(-2 * time.Minute)})
+	history.Add(Event{Camera: "garage", Message: "new", Time: now})
+	history.Add(Event{Camera: "porch", Message: "middle", Time: now.Add(-time.Minute)})
+
+	if got := messages(history.Recent(0)); !reflect.DeepEqual(got, []string{"new", "middle", "old"}) {
+		t.Errorf("recent events are %v, want [new middle old]", got)
+	}
+	if got := messages(history.Recent(2)); !reflect.DeepEqual(got, []string{"new", "middle"}) {
+		t.Errorf("recent events limited to 2 are %v, want [new middle]", got)
+	}
+	if got := history.Cameras(); !reflect.DeepEqual(got, []string{"garage", "porch"}) {
+		t.Errorf("cameras are %v, want [garage porch]", got)
+	}
+}
@@ -0,0 +1,76 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Key identifies a single alarm, so that concurrent alarms of one camera are tracked separately
+type Key struct {
+	Camera  string
+	Channel string
+	Type    string
+	Region  string
+}
+
+func KeyOf(event Event) Key {
+	return Key{
+		Camera:  event.Camera,
+		Channel: event.Channel,
+		Type:    event.Type,
+		Region:  event.Metadata["region"],
+	}
+}
+
+type alarmState struct {
+	since    time.Time
+	lastSeen time.Time
+}
+
+// StateTracker remembers which alarms are active, so that only changes of alarm state are reported
+type StateTracker struct {
+	lock   sync.Mutex
+	active map[Key]*alarmState
+}
+
+// Start marks alarm as active. Returns true if it was not active before
+func (tracker *StateTracker) Start(key Key) bool {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if tracker.active == nil {
+		tracker.active = make(map[Key]*alarmState)
+	}
+	now := time.Now()
+	if state, exists := tracker.active[key]; exists {
+		state.lastSeen = now
+		return false
+	}
+	tracker.active[key] = &alarmState{since: now, lastSeen: now}
+	return true
+}
+
+// Stop marks alarm as inactive. Returns how long it was active, or false if it was not active
+func (tracker *StateTracker) Stop(key Key) (time.Duration, bool) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	state, exists := tracker.active[key]
+	if !exists {
+		return 0, false
+	}
+	delete(tracker.active, key)
+	return time.Since(state.since), true
+}
+
+// StopStale stops all alarms of a camera that were not seen since given time, returning their durations
+func (tracker *StateTracker) StopStale(camera string, notSeenSince time.Time) map[Key]time.Duration {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	stopped := make(map[Key]time.Duration)
+	for key, state := range tracker.active {
+		if key.Camera == camera && state.lastSeen.Before(notSeenSince) {
+			stopped[key] = time.Since(state.since)
+			delete(tracker.active, key)
+		}
+	}
+	return stopped
+}
@@ -0,0 +1,88 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStateTrackerReportsOnlyChanges(t *testing.T) {
+	tracker := StateTracker{}
+	key := Key{Camera: "porch", Channel: "1", Type: "VMD"}
+	if !tracker.Start(key) {
+		t.Error("first start is not reported")
+	}
+	if tracker.Start(key) {
+		t.Error("repeated start is reported")
+	}
+	if _, wasActive := tracker.Stop(key); !wasActive {
+		t.Error("stop of active alarm is not reported")
+	}
+	if _, wasActive := tracker.Stop(key); wasActive {
+		t.Error("second stop is reported")
+	}
+	if !tracker.Start(key) {
+		t.Error("start after stop is not reported")
+	}
+}
+
+func TestStateTrackerKeepsAlarmsApart(t *testing.T) {
+	tracker := StateTracker{}
+	keys := []Key{
+		{Camera: "porch", Channel: "1", Type: "VMD"},
+		{Camera: "porch", Channel: "2", Type: "VMD"},
+		{Camera: "porch", Channel: "1", Type: "linedetection"},
+		{Camera: "porch", Channel: "1", Type: "VMD", Region: "2"},
+		{Camera: "garage", Channel: "1", Type: "VMD"},
+	}
+	for _, key := range keys {
+		if !tracker.Start(key) {
+			t.Errorf("start of %+v is taken for a repeat", key)
+		}
+	}
+}
+
+func TestStateTrackerStopReturnsDuration(t *testing.T) {
+	tracker := StateTracker{}
+	key := Key{Camera: "porch", Type: "VMD"}
+	tracker.Start(key)
+	time.Sleep(10 * time.Millisecond)
+	duration, _ := tracker.Stop(key)
+	if duration < 10*time.Millisecond {
+		t.Errorf("duration is %s, want at least 10ms", duration)
+	}
+}
+
+func TestStateTrackerStopStale(t *testing.T) {
+	tracker := StateTracker{}
+	stale := Key{Camera: "porch", Type: "VMD"}
+	fresh := Key{Camera: "porch", Type: "linedetection"}
+	other := Key{Camera: "garage", Type: "VMD"}
+	tracker.Start(stale)
+	tracker.Start(other)
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	tracker.Start(fresh)
+
+	stopped := tracker.StopStale("porch", cutoff)
+	if _, found := stopped[stale]; !found || len(stopped) != 1 {
+		t.Errorf("stopped %v, want only %+v", stopped, stale)
+	}
+	if !tracker.Start(stale) {
+		t.Error("stale alarm is still active")
+	}
+	if tracker.Start(fresh) {
+		t.Error("alarm seen after cutoff was stopped")
+	}
+	if tracker.Start(other) {
+		t.Error("alarm of other camera was stopped")
+	}
+}
+
+func TestKeyOfTakesRegionFromMetadata(t *testing.T) {
+	event := Event{Camera: "porch", Channel: "1", Type: "VMD"}
+	event.SetMeta("region", "3")
+	want := Key{Camera: "porch", Channel: "1", Type: "VMD", Region: "3"}
+	if key := KeyOf(event); key != want {
+		t.Errorf("key is %+v, want %+v", key, want)
+	}
+}
@@ -0,0 +1,16 @@
+package events
+
+// TemplateVars are what webhook and MQTT templates can use, like {{ .Camera }}
+func (event Event) TemplateVars() map[string]interface{} {
+	return map[string]interface{}{
+		"ID":      event.ID,
+		"Camera":  event.Camera,
+		"Event":   event.Type,
+		"Extra":   event.Message,
+		"Source":  event.Source,
+		"Channel": event.Channel,
+		"State":   event.State,
+		"Time":    event.Time,
+		"Meta":    event.Metadata,
+	}
+}
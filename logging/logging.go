@@ -0,0 +1,150 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Options configure the whole logging subsystem, see "log" section of config
+type Options struct {
+	Level  string            `json:"level"`  // debug, info, warn OR error
+	Format string            `json:"format"` // text OR json
+	Levels map[string]string `json:"levels"` // PER-COMPONENT LEVEL OVERRIDES, LIKE hikvision: debug
+	Output io.Writer         `json:"-"`
+}
+
+// ATTRIBUTES WITH THESE NAMES NEVER MAKE IT TO THE LOGS
+var secretKeys = map[string]bool{
+	"password": true,
+	"passwd":   true,
+	"token":    true,
+	"secret":   true,
+}
+
+const redacted = "[REDACTED]"
+
+var (
+	lock   sync.RWMutex
+	root   slog.Handler = newRootHandler(os.Stdout, "text")
+	level               = slog.LevelInfo
+	levels              = map[string]slog.Level{}
+)
+
+// Setup replaces output, format and levels of all loggers, including ones that were created before
+func Setup(options Options) error {
+	defaultLevel, err := ParseLevel(options.Level)
+	if err != nil {
+		return err
+	}
+	componentLevels := make(map[string]slog.Level, len(options.Levels))
+	for component, levelName := range options.Levels {
+		componentLevel, err := ParseLevel(levelName)
+		if err != nil {
+			return fmt.Errorf("component %s: %w", component, err)
+		}
+		componentLevels[strings.ToLower(component)] = componentLevel
+	}
+	format := strings.ToLower(options.Format)
+	if format != "" && format != "text" && format != "json" {
+		return fmt.Errorf("unknown log format %q, use text or json", options.Format)
+	}
+	output := options.Output
+	if output == nil {
+		output = os.Stdout
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	root = newRootHandler(output, format)
+	level = defaultLevel
+	levels = componentLevels
+	return nil
+}
+
+// ParseLevel turns level name from config into slog level. Empty name means info
+func ParseLevel(name string) (slog.Level, error) {
+	var parsed slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := parsed.UnmarshalText([]byte(name)); err != nil {
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q, use debug, info, warn or error", name)
+	}
+	return parsed, nil
+}
+
+// For returns logger of a component. Every record it writes has "component" attribute
+// and is filtered by level of that component
+func For(component string) *slog.Logger {
+	return slog.New(&componentHandler{component: strings.ToLower(component)})
+}
+
+func newRootHandler(output io.Writer, format string) slog.Handler {
+	options := &slog.HandlerOptions{
+		Level:       slog.LevelDebug, // FILTERING IS DONE BY componentHandler
+		ReplaceAttr: redact,
+	}
+	if format == "json" {
+		return slog.NewJSONHandler(output, options)
+	}
+	return slog.NewTextHandler(output, options)
+}
+
+func redact(groups []string, attr slog.Attr) slog.Attr {
+	if secretKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redacted)
+	}
+	return attr
+}
+
+func levelOf(component string) slog.Level {
+	lock.RLock()
+	defer lock.RUnlock()
+	if componentLevel, exists := levels[component]; exists {
+		return componentLevel
+	}
+	return level
+}
+
+// componentHandler looks up root handler on every record, so that loggers made at init time follow Setup
+type componentHandler struct {
+	component string
+	wrappers  []func(slog.Handler) slog.Handler // WithAttrs AND WithGroup CALLS, IN ORDER
+}
+
+func (handler *componentHandler) Enabled(_ context.Context, recordLevel slog.Level) bool {
+	return recordLevel >= levelOf(handler.component)
+}
+
+func (handler *componentHandler) Handle(ctx context.Context, record slog.Record) error {
+	lock.RLock()
+	target := root.WithAttrs([]slog.Attr{slog.String("component", handler.component)})
+	lock.RUnlock()
+	for _, wrap := range handler.wrappers {
+		target = wrap(target)
+	}
+	return target.Handle(ctx, record)
+}
+
+func (handler *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return handler.with(func(target slog.Handler) slog.Handler {
+		return target.WithAttrs(attrs)
+	})
+}
+
+func (handler *componentHandler) WithGroup(name string) slog.Handler {
+	return handler.with(func(target slog.Handler) slog.Handler {
+		return target.WithGroup(name)
+	})
+}
+
+func (handler *componentHandler) with(wrap func(slog.Handler) slog.Handler) *componentHandler {
+	wrappers := make([]func(slog.Handler) slog.Handler, len(handler.wrappers), len(handler.wrappers)+1)
+	copy(wrappers, handler.wrappers)
+	return &componentHandler{component: handler.component, wrappers: append(wrappers, wrap)}
+}
@@ -1,124 +1,277 @@
 package main
 
 import (
-	"fmt"
-	"github.com/toxuin/alarmserver/buses/mqtt"
-	"github.com/toxuin/alarmserver/buses/webhooks"
+	"context"
+	"errors"
+	"github.com/toxuin/alarmserver/buses"
+	_ "github.com/toxuin/alarmserver/buses/mqtt"
+	_ "github.com/toxuin/alarmserver/buses/stream"
+	_ "github.com/toxuin/alarmserver/buses/webhooks"
 	conf "github.com/toxuin/alarmserver/config"
+	"github.com/toxuin/alarmserver/control"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/logging"
+	"github.com/toxuin/alarmserver/metrics"
+	"github.com/toxuin/alarmserver/servers"
 	"github.com/toxuin/alarmserver/servers/dahua"
 	"github.com/toxuin/alarmserver/servers/ftp"
 	"github.com/toxuin/alarmserver/servers/hikvision"
 	"github.com/toxuin/alarmserver/servers/hisilicon"
+	"github.com/toxuin/alarmserver/store"
+	"github.com/toxuin/alarmserver/web"
+	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"path/filepath"
 	"syscall"
+	"time"
 )
 
 var config *conf.Config
 
+var log = logging.For("main")
+
 func init() {
 	config.SetDefaults()
 }
 
 func main() {
 	config = config.Load()
-	fmt.Println("STARTING...")
-	if config.Debug {
-		config.Printout()
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		healthcheck()
+		return
+	}
+	if err := logging.Setup(config.Log); err != nil {
+		panic(err)
 	}
+	log.Info("starting...")
+	config.Printout()
 
-	processesWaitGroup := sync.WaitGroup{}
+	// INIT BUSES. THEY OUTLIVE SERVERS ON SHUTDOWN TO DELIVER IN-FLIGHT EVENTS
+	busContext, cancelBuses := context.WithCancel(context.Background())
+	defer cancelBuses()
+	busManager, err := buses.NewManager(busContext, config)
+	if err != nil {
+		panic(err)
+	}
+	if busManager.Count() == 0 {
+		panic("No buses are enabled. Nothing to do!")
+	}
 
-	// INIT BUSES
-	mqttBus := mqtt.Bus{Debug: config.Debug}
-	if config.Mqtt.Enabled {
-		mqttBus.Initialize(config.Mqtt)
-		if config.Debug {
-			fmt.Println("MQTT BUS INITIALIZED")
+	// EVENT STORE RECORDS EVERY EVENT AND WHAT BUSES DID WITH IT
+	var eventStore *store.Store
+	if config.Store.Enabled {
+		eventStore, err = store.Open(store.Options{
+			Path:      config.Store.Path,
+			MaxAge:    config.Store.MaxAge,
+			MaxEvents: config.Store.MaxEvents,
+		})
+		if err != nil {
+			panic(err)
 		}
+		defer eventStore.Close()
+		busManager.SetDeliveryReporter(eventStore.ReportDelivery)
 	}
 
-	webhookBus := webhooks.Bus{Debug: config.Debug}
-	if config.Webhooks.Enabled {
-		webhookBus.Initialize(config.Webhooks)
-		if config.Debug {
-			fmt.Println("WEBHOOK BUS INITIALIZED")
-		}
+	// RECENT EVENTS FOR ADMIN API AND DASHBOARD
+	var history *events.History
+	if config.Api.Enabled || config.Dashboard.Enabled {
+		history = &events.History{Size: config.Api.RecentEvents}
 	}
 
-	messageHandler := func(cameraName string, eventType string, extra string) {
-		if config.Mqtt.Enabled {
-			mqttBus.SendMessage(config.Mqtt.TopicRoot+"/"+cameraName+"/"+eventType, extra)
+	// EVENTS HELD BACK BY ARMING MODE, MUTE OR SCHEDULE ARE RECORDED, BUT NOT SENT TO BUSES
+	router, err := control.NewRouter(config.Arming)
+	if err != nil {
+		panic(err)
+	}
+	schedules, err := control.NewSchedules(config.Schedules)
+	if err != nil {
+		panic(err)
+	}
+
+	messageHandler := func(event events.Event) {
+		metrics.Event(event.Source, event.Camera, event.Type, string(event.State))
+		if eventStore != nil {
+			if err := eventStore.Add(&event); err != nil {
+				log.Error("error storing event", "camera", event.Camera, "event", event.Type, "error", err)
+			}
+		}
+		if history != nil {
+			history.Add(event)
 		}
-		if config.Webhooks.Enabled {
-			webhookBus.SendMessage(cameraName, eventType, extra)
+		if !router.Allow(event) {
+			log.Debug("event held back", "camera", event.Camera, "event", event.Type)
+			return
 		}
+		now := time.Now()
+		busManager.SendTo(event, func(bus string) bool {
+			return schedules.Allow(event, bus, now)
+		})
 	}
 
-	if config.Hisilicon.Enabled {
-		// START HISILICON ALARM SERVER
-		hisiliconServer := hisilicon.Server{
-			Debug:          config.Debug,
-			WaitGroup:      &processesWaitGroup,
-			Port:           config.Hisilicon.Port,
-			MessageHandler: messageHandler,
-		}
-		hisiliconServer.Start()
-		if config.Debug {
-			fmt.Println("STARTED HISILICON SERVER")
+	supervisor := servers.Supervisor{}
+
+	for _, name := range alarmServers {
+		if source := alarmServer(name, config, messageHandler); source != nil {
+			supervisor.Add(name, source)
 		}
 	}
 
-	if config.Hikvision.Enabled {
-		// START HIKVISION ALARM SERVER
-		hikvisionServer := hikvision.Server{
-			Debug:          config.Debug,
-			WaitGroup:      &processesWaitGroup,
-			Cameras:        &config.Hikvision.Cams,
-			MessageHandler: messageHandler,
+	if config.Http.Enabled {
+		// HTTP SERVER FOR METRICS AND HEALTH CHECKS
+		health := &web.Health{Servers: &supervisor, Buses: busManager}
+		httpServer := &web.Server{Port: config.Http.Port}
+		httpServer.Handle("/metrics", metrics.Handler())
+		httpServer.Handle("/healthz", health.LiveHandler())
+		httpServer.Handle("/readyz", health.ReadyHandler())
+		if config.Api.Enabled {
+			if config.Api.Token == "" {
+				log.Warn("admin API is enabled but has no token, not serving it. Set api.token")
+			} else {
+				httpServer.Handle("/api/", &web.API{
+					Token:    config.Api.Token,
+					ReadOnly: config.Api.ReadOnly,
+					Servers:  &supervisor,
+					Buses:    busManager,
+					History:  history,
+					Store:    eventStore,
+					Arming:   router,
+				})
+			}
+		}
+		streamBus, _ := busManager.Get("stream").(http.Handler)
+		if streamBus != nil {
+			httpServer.Handle("/events", streamBus)
+		}
+		if config.Dashboard.Enabled {
+			if config.Dashboard.Password == "" {
+				log.Warn("dashboard has no password, anyone who can reach HTTP port can see it")
+			}
+			dashboard := &web.Dashboard{
+				Username:    config.Dashboard.Username,
+				Password:    config.Dashboard.Password,
+				Servers:     &supervisor,
+				Buses:       busManager,
+				History:     history,
+				Stream:      streamBus,
+				StreamToken: config.Stream.Token,
+			}
+			if config.Ftp.Enabled && config.Ftp.AllowFiles {
+				dashboard.SnapshotRoot, _ = filepath.Abs(config.Ftp.RootPath)
+			}
+			httpServer.Handle("/dashboard/", dashboard.Handler())
+			httpServer.Handle("/", dashboard.RedirectHandler())
 		}
-		hikvisionServer.Start()
-		if config.Debug {
-			fmt.Println("STARTED HIKVISION SERVER")
+		supervisor.Add("http", httpServer)
+	} else {
+		if config.Api.Enabled {
+			log.Warn("admin API needs HTTP server, set http.enabled")
+		}
+		if config.Stream.Enabled {
+			log.Warn("event stream needs HTTP server, set http.enabled")
+		}
+		if config.Dashboard.Enabled {
+			log.Warn("dashboard needs HTTP server, set http.enabled")
 		}
 	}
 
-	if config.Dahua.Enabled {
-		// START DAHUA SERVER
-		dhServer := dahua.Server{
-			Debug:          config.Debug,
-			WaitGroup:      &processesWaitGroup,
-			Cameras:        &config.Dahua.Cams,
+	// COMMANDS FROM BUSES, LIKE MQTT COMMAND TOPIC
+	controller := &control.Controller{
+		Router:    router,
+		Schedules: schedules,
+		Servers:   &supervisor,
+		Buses:     busManager,
+		Handler:   messageHandler,
+		Reload: func() error {
+			return reload(&supervisor, messageHandler)
+		},
+	}
+	busManager.SetCommandHandler(controller.Handle)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	supervisor.StartAll(ctx)
+
+	// WAIT FOR EXIT SIGNAL
+	<-ctx.Done()
+	stop()
+
+	log.Info("shutting down...")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancelShutdown()
+	supervisor.StopAll(shutdownCtx)
+	busManager.Close(shutdownCtx)
+	log.Info("bye")
+}
+
+// ALARM SERVERS IN START ORDER
+var alarmServers = []string{"hisilicon", "hikvision", "dahua", "ftp"}
+
+// alarmServer creates server from config, nil if it is not enabled
+func alarmServer(name string, config *conf.Config, messageHandler events.Handler) servers.Source {
+	switch {
+	case name == "hisilicon" && config.Hisilicon.Enabled:
+		return &hisilicon.Server{
+			Port:           config.Hisilicon.Port,
+			AlarmEnd:       config.Hisilicon.AlarmEnd,
+			AlarmTimeout:   config.Hisilicon.AlarmTimeout,
 			MessageHandler: messageHandler,
 		}
-		dhServer.Start()
-		if config.Debug {
-			fmt.Println("STARTED DAHUA SERVER")
+	case name == "hikvision" && config.Hikvision.Enabled:
+		return &hikvision.Server{
+			AlarmEnd:       config.Hikvision.AlarmEnd,
+			Reconnect:      config.Hikvision.Reconnect,
+			IdleTimeout:    config.Hikvision.IdleTimeout,
+			Cameras:        &config.Hikvision.Cams,
+			MessageHandler: messageHandler,
 		}
-	}
-
-	if config.Ftp.Enabled {
-		// START FTP SERVER
-		ftpServer := ftp.Server{
-			Debug:          config.Debug,
-			WaitGroup:      &processesWaitGroup,
+	case name == "dahua" && config.Dahua.Enabled:
+		return &dahua.Server{
+			AlarmEnd:       config.Dahua.AlarmEnd,
+			Reconnect:      config.Dahua.Reconnect,
+			IdleTimeout:    config.Dahua.IdleTimeout,
+			Cameras:        &config.Dahua.Cams,
+			MessageHandler: messageHandler,
+		}
+	case name == "ftp" && config.Ftp.Enabled:
+		return &ftp.Server{
 			Port:           config.Ftp.Port,
 			AllowFiles:     config.Ftp.AllowFiles,
 			RootPath:       config.Ftp.RootPath,
 			Password:       config.Ftp.Password,
+			AlarmEnd:       config.Ftp.AlarmEnd,
+			AlarmTimeout:   config.Ftp.AlarmTimeout,
 			MessageHandler: messageHandler,
 		}
-		ftpServer.Start()
-		if config.Debug {
-			fmt.Println("STARTED FTP SERVER")
-		}
 	}
+	return nil
+}
 
-	processesWaitGroup.Wait()
+// reload reads config file again and restarts alarm servers with it.
+// Buses, HTTP server and the rest keep config they started with
+func reload(supervisor *servers.Supervisor, messageHandler events.Handler) error {
+	newConfig, err := config.Reload()
+	if err != nil {
+		return err
+	}
+	log.Info("config reloaded, restarting alarm servers")
+	var errs []error
+	for _, name := range alarmServers {
+		if err := supervisor.Replace(name, alarmServer(name, newConfig, messageHandler)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
 
-	// START INFINITE LOOP WAITING FOR SERVERS
-	exitSignal := make(chan os.Signal)
-	signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
-	<-exitSignal
+// healthcheck exits with non-zero code if running instance is not healthy. Docker image has no curl to do that
+func healthcheck() {
+	if !config.Http.Enabled {
+		log.Error("health check needs HTTP server, set http.enabled")
+		os.Exit(1)
+	}
+	if err := web.CheckHealth(config.Http.Port); err != nil {
+		log.Error("instance is not healthy", "error", err)
+		os.Exit(1)
+	}
 }
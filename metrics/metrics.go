@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const namespace = "alarmserver"
+
+// Registry holds all alarm server metrics, plus Go runtime and process ones
+var Registry = prometheus.NewRegistry()
+
+var (
+	events = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_total",
+		Help:      "Events received from cameras.",
+	}, []string{"source", "camera", "type", "state"})
+
+	webhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook deliveries by response status code, \"error\" if there was no response.",
+	}, []string{"url", "status"})
+
+	webhookDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "webhook_delivery_duration_seconds",
+		Help:      "Time it took webhook to respond.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"url"})
+
+	webhookOutbox = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "webhook_outbox",
+		Help:      "Webhook deliveries in outbox, \"pending\" ones are being retried, \"dead\" ones were given up on.",
+	}, []string{"state"})
+
+	mqttConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mqtt_connected",
+		Help:      "1 if MQTT bus is connected to the broker.",
+	})
+
+	mqttBuffered = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mqtt_buffered_messages",
+		Help:      "Messages waiting for MQTT broker to come back.",
+	})
+
+	cameraOnline = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "camera_online",
+		Help:      "1 if event stream of camera is open.",
+	}, []string{"source", "camera"})
+
+	cameraReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "camera_reconnects_total",
+		Help:      "Reconnect attempts to camera event stream.",
+	}, []string{"source", "camera"})
+
+	ftpUploadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ftp_upload_bytes_total",
+		Help:      "Bytes uploaded by cameras to FTP server.",
+	}, []string{"camera"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		events,
+		webhookDeliveries,
+		webhookDuration,
+		webhookOutbox,
+		mqttConnected,
+		mqttBuffered,
+		cameraOnline,
+		cameraReconnects,
+		ftpUploadBytes,
+	)
+}
+
+// Handler serves metrics in Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+func Event(source string, camera string, eventType string, state string) {
+	events.WithLabelValues(source, camera, eventType, state).Inc()
+}
+
+// WebhookDelivery records webhook response. Status 0 means request failed without a response
+func WebhookDelivery(url string, status int, duration time.Duration) {
+	statusLabel := "error"
+	if status != 0 {
+		statusLabel = strconv.Itoa(status)
+	}
+	webhookDeliveries.WithLabelValues(url, statusLabel).Inc()
+	webhookDuration.WithLabelValues(url).Observe(duration.Seconds())
+}
+
+func WebhookOutbox(pending int, dead int) {
+	webhookOutbox.WithLabelValues("pending").Set(float64(pending))
+	webhookOutbox.WithLabelValues("dead").Set(float64(dead))
+}
+
+func MqttConnected(connected bool) {
+	mqttConnected.Set(boolToFloat(connected))
+}
+
+func MqttBuffered(count int) {
+	mqttBuffered.Set(float64(count))
+}
+
+func CameraOnline(source string, camera string, online bool) {
+	cameraOnline.WithLabelValues(source, camera).Set(boolToFloat(online))
+}
+
+func CameraReconnect(source string, camera string) {
+	cameraReconnects.WithLabelValues(source, camera).Inc()
+}
+
+func FtpUpload(camera string, bytes int64) {
+	ftpUploadBytes.WithLabelValues(camera).Add(float64(bytes))
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+package retry
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Policy controls how streaming sources retry connecting to cameras, and buses retry deliveries
+type Policy struct {
+	InitialDelay time.Duration `json:"initialDelay"`
+	MaxDelay     time.Duration `json:"maxDelay"`
+	Jitter       float64       `json:"jitter"`      // RANDOM SPREAD AS A FRACTION OF DELAY, 0..1
+	MaxAttempts  int           `json:"maxAttempts"` // 0 MEANS RETRY FOREVER
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		InitialDelay: 1 * time.Second,
+		MaxDelay:     2 * time.Minute,
+		Jitter:       0.2,
+		MaxAttempts:  0,
+	}
+}
+
+// Delay returns delay before attempt number attempt, counting from 0, doubling each time up to MaxDelay
+func (policy Policy) Delay(attempt int) time.Duration {
+	delay := policy.InitialDelay
+	if delay <= 0 {
+		delay = DefaultPolicy().InitialDelay
+	}
+	for i := 0; i < attempt; i++ {
+		delay *= 2
+		if policy.MaxDelay > 0 && delay >= policy.MaxDelay {
+			delay = policy.MaxDelay
+			break
+		}
+	}
+	if policy.Jitter > 0 {
+		spread := float64(delay) * policy.Jitter
+		delay += time.Duration(spread * (2*rand.Float64() - 1))
+	}
+	return delay
+}
+
+// Backoff hands out exponentially growing delays between attempts
+type Backoff struct {
+	Policy  Policy
+	attempt int
+}
+
+// Next returns delay before next attempt, or false if policy allows no more attempts
+func (backoff *Backoff) Next() (time.Duration, bool) {
+	if backoff.Policy.MaxAttempts > 0 && backoff.attempt >= backoff.Policy.MaxAttempts {
+		return 0, false
+	}
+	delay := backoff.Policy.Delay(backoff.attempt)
+	backoff.attempt++
+	return delay, true
+}
+
+// Wait sleeps until next attempt. Returns false if there should be no next attempt
+func (backoff *Backoff) Wait(ctx context.Context) bool {
+	delay, ok := backoff.Next()
+	if !ok {
+		return false
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (backoff *Backoff) Reset() {
+	backoff.attempt = 0
+}
+
+func (backoff *Backoff) Attempts() int {
+	return backoff.attempt
+}
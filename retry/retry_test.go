@@ -0,0 +1,83 @@
+package retry
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDelayGrowsUpToMaxDelay(t *testing.T) {
+	policy := Policy{InitialDelay: time.Second, MaxDelay: 10 * time.Second}
+	expected := []time.Duration{1, 2, 4, 8, 10, 10, 10}
+	for attempt, want := range expected {
+		if delay := policy.Delay(attempt); delay != want*time.Second {
+			t.Errorf("delay before attempt %d is %s, want %s", attempt, delay, want*time.Second)
+		}
+	}
+	if delay := policy.Delay(1000); delay != 10*time.Second {
+		t.Errorf("delay far past max is %s, want 10s", delay)
+	}
+}
+
+func TestDelayWithoutInitialDelayUsesDefault(t *testing.T) {
+	if delay := (Policy{}).Delay(0); delay != DefaultPolicy().InitialDelay {
+		t.Errorf("delay is %s, want %s", delay, DefaultPolicy().InitialDelay)
+	}
+}
+
+func TestDelayJitterStaysInBounds(t *testing.T) {
+	policy := Policy{InitialDelay: time.Second, MaxDelay: 8 * time.Second, Jitter: 0.2}
+	for attempt, base := range []time.Duration{1, 2, 4, 8, 8} {
+		base *= time.Second
+		low, high := base-base/5, base+base/5
+		spread := false
+		for i := 0; i < 200; i++ {
+			delay := policy.Delay(attempt)
+			if delay < low || delay > high {
+				t.Fatalf("delay before attempt %d is %s, want it within %s..%s", attempt, delay, low, high)
+			}
+			spread = spread || delay != base
+		}
+		if !spread {
+			t.Errorf("delay before attempt %d is always %s, jitter does nothing", attempt, base)
+		}
+	}
+}
+
+func TestBackoffStopsAfterMaxAttempts(t *testing.T) {
+	backoff := Backoff{Policy: Policy{InitialDelay: time.Second, MaxAttempts: 3}}
+	for i := 0; i < 3; i++ {
+		if _, ok := backoff.Next(); !ok {
+			t.Fatalf("attempt %d refused, want 3 attempts", i+1)
+		}
+	}
+	if _, ok := backoff.Next(); ok {
+		t.Error("attempt 4 allowed, want 3 attempts")
+	}
+	if backoff.Attempts() != 3 {
+		t.Errorf("attempts are %d, want 3", backoff.Attempts())
+	}
+}
+
+func TestBackoffResetStartsOver(t *testing.T) {
+	backoff := Backoff{Policy: Policy{InitialDelay: time.Second, MaxDelay: time.Minute, MaxAttempts: 2}}
+	backoff.Next()
+	backoff.Next()
+	backoff.Reset()
+	if backoff.Attempts() != 0 {
+		t.Errorf("attempts after reset are %d, want 0", backoff.Attempts())
+	}
+	delay, ok := backoff.Next()
+	if !ok || delay != time.Second {
+		t.Errorf("first delay after reset is %s (%v), want 1s", delay, ok)
+	}
+}
+
+func TestBackoffWaitStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	backoff := Backoff{Policy: Policy{InitialDelay: time.Hour}}
+	if backoff.Wait(ctx) {
+		t.Error("wait went on after context was done")
+	}
+}
@@ -0,0 +1,141 @@
+package servers
+
+import (
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/metrics"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type ConnectionState string
+
+const (
+	ConnectionConnecting ConnectionState = "connecting"
+	ConnectionOnline     ConnectionState = "online"
+	ConnectionOffline    ConnectionState = "offline"
+	ConnectionAuthFailed ConnectionState = "auth-failed"
+)
+
+type CameraStatus struct {
+	Name       string          `json:"name"`
+	State      ConnectionState `json:"state"`
+	Since      time.Time       `json:"since"`
+	Reconnects int             `json:"reconnects"`
+	AuthMethod string          `json:"authMethod,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// ConnectionTracker keeps connection state of every camera of a streaming source, logs its changes to Logger
+// and sends them to Handler as availability events
+type ConnectionTracker struct {
+	Logger  *slog.Logger
+	Source  string
+	Handler events.Handler
+	lock    sync.RWMutex
+	cameras map[string]*CameraStatus
+}
+
+func (tracker *ConnectionTracker) Set(camera string, state ConnectionState, err error) {
+	tracker.lock.Lock()
+	if tracker.cameras == nil {
+		tracker.cameras = make(map[string]*CameraStatus)
+	}
+	status, exists := tracker.cameras[camera]
+	if !exists {
+		status = &CameraStatus{Name: camera}
+		tracker.cameras[camera] = status
+	}
+	if err != nil {
+		status.Error = err.Error()
+	} else if state == ConnectionOnline {
+		status.Error = ""
+	}
+	if status.State == state {
+		tracker.lock.Unlock()
+		return
+	}
+	if exists {
+		logger := tracker.Logger
+		if logger == nil {
+			logger = log
+		}
+		logger = logger.With("camera", camera, "state", state, "previousState", status.State)
+		if status.Error != "" {
+			logger = logger.With("error", status.Error)
+		}
+		logger.Info("camera connection changed")
+	}
+	previousState := status.State
+	status.State = state
+	status.Since = time.Now()
+	metrics.CameraOnline(tracker.Source, camera, state == ConnectionOnline)
+	event := availabilityEvent(tracker.Source, *status, previousState)
+	tracker.lock.Unlock()
+
+	// SEND OUTSIDE THE LOCK, BUSES MAY TAKE A WHILE
+	if tracker.Handler != nil {
+		tracker.Handler(event)
+	}
+}
+
+func availabilityEvent(source string, status CameraStatus, previousState ConnectionState) events.Event {
+	event := events.Event{
+		Source:  source,
+		Camera:  status.Name,
+		Type:    events.TypeAvailability,
+		State:   events.StateInactive,
+		Time:    status.Since,
+		Message: string(status.State),
+	}
+	if status.State == ConnectionOnline {
+		event.State = events.StateActive
+	}
+	event.SetMeta("previousState", string(previousState))
+	event.SetMeta("error", status.Error)
+	event.SetMeta("reconnects", strconv.Itoa(status.Reconnects))
+	return event
+}
+
+func (tracker *ConnectionTracker) AddReconnect(camera string) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if status, exists := tracker.cameras[camera]; exists {
+		status.Reconnects++
+	}
+	metrics.CameraReconnect(tracker.Source, camera)
+}
+
+func (tracker *ConnectionTracker) SetAuthMethod(camera string, authMethod string) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if status, exists := tracker.cameras[camera]; exists {
+		status.AuthMethod = authMethod
+	}
+}
+
+func (tracker *ConnectionTracker) Get(camera string) (CameraStatus, bool) {
+	tracker.lock.RLock()
+	defer tracker.lock.RUnlock()
+	status, exists := tracker.cameras[camera]
+	if !exists {
+		return CameraStatus{}, false
+	}
+	return *status, true
+}
+
+// List returns statuses of all cameras sorted by name
+func (tracker *ConnectionTracker) List() []CameraStatus {
+	tracker.lock.RLock()
+	defer tracker.lock.RUnlock()
+	list := make([]CameraStatus, 0, len(tracker.cameras))
+	for _, status := range tracker.cameras {
+		list = append(list, *status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
@@ -0,0 +1,91 @@
+package servers
+
+import (
+	"errors"
+	"github.com/toxuin/alarmserver/events"
+	"reflect"
+	"testing"
+)
+
+func TestConnectionTrackerSendsEachChangeOnce(t *testing.T) {
+	var sent []events.Event
+	tracker := &ConnectionTracker{Source: "hikvision", Handler: func(event events.Event) {
+		sent = append(sent, event)
+	}}
+
+	tracker.Set("porch", ConnectionConnecting, nil)
+	tracker.Set("porch", ConnectionOnline, nil)
+	tracker.Set("porch", ConnectionOnline, nil)
+	tracker.AddReconnect("porch")
+	tracker.Set("porch", ConnectionOffline, errors.New("connection reset"))
+	tracker.Set("porch", ConnectionOffline, errors.New("connection refused"))
+	tracker.Set("porch", ConnectionOnline, nil)
+
+	var got []string
+	for _, event := range sent {
+		got = append(got, event.Message)
+	}
+	if want := []string{"connecting", "online", "offline", "online"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("sent %v, want %v", got, want)
+	}
+
+	online, offline := sent[1], sent[2]
+	if online.Source != "hikvision" || online.Camera != "porch" || online.Type != events.TypeAvailability {
+		t.Errorf("event is %s/%s/%s, want hikvision/porch/%s", online.Source, online.Camera, online.Type, events.TypeAvailability)
+	}
+	if online.State != events.StateActive || offline.State != events.StateInactive {
+		t.Errorf("online is %s and offline is %s, want active and inactive", online.State, offline.State)
+	}
+	if previous := offline.Metadata["previousState"]; previous != "online" {
+		t.Errorf("previous state of offline is %q, want online", previous)
+	}
+	if reason := offline.Metadata["error"]; reason != "connection reset" {
+		t.Errorf("error of offline is %q, want connection reset", reason)
+	}
+	if reconnects := offline.Metadata["reconnects"]; reconnects != "1" {
+		t.Errorf("reconnects of offline are %q, want 1", reconnects)
+	}
+
+	status, found := tracker.Get("porch")
+	if !found {
+		t.Fatal("porch is not tracked")
+	}
+	if status.State != ConnectionOnline || status.Error != "" {
+		t.Errorf("porch is %s with error %q, want online without error", status.State, status.Error)
+	}
+}
+
+func TestConnectionTrackerKeepsLatestErrorWithoutEvent(t *testing.T) {
+	sent := 0
+	tracker := &ConnectionTracker{Handler: func(events.Event) { sent++ }}
+	tracker.Set("porch", ConnectionOffline, errors.New("connection reset"))
+	tracker.Set("porch", ConnectionOffline, errors.New("connection refused"))
+	if sent != 1 {
+		t.Errorf("sent %d events, want 1", sent)
+	}
+	if status, _ := tracker.Get("porch"); status.Error != "connection refused" {
+		t.Errorf("error is %q, want latest one", status.Error)
+	}
+}
+
+func TestConnectionTrackerTracksCamerasApart(t *testing.T) {
+	var sent []string
+	tracker := &ConnectionTracker{Handler: func(event events.Event) {
+		sent = append(sent, event.Camera+" "+event.Message)
+	}}
+	tracker.Set("porch", ConnectionOnline, nil)
+	tracker.Set("garage", ConnectionOnline, nil)
+	tracker.Set("garage", ConnectionAuthFailed, errors.New("401"))
+	tracker.Set("porch", ConnectionOnline, nil)
+
+	if want := []string{"porch online", "garage online", "garage auth-failed"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent %v, want %v", sent, want)
+	}
+	list := tracker.List()
+	if len(list) != 2 || list[0].Name != "garage" || list[1].Name != "porch" {
+		t.Errorf("list is %+v, want garage and porch", list)
+	}
+	if _, found := tracker.Get("attic"); found {
+		t.Error("unknown camera is tracked")
+	}
+}
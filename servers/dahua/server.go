@@ -1,40 +1,53 @@
 package dahua
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
+	"errors"
 	"github.com/icholy/digest"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/logging"
+	"github.com/toxuin/alarmserver/retry"
+	"github.com/toxuin/alarmserver/servers"
 	"io"
-	"log"
+	"log/slog"
 	"mime"
 	"mime/multipart"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+var log = logging.For("dahua")
+
 type DhCamera struct {
-	Debug    bool
-	Name     string   `json:"name"`
-	Url      string   `json:"url"`
-	Username string   `json:"username"`
-	Password string   `json:"password"`
-	Channel  string   `json:"channel"`
-	Events   []string `json:"events"`
-	client   *http.Client
+	Name        string   `json:"name"`
+	Url         string   `json:"url"`
+	Username    string   `json:"username"`
+	Password    string   `json:"password"`
+	Channel     string   `json:"channel"`
+	Events      []string `json:"events"`
+	client      *http.Client
+	alarmEnd    bool
+	idleTimeout time.Duration
+	states      *events.StateTracker
 }
 
+// SECONDS BETWEEN HEARTBEATS CAMERA IS ASKED TO SEND, IdleTimeout SHOULD BE A FEW OF THESE
+const heartbeatInterval = 10
+
 type Server struct {
-	Debug          bool
-	WaitGroup      *sync.WaitGroup
+	servers.StatusHolder
+	AlarmEnd       bool
+	Reconnect      retry.Policy
+	IdleTimeout    time.Duration
 	Cameras        *[]DhCamera
-	MessageHandler func(cameraName string, eventType string, extra string)
-}
-
-type DhEvent struct {
-	Camera  *DhCamera
-	Type    string
-	Message string
+	MessageHandler events.Handler
+	connections    servers.ConnectionTracker
+	cancel         context.CancelFunc
+	waitGroup      sync.WaitGroup
 }
 
 type Event struct {
@@ -42,11 +55,26 @@ type Event struct {
 	Action string
 	Index  int
 	Data   string
-	active bool
 }
 
-func (camera *DhCamera) readEvents(channel chan<- DhEvent, callback func()) {
-	eventUrlSuffix := "/cgi-bin/eventManager.cgi?action=attach&heartbeat=10"
+// region returns name of the rule that triggered the event, for rule-based events like CrossLineDetection
+func (event *Event) region() string {
+	if event.Data == "" {
+		return ""
+	}
+	var data struct {
+		Name string
+	}
+	if err := json.Unmarshal([]byte(event.Data), &data); err != nil {
+		return ""
+	}
+	return data.Name
+}
+
+// readEvents reads camera's event stream until it breaks. It calls onConnect once the stream is open,
+// and callback if there is no point in reconnecting
+func (camera *DhCamera) readEvents(ctx context.Context, channel chan<- events.Event, onConnect func(), callback func()) {
+	eventUrlSuffix := "/cgi-bin/eventManager.cgi?action=attach&heartbeat=" + strconv.Itoa(heartbeatInterval)
 	if camera.Channel != "" {
 		eventUrlSuffix += "&channel=" + camera.Channel
 	}
@@ -55,10 +83,21 @@ func (camera *DhCamera) readEvents(channel chan<- DhEvent, callback func()) {
 	} else {
 		eventUrlSuffix += "&codes=[All]"
 	}
-	request, err := http.NewRequest("GET", camera.Url+eventUrlSuffix, nil)
+
+	logger := log.With("camera", camera.Name)
+
+	// DROP THE STREAM IF HEARTBEATS STOP COMING
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchdog := servers.NewWatchdog(camera.idleTimeout, func() {
+		logger.Warn("no heartbeat from camera, reconnecting...", "idleTimeout", camera.idleTimeout)
+		cancel()
+	})
+	defer watchdog.Stop()
+
+	request, err := http.NewRequestWithContext(ctx, "GET", camera.Url+eventUrlSuffix, nil)
 	if err != nil {
-		fmt.Printf("DAHUA: Error: Could not connect to camera %s\n", camera.Name)
-		fmt.Println("DAHUA: Error", err)
+		logger.Error("could not connect to camera", "error", err)
 		callback()
 		return
 	}
@@ -68,38 +107,34 @@ func (camera *DhCamera) readEvents(channel chan<- DhEvent, callback func()) {
 
 	response, err := camera.client.Do(request)
 	if err != nil {
-		fmt.Printf("DAHUA: Error opening HTTP connection to camera %s\n", camera.Name)
-		fmt.Println(err)
-		callback()
+		// CAMERA IS UNREACHABLE, RECONNECT LATER
+		if ctx.Err() == nil {
+			logger.Error("error opening HTTP connection to camera", "error", err)
+		}
 		return
 	}
 	defer response.Body.Close()
 
 	if response.StatusCode != 200 {
-		fmt.Printf("DAHUA: Warning: Status Code was not 200, but %v\n", response.StatusCode)
-		if camera.Debug { // DUMP BODY
-			body, err := io.ReadAll(response.Body)
-			if err != nil {
-				log.Fatalln(err)
-			}
-			fmt.Println(string(body))
+		logger.Warn("status code was not 200", "status", response.StatusCode)
+		if logger.Enabled(ctx, slog.LevelDebug) { // DUMP BODY
+			body, _ := io.ReadAll(response.Body)
+			logger.Debug("error response", "body", string(body))
 		}
+		return
 	}
 
 	// FIGURE OUT MULTIPART BOUNDARY
 	mediaType, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
-	if camera.Debug {
-		fmt.Printf("DAHUA: Media type is %s\n", mediaType)
-	}
+	logger.Debug("got event stream", "mediaType", mediaType)
 
 	if params["boundary"] == "" {
-		fmt.Println("DAHUA: ERROR: Camera " + camera.Name + " does not seem to support event streaming")
+		logger.Error("camera does not seem to support event streaming")
 		callback()
 		return
 	}
 	multipartBoundary := params["boundary"]
-
-	event := Event{}
+	onConnect()
 
 	// READ PART BY PART
 	multipartReader := multipart.NewReader(response.Body, multipartBoundary)
@@ -109,20 +144,21 @@ func (camera *DhCamera) readEvents(channel chan<- DhEvent, callback func()) {
 			break
 		}
 		if err != nil {
-			fmt.Println(err)
-			continue
+			// STREAM IS BROKEN OR CLOSED, RECONNECT
+			if ctx.Err() == nil {
+				logger.Warn("event stream broken", "error", err)
+			}
+			break
 		}
+		watchdog.Kick()
 		contentLength, _ := strconv.Atoi(part.Header.Get("Content-Length"))
 		body := make([]byte, contentLength)
 		_, err = part.Read(body)
 		if err != nil {
-			fmt.Println(err)
+			logger.Warn("error reading event", "error", err)
 			continue
 		}
-
-		if camera.Debug {
-			fmt.Printf("DAHUA: Read event body: %s\n", body)
-		}
+		logger.Debug("read event body", "body", string(body))
 
 		// EXAMPLE: "Code=VideoMotion; action=Start; index=0\r\n\r\n"
 		line := strings.Trim(string(body), " \n\r")
@@ -132,79 +168,168 @@ func (camera *DhCamera) readEvents(channel chan<- DhEvent, callback func()) {
 		items := strings.Split(line, ";")
 		keyValues := make(map[string]string, len(items))
 		for _, item := range items {
-			parts := strings.Split(item, "=")
-			if len(parts) > 0 {
+			parts := strings.SplitN(item, "=", 2)
+			if len(parts) > 1 {
 				keyValues[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
 			}
 		}
 		// EXAMPLE: { Code: VideoMotion, action: Start, index: 0 }
 		index := 0
 		index, _ = strconv.Atoi(keyValues["index"])
-		event.Code = keyValues["Code"]
-		event.Action = keyValues["action"]
-		event.Index = index
-		event.Data = keyValues["data"]
+		event := Event{
+			Code:   keyValues["Code"],
+			Action: keyValues["action"],
+			Index:  index,
+			Data:   keyValues["data"],
+		}
+
+		dahuaEvent := events.Event{
+			Source:  events.SourceDahua,
+			Camera:  camera.Name,
+			Channel: strconv.Itoa(event.Index),
+			Type:    event.Code,
+			State:   events.StateActive,
+			Time:    time.Now(),
+			Message: event.Data,
+			Raw:     line,
+		}
+		if dahuaEvent.Message == "" {
+			dahuaEvent.Message = event.Action
+		}
+		dahuaEvent.SetMeta("region", event.region())
+		key := events.KeyOf(dahuaEvent)
 
 		switch event.Action {
 		case "Start":
-			if !event.active {
-				if camera.Debug {
-					fmt.Println("DAHUA: SENDING CAMERA EVENT!")
-				}
-				dahuaEvent := DhEvent{
-					Camera:  camera,
-					Type:    event.Code,
-					Message: event.Data,
-				}
-				if dahuaEvent.Message == "" {
-					dahuaEvent.Message = event.Action
-				}
+			if camera.states.Start(key) {
+				logger.Debug("sending camera event", "event", dahuaEvent.Type, "channel", dahuaEvent.Channel)
 				channel <- dahuaEvent
 			}
-			event.active = true
 		case "Stop":
-			event.active = false
+			duration, wasActive := camera.states.Stop(key)
+			if wasActive && camera.alarmEnd {
+				dahuaEvent.State = events.StateInactive
+				dahuaEvent.Duration = duration.Seconds()
+				dahuaEvent.Message = event.Action
+				channel <- dahuaEvent
+			}
 		}
 	}
 }
 
-func (server *Server) addCamera(waitGroup *sync.WaitGroup, cam *DhCamera, channel chan<- DhEvent) {
-	waitGroup.Add(1)
-
-	if server.Debug {
-		fmt.Printf("DAHUA: Adding camera %s: %s\n", cam.Name, cam.Url)
+// endAlarms forgets alarms that are still on, sending their end events if those are wanted
+func (camera *DhCamera) endAlarms(channel chan<- events.Event) {
+	for key, duration := range camera.states.StopStale(camera.Name, time.Now()) {
+		if !camera.alarmEnd {
+			continue
+		}
+		endEvent := events.Event{
+			Source:   events.SourceDahua,
+			Camera:   camera.Name,
+			Channel:  key.Channel,
+			Type:     key.Type,
+			State:    events.StateInactive,
+			Time:     time.Now(),
+			Message:  string(events.StateInactive),
+			Duration: duration.Seconds(),
+		}
+		endEvent.SetMeta("region", key.Region)
+		channel <- endEvent
 	}
+}
+
+func (server *Server) addCamera(ctx context.Context, waitGroup *sync.WaitGroup, cam *DhCamera, channel chan<- events.Event) {
+	log.Debug("adding camera", "camera", cam.Name, "url", cam.Url)
 
 	if cam.client == nil {
 		cam.client = &http.Client{}
 	}
+	cam.alarmEnd = server.AlarmEnd
+	cam.idleTimeout = server.IdleTimeout
+	cam.states = &events.StateTracker{}
 
-	// PROBE AUTH
-	request, err := http.NewRequest("GET", cam.Url+"/cgi-bin/configManager.cgi?action=getConfig&name=General", nil)
+	server.connections.Set(cam.Name, servers.ConnectionConnecting, nil)
+
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		backoff := retry.Backoff{Policy: server.Reconnect}
+		authProbed := false
+		done := false
+		callback := func() {
+			done = true
+		}
+		onConnect := func() {
+			backoff.Reset()
+			server.connections.Set(cam.Name, servers.ConnectionOnline, nil)
+		}
+
+		authFailed := false
+		for !done && ctx.Err() == nil {
+			var err error
+			if !authProbed {
+				err = server.probeAuth(ctx, cam)
+				if errors.Is(err, errBadCredentials) {
+					authFailed = true
+					server.connections.Set(cam.Name, servers.ConnectionAuthFailed, err)
+					break
+				}
+				authProbed = err == nil
+			}
+			if authProbed {
+				cam.readEvents(ctx, channel, onConnect, callback)
+				// OR ALARMS ON WHEN STREAM DROPPED NEVER END, AND THEIR NEXT START LOOKS LIKE A DUPLICATE
+				cam.endAlarms(channel)
+			}
+			if done || ctx.Err() != nil {
+				break
+			}
+
+			// WAIT BEFORE RECONNECTING
+			server.connections.Set(cam.Name, servers.ConnectionOffline, err)
+			if !backoff.Wait(ctx) {
+				if ctx.Err() == nil {
+					log.Error("giving up on camera", "camera", cam.Name, "attempts", backoff.Attempts())
+				}
+				break
+			}
+			server.connections.AddReconnect(cam.Name)
+		}
+		if !authFailed {
+			server.connections.Set(cam.Name, servers.ConnectionOffline, nil)
+		}
+		log.Info("closed connection to camera", "camera", cam.Name)
+	}()
+}
+
+var errBadCredentials = errors.New("bad username or password")
+
+// probeAuth figures out which HTTP auth method camera wants. Returns errBadCredentials when camera rejects the password
+func (server *Server) probeAuth(ctx context.Context, cam *DhCamera) error {
+	logger := log.With("camera", cam.Name)
+	request, err := http.NewRequestWithContext(ctx, "GET", cam.Url+"/cgi-bin/configManager.cgi?action=getConfig&name=General", nil)
 	if err != nil {
-		fmt.Printf("DAHUA: Error probing auth method for camera %s\n", cam.Name)
-		fmt.Println(err)
-		return
+		logger.Error("error probing auth method", "error", err)
+		return err
 	}
 	request.SetBasicAuth(cam.Username, cam.Password)
 	response, err := cam.client.Do(request)
 	if err != nil {
-		fmt.Printf("DAHUA: Error probing HTTP Auth method for camera %s\n", cam.Name)
-		fmt.Println(err)
-		return
+		logger.Error("error probing HTTP auth method", "error", err)
+		return err
 	}
-	defer response.Body.Close()
+	_ = response.Body.Close()
 	if response.StatusCode == 401 {
 		if response.Header.Get("WWW-Authenticate") == "" {
 			// BAD PASSWORD
-			fmt.Printf("DAHUA: UNKNOWN AUTH METHOD FOR CAMERA %s! SKIPPING...", cam.Name)
-			return
+			logger.Error("unknown auth method, skipping camera")
+			return errBadCredentials
 		}
 		authMethod := strings.Split(response.Header.Get("WWW-Authenticate"), " ")[0]
 		if authMethod == "Basic" {
 			// BAD PASSWORD
-			fmt.Printf("DAHUA: BAD PASSWORD FOR CAMERA %s! SKIPPING...", cam.Name)
-			return
+			logger.Error("bad password, skipping camera")
+			return errBadCredentials
 		}
 
 		// TRY ANOTHER TIME WITH DIGEST TRANSPORT
@@ -213,73 +338,84 @@ func (server *Server) addCamera(waitGroup *sync.WaitGroup, cam *DhCamera, channe
 			Password: cam.Password,
 		}
 		response, err := cam.client.Do(request)
-		if err != nil || response.StatusCode == 401 {
-			if err != nil {
-				fmt.Println(err)
-			}
+		if err != nil {
+			logger.Error("error probing HTTP auth method", "error", err)
+			return err
+		}
+		_ = response.Body.Close()
+		if response.StatusCode == 401 {
 			// BAD PASSWORD
-			fmt.Printf("DAHUA: BAD PASSWORD FOR CAMERA %s! SKIPPING...", cam.Name)
-			return
+			logger.Error("bad password, skipping camera")
+			return errBadCredentials
 		}
 
-		if server.Debug {
-			fmt.Println("DAHUA: USING DIGEST AUTH")
-		}
-	} else if server.Debug {
-		fmt.Println("DAHUA: USING BASIC AUTH")
+		logger.Debug("using digest auth")
+		server.connections.SetAuthMethod(cam.Name, "digest")
+	} else {
+		logger.Debug("using basic auth")
+		server.connections.SetAuthMethod(cam.Name, "basic")
 	}
-
-	go func() {
-		defer waitGroup.Done()
-		done := false
-		callback := func() {
-			done = true
-		}
-
-		for {
-			if done {
-				break
-			}
-			cam.readEvents(channel, callback)
-		}
-		fmt.Printf("DAHUA: Closed connection to camera %s\n", cam.Name)
-	}()
+	return nil
 }
 
-func (server *Server) Start() {
+func (server *Server) Start(ctx context.Context) error {
 	if server.Cameras == nil || len(*server.Cameras) == 0 {
-		fmt.Println("DAHUA: Error: no cameras defined")
-		return
+		err := errors.New("no cameras defined")
+		server.SetStatus(servers.StateFailed, err)
+		return err
 	}
+	server.SetStatus(servers.StateStarting, nil)
 
 	if server.MessageHandler == nil {
-		fmt.Println("DAHUA: Message handler is not set for Dahua cams - that's probably not what you want")
-		server.MessageHandler = func(cameraName string, eventType string, extra string) {
-			fmt.Printf("DAHUA: Lost alarm: %s - %s: %s\n", cameraName, eventType, extra)
+		log.Warn("message handler is not set for Dahua cams - that's probably not what you want")
+		server.MessageHandler = func(event events.Event) {
+			log.Warn("lost alarm", "camera", event.Camera, "event", event.Type, "message", event.Message)
 		}
 	}
 
-	waitGroup := sync.WaitGroup{}
-	eventChannel := make(chan DhEvent, 5)
+	ctx, server.cancel = context.WithCancel(ctx)
+	server.connections.Logger = log
+	server.connections.Source = events.SourceDahua
+	server.connections.Handler = server.MessageHandler
+	cameraWaitGroup := sync.WaitGroup{}
+	eventChannel := make(chan events.Event, 5)
 
-	for _, camera := range *server.Cameras {
-		server.addCamera(&waitGroup, &camera, eventChannel)
+	for index := range *server.Cameras {
+		server.addCamera(ctx, &cameraWaitGroup, &(*server.Cameras)[index], eventChannel)
 	}
 
+	// CLOSE EVENT CHANNEL ONCE ALL CAMERAS ARE DONE
+	go func() {
+		cameraWaitGroup.Wait()
+		close(eventChannel)
+	}()
+
 	// START MESSAGE PROCESSOR
-	go func(waitGroup *sync.WaitGroup, channel <-chan DhEvent) {
-		// WAIT GROUP FOR INDIVIDUAL CAMERAS
-		defer waitGroup.Done()
+	server.waitGroup.Add(1)
+	go func(channel <-chan events.Event) {
+		defer server.waitGroup.Done()
+		// ONE AT A TIME, OR ALARM END COULD OVERTAKE ITS START
+		for event := range channel {
+			server.MessageHandler(event)
+		}
+	}(eventChannel)
 
-		// EXTERNAL WAIT GROUP FOR PROCESSES
-		defer server.WaitGroup.Done()
-		server.WaitGroup.Add(1)
+	server.SetStatus(servers.StateRunning, nil)
+	return nil
+}
 
-		for {
-			event := <-channel
-			go server.MessageHandler(event.Camera.Name, event.Type, event.Message)
-		}
-	}(&waitGroup, eventChannel)
+func (server *Server) Status() servers.Status {
+	status := server.StatusHolder.Status()
+	status.Cameras = server.connections.List()
+	return status
+}
 
-	waitGroup.Wait()
+func (server *Server) Stop() {
+	if server.cancel == nil {
+		return
+	}
+	server.cancel()
+	server.waitGroup.Wait()
+	server.cancel = nil
+	server.SetStatus(servers.StateStopped, nil)
 }
@@ -1,18 +1,16 @@
 package ftp
 
 import (
-	"fmt"
 	"goftp.io/server/v2"
 )
 
 type DumbAuth struct {
-	Debug    bool
 	Password string
 }
 
 func (d *DumbAuth) CheckPasswd(ctx *server.Context, username string, password string) (bool, error) {
-	if d.Debug {
-		fmt.Printf("FTP: %s is connecting with username %s and password %s\n", ctx.Sess.RemoteAddr().String(), username, password)
-	}
-	return password == d.Password, nil
+	// NEVER LOG THE PASSWORD ITSELF
+	accepted := password == d.Password
+	log.Debug("client is connecting", "remoteAddress", ctx.Sess.RemoteAddr().String(), "username", username, "accepted", accepted)
+	return accepted, nil
 }
@@ -2,35 +2,50 @@ package ftp
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/metrics"
 	"goftp.io/server/v2"
 	"io"
+	"mime"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type Driver struct {
-	Debug           bool
+	Context         context.Context
 	RootPath        string
 	AllowFileUpload bool
-	EventChannel    chan<- Event
+	EventChannel    chan<- events.Event
 	rootFInfo       os.FileInfo
 }
 
 type EventMaker interface {
-	MakeEvent(eventStr string) Event
+	MakeEvent(eventStr string) events.Event
 }
 
-func (driver *Driver) createEvent(eventStr string) Event {
-	if driver.Debug {
-		fmt.Printf("FTP: PARSING STRING TO EVENT %s\n", eventStr)
+func (driver *Driver) createEvent(eventStr string) events.Event {
+	log.Debug("parsing string to event", "path", eventStr)
+
+	attachment := events.Attachment{
+		Name:        filepath.Base(eventStr),
+		ContentType: mime.TypeByExtension(filepath.Ext(eventStr)),
+	}
+	if driver.AllowFileUpload {
+		attachment.Path = driver.realPath(eventStr)
 	}
 
-	return Event{
-		Type:    "ftpUpload",
-		Message: eventStr,
+	return events.Event{
+		Source:      events.SourceFtp,
+		Type:        "ftpUpload",
+		State:       events.StateActive,
+		Time:        time.Now(),
+		Message:     eventStr,
+		Attachments: []events.Attachment{attachment},
 	}
 }
 
@@ -40,9 +55,7 @@ func (driver *Driver) realPath(path string) string {
 }
 
 func (driver *Driver) Stat(context *server.Context, path string) (os.FileInfo, error) {
-	if driver.Debug {
-		fmt.Printf("FTP: DRIVER: Stat(%s)\n", path)
-	}
+	log.Debug("driver: Stat", "path", path)
 
 	if !driver.AllowFileUpload {
 		return driver.rootFInfo, nil
@@ -57,9 +70,7 @@ func (driver *Driver) Stat(context *server.Context, path string) (os.FileInfo, e
 }
 
 func (driver *Driver) ListDir(context *server.Context, path string, callback func(os.FileInfo) error) error {
-	if driver.Debug {
-		fmt.Printf("FTP: DRIVER: ListDir(%s)\n", path)
-	}
+	log.Debug("driver: ListDir", "path", path)
 	if !driver.AllowFileUpload {
 		// THIS WILL RESULT IN AN INFINITELY DEEP TREE CONTAINING ROOT DIR CONTAINING ITSELF
 		return callback(driver.rootFInfo)
@@ -85,9 +96,7 @@ func (driver *Driver) ListDir(context *server.Context, path string, callback fun
 }
 
 func (driver *Driver) DeleteDir(context *server.Context, path string) error {
-	if driver.Debug {
-		fmt.Printf("FTP: DRIVER: DeleteDir(%s)\n", path)
-	}
+	log.Debug("driver: DeleteDir", "path", path)
 	if !driver.AllowFileUpload {
 		return nil
 	}
@@ -104,9 +113,7 @@ func (driver *Driver) DeleteDir(context *server.Context, path string) error {
 }
 
 func (driver *Driver) DeleteFile(context *server.Context, path string) error {
-	if driver.Debug {
-		fmt.Printf("FTP: DRIVER: DeleteFile(%s)\n", path)
-	}
+	log.Debug("driver: DeleteFile", "path", path)
 	if !driver.AllowFileUpload {
 		return nil
 	}
@@ -123,9 +130,7 @@ func (driver *Driver) DeleteFile(context *server.Context, path string) error {
 }
 
 func (driver *Driver) Rename(context *server.Context, fromPath string, toPath string) error {
-	if driver.Debug {
-		fmt.Printf("FTP: DRIVER: Rename(fromPath: %s, toPath: %s)\n", fromPath, toPath)
-	}
+	log.Debug("driver: Rename", "fromPath", fromPath, "toPath", toPath)
 	if !driver.AllowFileUpload {
 		return nil
 	}
@@ -134,9 +139,7 @@ func (driver *Driver) Rename(context *server.Context, fromPath string, toPath st
 }
 
 func (driver *Driver) MakeDir(context *server.Context, path string) error {
-	if driver.Debug {
-		fmt.Printf("FTP: DRIVER: MakeDir(%s)\n", path)
-	}
+	log.Debug("driver: MakeDir", "path", path)
 	if !driver.AllowFileUpload {
 		return nil
 	}
@@ -145,9 +148,7 @@ func (driver *Driver) MakeDir(context *server.Context, path string) error {
 }
 
 func (driver *Driver) GetFile(context *server.Context, path string, offset int64) (int64, io.ReadCloser, error) {
-	if driver.Debug {
-		fmt.Printf("FTP: DRIVER: GetFile(path: %s, offset: %v)\n", path, offset)
-	}
+	log.Debug("driver: GetFile", "path", path, "offset", offset)
 	if !driver.AllowFileUpload {
 		// TODO
 	}
@@ -178,18 +179,32 @@ func (driver *Driver) GetFile(context *server.Context, path string, offset int64
 	return info.Size() - offset, fInfo, nil
 }
 
-func (driver *Driver) PutFile(context *server.Context, destPath string, data io.Reader, filepos int64) (int64, error) {
-	if driver.Debug {
-		fmt.Printf("FTP: DRIVER: PutFile(destPath: %s, filepos: %v)\n", destPath, filepos)
+func (driver *Driver) PutFile(context *server.Context, destPath string, data io.Reader, filepos int64) (written int64, err error) {
+	log.Debug("driver: PutFile", "destPath", destPath, "filepos", filepos)
+
+	event := driver.createEvent(destPath)
+	if event.Camera == "" {
+		event.Camera = context.Sess.LoginUser()
 	}
+	event.SetMeta("remoteAddress", context.Sess.RemoteAddr().String())
 
-	go func() {
-		var event Event = driver.createEvent(destPath)
-		if event.CameraName == "" {
-			event.CameraName = context.Sess.LoginUser()
+	// COUNT UPLOADED BYTES, WHETHER FILE IS KEPT OR NOT
+	counter := &countingReader{reader: data}
+	data = counter
+	// RUNS AFTER FILE IS CLOSED, SO THAT WHOEVER READS ATTACHMENT GETS ALL OF IT
+	defer func() {
+		metrics.FtpUpload(context.Sess.LoginUser(), counter.count)
+		if err != nil {
+			// CAMERA STILL TRIED TO REPORT AN ALARM, THERE IS JUST NO FILE TO SHOW
+			event.Attachments = nil
 		}
-		// DISPATCH EVENT
-		driver.EventChannel <- event
+		go func() {
+			// DISPATCH EVENT, UNLESS SERVER IS SHUTTING DOWN
+			select {
+			case driver.EventChannel <- event:
+			case <-driver.Context.Done():
+			}
+		}()
 	}()
 
 	if !driver.AllowFileUpload { // JUST RETURN SUCCESSFUL UPLOAD
@@ -268,7 +283,18 @@ func (driver *Driver) PutFile(context *server.Context, destPath string, data io.
 	return bytesRead, nil
 }
 
-func NewDriver(debug bool, rootPath string, allowFileUpload bool, eventChannel chan<- Event) (server.Driver, error) {
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (counter *countingReader) Read(buffer []byte) (int, error) {
+	read, err := counter.reader.Read(buffer)
+	counter.count += int64(read)
+	return read, err
+}
+
+func NewDriver(ctx context.Context, rootPath string, allowFileUpload bool, eventChannel chan<- events.Event) (server.Driver, error) {
 	var err error
 	rootPath, err = filepath.Abs(rootPath)
 	if err != nil {
@@ -289,7 +315,7 @@ func NewDriver(debug bool, rootPath string, allowFileUpload bool, eventChannel c
 	}
 
 	return &Driver{
-		Debug:           debug,
+		Context:         ctx,
 		RootPath:        rootPath,
 		AllowFileUpload: allowFileUpload,
 		EventChannel:    eventChannel,
@@ -0,0 +1,27 @@
+package ftp
+
+import (
+	"fmt"
+)
+
+// sessionLogger sends FTP protocol chatter to debug log
+type sessionLogger struct{}
+
+func (logger *sessionLogger) Print(sessionID string, message interface{}) {
+	log.Debug(fmt.Sprint(message), "session", sessionID)
+}
+
+func (logger *sessionLogger) Printf(sessionID string, format string, v ...interface{}) {
+	log.Debug(fmt.Sprintf(format, v...), "session", sessionID)
+}
+
+func (logger *sessionLogger) PrintCommand(sessionID string, command string, params string) {
+	if command == "PASS" {
+		params = "****"
+	}
+	log.Debug("> "+command+" "+params, "session", sessionID)
+}
+
+func (logger *sessionLogger) PrintResponse(sessionID string, code int, message string) {
+	log.Debug(fmt.Sprintf("< %d %s", code, message), "session", sessionID)
+}
@@ -1,82 +1,150 @@
 package ftp
 
 import (
+	"context"
 	"fmt"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/logging"
+	"github.com/toxuin/alarmserver/servers"
 	"goftp.io/server/v2"
+	"net"
 	"sync"
+	"time"
 )
 
+var log = logging.For("ftp")
+
 type Server struct {
-	Debug          bool
-	WaitGroup      *sync.WaitGroup
+	servers.StatusHolder
 	Port           int
 	AllowFiles     bool
 	RootPath       string
 	Password       string
-	MessageHandler func(cameraName string, eventType string, extra string)
-}
-
-type Event struct {
-	CameraName string `json:"camera"`
-	Type       string `json:"type"`
-	Message    string `json:"message"`
+	AlarmEnd       bool
+	AlarmTimeout   time.Duration
+	MessageHandler events.Handler
+	alarmTimer     *events.AlarmTimer
+	sessions       sessionTracker
+	cancel         context.CancelFunc
+	waitGroup      sync.WaitGroup
 }
 
-func (serv *Server) Start() {
+func (serv *Server) Start(ctx context.Context) error {
 	if serv.MessageHandler == nil {
-		fmt.Println("FTP: Message handler is not set for FTP server - that's probably not what you want")
-		serv.MessageHandler = func(cameraName string, eventType string, extra string) {
-			fmt.Printf("FTP: Lost alarm: %s - %s: %s\n", cameraName, eventType, extra)
+		log.Warn("message handler is not set for FTP server - that's probably not what you want")
+		serv.MessageHandler = func(event events.Event) {
+			log.Warn("lost alarm", "camera", event.Camera, "event", event.Type, "message", event.Message)
 		}
 	}
 	// DEFAULT FTP PASSWORD
 	if serv.Password == "" {
 		serv.Password = "root"
 	}
+	if serv.AlarmEnd {
+		if serv.AlarmTimeout == 0 {
+			serv.AlarmTimeout = 30 * time.Second // DEFAULT ALARM TIMEOUT
+		}
+		serv.alarmTimer = &events.AlarmTimer{Timeout: serv.AlarmTimeout, Handler: serv.MessageHandler}
+	}
+	serv.SetStatus(servers.StateStarting, nil)
 
-	go func() {
-		defer serv.WaitGroup.Done()
-		serv.WaitGroup.Add(1)
+	ctx, cancel := context.WithCancel(ctx)
+	eventChannel := make(chan events.Event, 5)
 
-		eventChannel := make(chan Event, 5)
+	driver, err := NewDriver(ctx, serv.RootPath, serv.AllowFiles, eventChannel)
+	if err != nil {
+		log.Error("cannot init driver", "error", err)
+		cancel()
+		serv.SetStatus(servers.StateFailed, err)
+		return err
+	}
 
-		// START MESSAGE PROCESSOR
-		go func(channel <-chan Event) {
-			for {
-				event := <-channel
-				go serv.MessageHandler(event.CameraName, event.Type, event.Message)
-			}
-		}(eventChannel)
+	opt := &server.Options{
+		Name:           "alarmserver-go",
+		WelcomeMessage: "HI",
+		Driver:         driver,
+		Port:           serv.Port,
+		Perm:           server.NewSimplePerm("root", "root"),
+		Auth:           &DumbAuth{Password: serv.Password},
+		Logger:         &sessionLogger{},
+	}
 
-		driver, err := NewDriver(serv.Debug, serv.RootPath, serv.AllowFiles, eventChannel)
-		if err != nil {
-			fmt.Println("FTP: Cannot init driver")
-		}
+	ftpServer, err := server.NewServer(opt)
+	if err != nil {
+		log.Error("cannot start FTP server", "error", err)
+		cancel()
+		serv.SetStatus(servers.StateFailed, err)
+		return err
+	}
+	ftpServer.RegisterNotifer(&serv.sessions)
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", serv.Port))
+	if err != nil {
+		log.Error("cannot listen on port", "port", serv.Port, "error", err)
+		cancel()
+		serv.SetStatus(servers.StateFailed, err)
+		return err
+	}
+	serv.cancel = cancel
 
-		opt := &server.Options{
-			Name:           "alarmserver-go",
-			WelcomeMessage: "HI",
-			Driver:         driver,
-			Port:           serv.Port,
-			Perm:           server.NewSimplePerm("root", "root"),
-			Auth:           &DumbAuth{Debug: serv.Debug, Password: serv.Password},
+	// START MESSAGE PROCESSOR
+	serv.waitGroup.Add(1)
+	go func(channel <-chan events.Event) {
+		defer serv.waitGroup.Done()
+		// ONE AT A TIME, OR ALARM END COULD OVERTAKE ITS START
+		handle := func(event events.Event) {
+			if serv.alarmTimer != nil {
+				serv.alarmTimer.Touch(&event)
+			}
+			serv.MessageHandler(event)
 		}
-
-		if !serv.Debug {
-			opt.Logger = &server.DiscardLogger{}
+		for {
+			select {
+			case event := <-channel:
+				handle(event)
+			case <-ctx.Done():
+				// DRAIN IN-FLIGHT EVENTS
+				for len(channel) > 0 {
+					handle(<-channel)
+				}
+				return
+			}
 		}
+	}(eventChannel)
 
-		ftpServer, err := server.NewServer(opt)
-		if err != nil {
-			fmt.Println("FTP: Cannot start FTP server", err)
-			return
-		}
-		err = ftpServer.ListenAndServe()
-		if err != nil {
-			fmt.Println(fmt.Sprintf("FTP: Cannot listen on port %v", serv.Port), err)
-			return
+	serv.waitGroup.Add(1)
+	go func() {
+		defer serv.waitGroup.Done()
+		log.Info("listening", "port", serv.Port)
+		err := ftpServer.Serve(listener)
+		if err != nil && err != server.ErrServerClosed {
+			log.Error("server failed", "port", serv.Port, "error", err)
+			serv.SetStatus(servers.StateFailed, err)
 		}
-		defer ftpServer.Shutdown()
-		fmt.Printf("FTP: Listening on port %v", serv.Port)
 	}()
+
+	// SHUT DOWN FTP SERVER WHEN CONTEXT IS CANCELLED
+	context.AfterFunc(ctx, func() {
+		_ = ftpServer.Shutdown()
+	})
+
+	serv.SetStatus(servers.StateRunning, nil)
+	return nil
+}
+
+// Details lists recent FTP sessions
+func (serv *Server) Details() interface{} {
+	return map[string]interface{}{"sessions": serv.sessions.list()}
+}
+
+func (serv *Server) Stop() {
+	if serv.cancel == nil {
+		return
+	}
+	serv.cancel()
+	serv.waitGroup.Wait()
+	if serv.alarmTimer != nil {
+		serv.alarmTimer.Flush()
+	}
+	serv.cancel = nil
+	serv.SetStatus(servers.StateStopped, nil)
 }
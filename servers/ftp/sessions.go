@@ -0,0 +1,97 @@
+package ftp
+
+import (
+	"goftp.io/server/v2"
+	"sync"
+	"time"
+)
+
+const maxSessions = 50 // OLDEST SESSIONS ARE FORGOTTEN PAST THIS
+
+// Session is what admin API shows about an FTP client. FTP server does not tell when clients hang up,
+// so sessions are kept until newer ones push them out
+type Session struct {
+	RemoteAddress string    `json:"remoteAddress"`
+	User          string    `json:"user"`
+	LoggedIn      bool      `json:"loggedIn"`
+	Started       time.Time `json:"started"`
+	LastActivity  time.Time `json:"lastActivity"`
+	Uploads       int       `json:"uploads"`
+	Bytes         int64     `json:"bytes"`
+	LastFile      string    `json:"lastFile,omitempty"`
+}
+
+// sessionTracker is an FTP server notifier that remembers recent sessions by remote address
+type sessionTracker struct {
+	lock     sync.RWMutex
+	sessions []*Session // OLDEST FIRST
+}
+
+var _ server.Notifier = &sessionTracker{}
+
+func (tracker *sessionTracker) session(ctx *server.Context) *Session {
+	remoteAddress := ctx.Sess.RemoteAddr().String()
+	for _, session := range tracker.sessions {
+		if session.RemoteAddress == remoteAddress {
+			return session
+		}
+	}
+	session := &Session{RemoteAddress: remoteAddress, Started: time.Now()}
+	tracker.sessions = append(tracker.sessions, session)
+	if len(tracker.sessions) > maxSessions {
+		tracker.sessions = tracker.sessions[len(tracker.sessions)-maxSessions:]
+	}
+	return session
+}
+
+// list returns copies of sessions, newest first
+func (tracker *sessionTracker) list() []Session {
+	tracker.lock.RLock()
+	defer tracker.lock.RUnlock()
+	sessions := make([]Session, 0, len(tracker.sessions))
+	for i := len(tracker.sessions) - 1; i >= 0; i-- {
+		sessions = append(sessions, *tracker.sessions[i])
+	}
+	return sessions
+}
+
+func (tracker *sessionTracker) AfterUserLogin(ctx *server.Context, userName, password string, passMatched bool, err error) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	session := tracker.session(ctx)
+	session.User = userName
+	session.LoggedIn = passMatched && err == nil
+	session.LastActivity = time.Now()
+}
+
+func (tracker *sessionTracker) AfterFilePut(ctx *server.Context, dstPath string, size int64, err error) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	session := tracker.session(ctx)
+	session.LastActivity = time.Now()
+	if err != nil {
+		return
+	}
+	session.Uploads++
+	if size > 0 {
+		session.Bytes += size
+	}
+	session.LastFile = dstPath
+}
+
+// THE REST IS NOT INTERESTING
+
+func (tracker *sessionTracker) BeforeLoginUser(ctx *server.Context, userName string)                {}
+func (tracker *sessionTracker) BeforePutFile(ctx *server.Context, dstPath string)                   {}
+func (tracker *sessionTracker) BeforeDeleteFile(ctx *server.Context, dstPath string)                {}
+func (tracker *sessionTracker) BeforeChangeCurDir(ctx *server.Context, oldCurDir, newCurDir string) {}
+func (tracker *sessionTracker) BeforeCreateDir(ctx *server.Context, dstPath string)                 {}
+func (tracker *sessionTracker) BeforeDeleteDir(ctx *server.Context, dstPath string)                 {}
+func (tracker *sessionTracker) BeforeDownloadFile(ctx *server.Context, dstPath string)              {}
+func (tracker *sessionTracker) AfterFileDeleted(ctx *server.Context, dstPath string, err error)     {}
+func (tracker *sessionTracker) AfterFileDownloaded(ctx *server.Context, dstPath string, size int64, err error) {
+}
+func (tracker *sessionTracker) AfterCurDirChanged(ctx *server.Context, oldCurDir, newCurDir string, err error) {
+}
+func (tracker *sessionTracker) AfterDirCreated(ctx *server.Context, dstPath string, err error) {}
+func (tracker *sessionTracker) AfterDirDeleted(ctx *server.Context, dstPath string, err error) {}
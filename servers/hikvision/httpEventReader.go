@@ -1,23 +1,29 @@
 package hikvision
 
 import (
+	"context"
 	"encoding/xml"
-	"fmt"
 	"github.com/icholy/digest"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/servers"
 	"io"
-	"log"
 	"mime"
 	"mime/multipart"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 type HttpEventReader struct {
-	Debug  bool
-	client *http.Client
+	AlarmEnd    bool
+	IdleTimeout time.Duration
+	client      *http.Client
+	states      events.StateTracker
 }
 
-func (eventReader *HttpEventReader) ReadEvents(camera *HikCamera, channel chan<- HikEvent, callback func()) {
+func (eventReader *HttpEventReader) ReadEvents(ctx context.Context, camera *HikCamera, channel chan<- events.Event, onConnect func(), callback func()) {
+	logger := log.With("camera", camera.Name)
+	defer endAlarms(camera.Name, &eventReader.states, eventReader.AlarmEnd, channel)
 	if eventReader.client == nil {
 		eventReader.client = &http.Client{}
 		if camera.AuthMethod == Digest {
@@ -28,10 +34,18 @@ func (eventReader *HttpEventReader) ReadEvents(camera *HikCamera, channel chan<-
 		}
 	}
 
-	request, err := http.NewRequest("GET", camera.Url+"Event/notification/alertStream", nil)
+	// DROP THE STREAM IF CAMERA GOES QUIET, IT SENDS videoloss HEARTBEATS WHEN THERE ARE NO ALARMS
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchdog := servers.NewWatchdog(eventReader.IdleTimeout, func() {
+		logger.Warn("no events from camera, reconnecting...", "idleTimeout", eventReader.IdleTimeout)
+		cancel()
+	})
+	defer watchdog.Stop()
+
+	request, err := http.NewRequestWithContext(ctx, "GET", camera.Url+"Event/notification/alertStream", nil)
 	if err != nil {
-		fmt.Printf("HIK: Error: Could not connect to camera %s\n", camera.Name)
-		fmt.Println("HIK: Error", err)
+		logger.Error("could not connect to camera", "error", err)
 		callback()
 		return
 	}
@@ -41,27 +55,28 @@ func (eventReader *HttpEventReader) ReadEvents(camera *HikCamera, channel chan<-
 
 	response, err := eventReader.client.Do(request)
 	if err != nil {
-		fmt.Printf("HIK: Error opening HTTP connection to camera %s\n", camera.Name)
-		fmt.Println(err)
+		if ctx.Err() == nil {
+			logger.Error("error opening HTTP connection to camera", "error", err)
+		}
 		return
 	}
 
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
-		fmt.Printf("HIK: BAD STATUS %d", response.StatusCode)
+		// CAMERA MIGHT BE BUSY OR REBOOTING, RECONNECT LATER
+		logger.Warn("bad status from camera", "status", response.StatusCode)
+		return
 	}
-	defer response.Body.Close()
 
 	// FIGURE OUT MULTIPART BOUNDARY
 	mediaType, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
 	if mediaType != "multipart/mixed" || params["boundary"] == "" {
-		fmt.Println("HIK: ERROR: Camera " + camera.Name + " does not seem to support event streaming")
-		fmt.Println("            Is it a doorbell? Try adding rawTcp to its config!")
+		logger.Error("camera does not seem to support event streaming. Is it a doorbell? Try adding rawTcp to its config!")
 		callback()
 		return
 	}
 	multipartBoundary := params["boundary"]
-
-	xmlEvent := XmlEvent{}
+	onConnect()
 
 	// READ PART BY PART
 	multipartReader := multipart.NewReader(response.Body, multipartBoundary)
@@ -71,44 +86,34 @@ func (eventReader *HttpEventReader) ReadEvents(camera *HikCamera, channel chan<-
 			break
 		}
 		if err != nil {
-			fmt.Println(err)
-			continue
+			// STREAM IS BROKEN OR CLOSED, RECONNECT
+			if ctx.Err() == nil {
+				logger.Warn("event stream broken", "error", err)
+			}
+			break
 		}
+		watchdog.Kick()
 		contentLength, _ := strconv.Atoi(part.Header.Get("Content-Length"))
 		body := make([]byte, contentLength)
 		_, err = part.Read(body)
 		if err != nil {
-			fmt.Println(err)
+			logger.Warn("error reading event", "error", err)
 			continue
 		}
 
+		// EVERY PART IS A SEPARATE EVENT, ALARM STATE IS KEPT IN eventReader.states
+		xmlEvent := XmlEvent{}
 		err = xml.Unmarshal(body, &xmlEvent)
 		if err != nil {
-			fmt.Println(err)
+			logger.Warn("error unmarshalling xml event", "error", err)
 			continue
 		}
 
 		// FILL IN THE CAMERA INTO FRESHLY-UNMARSHALLED EVENT
 		xmlEvent.Camera = camera
 
-		if eventReader.Debug {
-			log.Printf("%s event: %s (%s - %d)", xmlEvent.Camera.Name, xmlEvent.Type, xmlEvent.State, xmlEvent.Id)
-		}
+		logger.Debug("camera event", "event", xmlEvent.Type, "state", xmlEvent.State, "id", xmlEvent.Id)
 
-		switch xmlEvent.State {
-		case "active":
-			if !xmlEvent.Active {
-				if eventReader.Debug {
-					fmt.Println("HIK: SENDING CAMERA EVENT!")
-				}
-				event := HikEvent{Camera: camera}
-				event.Type = xmlEvent.Type
-				event.Message = xmlEvent.Description
-				channel <- event
-			}
-			xmlEvent.Active = true
-		case "inactive":
-			xmlEvent.Active = false
-		}
+		processXmlEvent(&xmlEvent, string(body), &eventReader.states, eventReader.AlarmEnd, channel)
 	}
 }
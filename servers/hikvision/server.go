@@ -1,15 +1,23 @@
 package hikvision
 
 import (
+	"context"
 	"encoding/xml"
-	"fmt"
+	"errors"
 	"github.com/icholy/digest"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/logging"
+	"github.com/toxuin/alarmserver/retry"
+	"github.com/toxuin/alarmserver/servers"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+var log = logging.For("hikvision")
+
 type HttpAuthMethod int
 
 const (
@@ -27,17 +35,16 @@ type HikCamera struct {
 	AuthMethod  HttpAuthMethod
 }
 
-type HikEvent struct {
-	Type    string
-	Message string
-	Camera  *HikCamera
-}
-
 type Server struct {
-	Debug          bool
-	WaitGroup      *sync.WaitGroup
+	servers.StatusHolder
+	AlarmEnd       bool
+	Reconnect      retry.Policy
+	IdleTimeout    time.Duration
 	Cameras        *[]HikCamera
-	MessageHandler func(cameraName string, eventType string, extra string)
+	MessageHandler events.Handler
+	connections    servers.ConnectionTracker
+	cancel         context.CancelFunc
+	waitGroup      sync.WaitGroup
 }
 
 type XmlEvent struct {
@@ -50,51 +57,139 @@ type XmlEvent struct {
 	Type        string    `xml:"eventType"`
 	State       string    `xml:"eventState"`
 	Description string    `xml:"eventDescription"`
-	Active      bool
+	Regions     []int     `xml:"DetectionRegionList>DetectionRegionEntry>regionID"`
 	Camera      *HikCamera
 }
 
+// Cameras repeat "active" notifications for as long as alarm is on, and send "inactive" videoloss
+// heartbeats when nothing is happening. Alarms not repeated for this long are over once a heartbeat comes
+const alarmRepeatWindow = 3 * time.Second
+
 type HikEventReader interface {
-	ReadEvents(camera *HikCamera, channel chan<- HikEvent, callback func())
+	// ReadEvents reads camera's event stream until it breaks. It calls onConnect once the stream is open,
+	// and callback if there is no point in reconnecting
+	ReadEvents(ctx context.Context, camera *HikCamera, channel chan<- events.Event, onConnect func(), callback func())
 }
 
-func (server *Server) addCamera(waitGroup *sync.WaitGroup, camera *HikCamera, eventChannel chan<- HikEvent) {
-	waitGroup.Add(1)
-	if !camera.BrokenHttp {
-		camera.EventReader = &HttpEventReader{Debug: server.Debug}
-	} else {
-		camera.EventReader = &TcpEventReader{Debug: server.Debug}
+func (xmlEvent *XmlEvent) toEvent(raw string) events.Event {
+	event := events.Event{
+		Source:  events.SourceHikvision,
+		Camera:  xmlEvent.Camera.Name,
+		Type:    xmlEvent.Type,
+		State:   events.StateActive,
+		Time:    xmlEvent.Time,
+		Message: xmlEvent.Description,
+		Raw:     raw,
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if xmlEvent.ChannelId != 0 {
+		event.Channel = strconv.Itoa(xmlEvent.ChannelId)
+	}
+	event.SetMeta("ipAddress", xmlEvent.IpAddress)
+	if xmlEvent.Port != 0 {
+		event.SetMeta("port", strconv.Itoa(xmlEvent.Port))
+	}
+	event.SetMeta("activePostCount", strconv.Itoa(xmlEvent.Id))
+	if len(xmlEvent.Regions) > 0 {
+		regions := make([]string, len(xmlEvent.Regions))
+		for index, region := range xmlEvent.Regions {
+			regions[index] = strconv.Itoa(region)
+		}
+		event.SetMeta("region", strings.Join(regions, ","))
+	}
+	return event
+}
+
+// processXmlEvent sends an event when alarm starts and, if alarmEnd is set, when it ends.
+// Alarms are tracked separately per channel, event type and detection region
+func processXmlEvent(xmlEvent *XmlEvent, raw string, states *events.StateTracker, alarmEnd bool, channel chan<- events.Event) {
+	event := xmlEvent.toEvent(raw)
+	key := events.KeyOf(event)
+
+	switch xmlEvent.State {
+	case "active":
+		if states.Start(key) {
+			log.Debug("sending camera event", "camera", event.Camera, "event", event.Type, "channel", event.Channel)
+			channel <- event
+		}
+	case "inactive":
+		ended := make(map[events.Key]time.Duration)
+		if duration, wasActive := states.Stop(key); wasActive {
+			ended[key] = duration
+		} else {
+			ended = states.StopStale(event.Camera, time.Now().Add(-alarmRepeatWindow))
+		}
+		if !alarmEnd {
+			return
+		}
+		for endedKey, duration := range ended {
+			endEvent := event
+			endEvent.Metadata = nil
+			endEvent.Channel = endedKey.Channel
+			endEvent.Type = endedKey.Type
+			endEvent.State = events.StateInactive
+			endEvent.Message = string(events.StateInactive)
+			endEvent.Duration = duration.Seconds()
+			endEvent.SetMeta("ipAddress", xmlEvent.IpAddress)
+			endEvent.SetMeta("region", endedKey.Region)
+			channel <- endEvent
+		}
 	}
-	if server.Debug {
-		fmt.Printf("HIK: Adding camera %s: %s\n", camera.Name, camera.Url)
+}
+
+// endAlarms forgets alarms of camera that are still on, sending their end events if those are wanted.
+// Called when event stream is over, or alarms on at that moment would never end
+func endAlarms(camera string, states *events.StateTracker, alarmEnd bool, channel chan<- events.Event) {
+	for key, duration := range states.StopStale(camera, time.Now()) {
+		if !alarmEnd {
+			continue
+		}
+		endEvent := events.Event{
+			Source:   events.SourceHikvision,
+			Camera:   camera,
+			Channel:  key.Channel,
+			Type:     key.Type,
+			State:    events.StateInactive,
+			Time:     time.Now(),
+			Message:  string(events.StateInactive),
+			Duration: duration.Seconds(),
+		}
+		endEvent.SetMeta("region", key.Region)
+		channel <- endEvent
 	}
+}
+
+var errBadCredentials = errors.New("bad username or password")
 
-	// PROBE AUTH
+// probeAuth figures out which HTTP auth method camera wants. Returns errBadCredentials when camera rejects the password
+func (server *Server) probeAuth(ctx context.Context, camera *HikCamera) error {
+	logger := log.With("camera", camera.Name)
 	client := &http.Client{}
-	request, err := http.NewRequest("GET", camera.Url+"System/status", nil)
+	request, err := http.NewRequestWithContext(ctx, "GET", camera.Url+"System/status", nil)
 	if err != nil {
-		fmt.Printf("HIK: Error probing auth method for camera %s\n", camera.Name)
-		fmt.Println(err)
-		return
+		logger.Error("error probing auth method", "error", err)
+		return err
 	}
 	request.SetBasicAuth(camera.Username, camera.Password)
 	response, err := client.Do(request)
 	if err != nil {
-		fmt.Printf("HIK: Error probing HTTP Auth method for camera %s\n", camera.Name)
-		fmt.Println(err)
-		return
+		logger.Error("error probing HTTP auth method", "error", err)
+		return err
 	}
+	_ = response.Body.Close()
 	if response.StatusCode == 401 {
 		if response.Header.Get("WWW-Authenticate") == "" {
 			// BAD PASSWORD
-			fmt.Printf("HIK: UNKNOWN AUTH METHOD FOR CAMERA %s! SKIPPING...", camera.Name)
-			return
+			logger.Error("unknown auth method, skipping camera")
+			return errBadCredentials
 		}
 		authMethod := strings.Split(response.Header.Get("WWW-Authenticate"), " ")[0]
 		if authMethod == "Basic" {
 			// BAD PASSWORD
-			fmt.Printf("HIK: BAD PASSWORD FOR CAMERA %s! SKIPPING...", camera.Name)
-			return
+			logger.Error("bad password, skipping camera")
+			return errBadCredentials
 		}
 
 		// TRY ANOTHER TIME WITH DIGEST TRANSPORT
@@ -103,82 +198,150 @@ func (server *Server) addCamera(waitGroup *sync.WaitGroup, camera *HikCamera, ev
 			Password: camera.Password,
 		}
 		response, err := client.Do(request)
-		if err != nil || response.StatusCode == 401 {
-			if err != nil {
-				fmt.Println(err)
-			}
+		if err != nil {
+			logger.Error("error probing HTTP auth method", "error", err)
+			return err
+		}
+		_ = response.Body.Close()
+		if response.StatusCode == 401 {
 			// BAD PASSWORD
-			fmt.Printf("HIK: BAD PASSWORD FOR CAMERA %s! SKIPPING...", camera.Name)
-			return
+			logger.Error("bad password, skipping camera")
+			return errBadCredentials
 		}
 
 		camera.AuthMethod = Digest
-		if server.Debug {
-			fmt.Println("HIK: USING DIGEST AUTH")
-			if camera.BrokenHttp {
-				fmt.Println("HIK: WARNING: rawTCP CONFIG VALUE Digest AUTH COMBO IS NOT SUPPORTED!")
-				fmt.Println("    PLEASE OPEN A GITHUB ISSUE AT https://github.com/toxuin/alarmserver/issues")
-				fmt.Println("    AND INCLUDE YOUR CAMERA MODEL. THANK YOU!")
-			}
+		server.connections.SetAuthMethod(camera.Name, "digest")
+		logger.Debug("using digest auth")
+		if camera.BrokenHttp {
+			logger.Warn("rawTcp and digest auth combo is not supported! " +
+				"Please open a GitHub issue at https://github.com/toxuin/alarmserver/issues and include your camera model. Thank you!")
 		}
 	} else {
 		camera.AuthMethod = Basic
-		if server.Debug {
-			fmt.Println("HIK: USING BASIC AUTH")
-		}
+		server.connections.SetAuthMethod(camera.Name, "basic")
+		logger.Debug("using basic auth")
 	}
+	return nil
+}
 
+func (server *Server) addCamera(ctx context.Context, waitGroup *sync.WaitGroup, camera *HikCamera, eventChannel chan<- events.Event) {
+	if !camera.BrokenHttp {
+		camera.EventReader = &HttpEventReader{AlarmEnd: server.AlarmEnd, IdleTimeout: server.IdleTimeout}
+	} else {
+		camera.EventReader = &TcpEventReader{AlarmEnd: server.AlarmEnd, IdleTimeout: server.IdleTimeout}
+	}
+	log.Debug("adding camera", "camera", camera.Name, "url", camera.Url)
+	server.connections.Set(camera.Name, servers.ConnectionConnecting, nil)
+
+	waitGroup.Add(1)
 	go func() {
 		defer waitGroup.Done()
+		backoff := retry.Backoff{Policy: server.Reconnect}
+		authProbed := false
 		done := false
 		callback := func() {
 			done = true
 		}
+		onConnect := func() {
+			backoff.Reset()
+			server.connections.Set(camera.Name, servers.ConnectionOnline, nil)
+		}
+
+		authFailed := false
+		for !done && ctx.Err() == nil {
+			var err error
+			if !authProbed {
+				err = server.probeAuth(ctx, camera)
+				if errors.Is(err, errBadCredentials) {
+					authFailed = true
+					server.connections.Set(camera.Name, servers.ConnectionAuthFailed, err)
+					break
+				}
+				authProbed = err == nil
+			}
+			if authProbed {
+				camera.EventReader.ReadEvents(ctx, camera, eventChannel, onConnect, callback)
+			}
+			if done || ctx.Err() != nil {
+				break
+			}
 
-		for {
-			if done {
+			// WAIT BEFORE RECONNECTING
+			server.connections.Set(camera.Name, servers.ConnectionOffline, err)
+			if !backoff.Wait(ctx) {
+				if ctx.Err() == nil {
+					log.Error("giving up on camera", "camera", camera.Name, "attempts", backoff.Attempts())
+				}
 				break
 			}
-			camera.EventReader.ReadEvents(camera, eventChannel, callback)
+			server.connections.AddReconnect(camera.Name)
+		}
+		if !authFailed {
+			server.connections.Set(camera.Name, servers.ConnectionOffline, nil)
 		}
-		fmt.Printf("HIK: Closed connection to camera %s\n", camera.Name)
+		log.Info("closed connection to camera", "camera", camera.Name)
 	}()
 }
 
-func (server *Server) Start() {
+func (server *Server) Start(ctx context.Context) error {
 	if server.Cameras == nil || len(*server.Cameras) == 0 {
-		fmt.Println("HIK: Error: no cameras defined")
-		return
+		err := errors.New("no cameras defined")
+		server.SetStatus(servers.StateFailed, err)
+		return err
 	}
+	server.SetStatus(servers.StateStarting, nil)
 
 	if server.MessageHandler == nil {
-		fmt.Println("HIK: Message handler is not set for Hikvision cams - that's probably not what you want")
-		server.MessageHandler = func(cameraName string, eventType string, extra string) {
-			fmt.Printf("HIK: Lost alarm: %s - %s: %s\n", cameraName, eventType, extra)
+		log.Warn("message handler is not set for Hikvision cams - that's probably not what you want")
+		server.MessageHandler = func(event events.Event) {
+			log.Warn("lost alarm", "camera", event.Camera, "event", event.Type, "message", event.Message)
 		}
 	}
 
+	ctx, server.cancel = context.WithCancel(ctx)
+	server.connections.Logger = log
+	server.connections.Source = events.SourceHikvision
+	server.connections.Handler = server.MessageHandler
 	cameraWaitGroup := sync.WaitGroup{}
-	eventChannel := make(chan HikEvent, 5)
+	eventChannel := make(chan events.Event, 5)
 
 	// START ALL CAMERA LISTENERS
-	for _, camera := range *server.Cameras {
-		server.addCamera(&cameraWaitGroup, &camera, eventChannel)
+	for index := range *server.Cameras {
+		server.addCamera(ctx, &cameraWaitGroup, &(*server.Cameras)[index], eventChannel)
 	}
 
-	// START MESSAGE PROCESSOR
-	go func(camWaitGroup *sync.WaitGroup, channel <-chan HikEvent) {
-		// WAIT GROUP FOR INDIVIDUAL CAMERAS
-		defer camWaitGroup.Done()
+	// CLOSE EVENT CHANNEL ONCE ALL CAMERAS ARE DONE
+	go func() {
+		cameraWaitGroup.Wait()
+		close(eventChannel)
+	}()
 
-		// EXTERNAL WAIT GROUP FOR PROCESSES
-		defer server.WaitGroup.Done()
-		server.WaitGroup.Add(1)
-		for {
-			event := <-channel
-			go server.MessageHandler(event.Camera.Name, event.Type, event.Message)
+	// START MESSAGE PROCESSOR
+	server.waitGroup.Add(1)
+	go func(channel <-chan events.Event) {
+		defer server.waitGroup.Done()
+		// ONE AT A TIME, OR ALARM END COULD OVERTAKE ITS START
+		for event := range channel {
+			server.MessageHandler(event)
 		}
-	}(&cameraWaitGroup, eventChannel)
+	}(eventChannel)
+
+	server.SetStatus(servers.StateRunning, nil)
+	return nil
+}
 
-	cameraWaitGroup.Wait()
+func (server *Server) Status() servers.Status {
+	status := server.StatusHolder.Status()
+	status.Cameras = server.connections.List()
+	return status
+}
+
+func (server *Server) Stop() {
+	if server.cancel == nil {
+		return
+	}
+	server.cancel()
+	server.waitGroup.Wait()
+	server.cancel = nil
+	server.SetStatus(servers.StateStopped, nil)
 }
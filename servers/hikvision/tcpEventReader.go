@@ -1,174 +1,178 @@
 package hikvision
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/xml"
-	"fmt"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/servers"
 	"io"
-	"log"
+	"net"
 	"net/textproto"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type TcpEventReader struct {
-	Debug bool
+	AlarmEnd    bool
+	IdleTimeout time.Duration
+	states      events.StateTracker
 }
 
-func (eventReader *TcpEventReader) ReadEvents(camera *HikCamera, channel chan<- HikEvent, callback func()) {
+func (eventReader *TcpEventReader) ReadEvents(ctx context.Context, camera *HikCamera, channel chan<- events.Event, onConnect func(), callback func()) {
+	logger := log.With("camera", camera.Name, "rawTcp", true)
+	defer endAlarms(camera.Name, &eventReader.states, eventReader.AlarmEnd, channel)
+
 	// PARSE THE ADDRESS OUTTA CAMERA URL
 	cameraUrl, err := url.Parse(camera.Url)
 	if err != nil {
-		fmt.Printf("HIK-TCP: Error parsing address of camera %s: %s\n", camera.Name, camera.Url)
+		logger.Error("error parsing camera address", "url", camera.Url, "error", err)
 		callback()
 		return
 	}
 
 	if cameraUrl.Scheme == "https:" {
-		fmt.Printf("HIK-TCP: Cannot read events for camera %s: HTTPS support is not implemented\n", camera.Name)
+		logger.Error("cannot read events: HTTPS support is not implemented")
 		callback()
 		return
 	}
 
-	for {
-		var address, host string
-		if strings.Contains(cameraUrl.Host, ":") {
-			address = cameraUrl.Host
-			host = strings.Split(cameraUrl.Host, ":")[1]
-		} else {
-			address = cameraUrl.Host + ":80"
-			host = cameraUrl.Host
-		}
+	var address, host string
+	if strings.Contains(cameraUrl.Host, ":") {
+		address = cameraUrl.Host
+		host = strings.Split(cameraUrl.Host, ":")[1]
+	} else {
+		address = cameraUrl.Host + ":80"
+		host = cameraUrl.Host
+	}
 
-		// BASE64-ENCODED VALUE FOR BASIC HTTP AUTH HEADER
-		basicAuth := base64.StdEncoding.EncodeToString([]byte(camera.Username + ":" + camera.Password))
+	// BASE64-ENCODED VALUE FOR BASIC HTTP AUTH HEADER
+	basicAuth := base64.StdEncoding.EncodeToString([]byte(camera.Username + ":" + camera.Password))
 
-		textConn, err := textproto.Dial("tcp", address)
-		if err != nil {
-			fmt.Printf("HIK: Error opening TCP connection to camera %s\n", camera.Name)
-			break
+	// DROP THE STREAM IF CAMERA GOES QUIET, IT SENDS videoloss HEARTBEATS WHEN THERE ARE NO ALARMS
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchdog := servers.NewWatchdog(eventReader.IdleTimeout, func() {
+		logger.Warn("no events from camera, reconnecting...", "idleTimeout", eventReader.IdleTimeout)
+		cancel()
+	})
+	defer watchdog.Stop()
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Error("error opening TCP connection to camera", "error", err)
 		}
+		return
+	}
+	textConn := textproto.NewConn(conn)
+
+	// CLOSE CONNECTION WHEN CONTEXT IS CANCELLED
+	stopClosing := context.AfterFunc(ctx, func() {
+		_ = textConn.Close()
+	})
+	defer stopClosing()
+	defer textConn.Close()
+
+	// SEND INITIAL REQUEST
+	err = textConn.PrintfLine("GET /ISAPI/Event/notification/alertStream HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Authorization: Basic %s\r\n\r\n\r\n",
+		host,
+		basicAuth,
+	)
+	if err != nil {
+		logger.Error("error sending auth request", "error", err)
+		return
+	}
 
-		// SEND INITIAL REQUEST
-		err = textConn.PrintfLine("GET /ISAPI/Event/notification/alertStream HTTP/1.1\r\n"+
-			"Host: %s\r\n"+
-			"Authorization: Basic %s\r\n\r\n\r\n",
-			host,
-			basicAuth,
-		)
-		if err != nil {
-			fmt.Println("HIK-TCP: Error sending auth request")
-			fmt.Println(err)
+	// READ AND PARSE HTTP STATUS
+	httpStatusLine, err := textConn.ReadLine()
+	if err != nil {
+		logger.Error("could not get status header", "error", err)
+		return
+	}
+	if !strings.Contains(httpStatusLine, "HTTP/1.1") {
+		logger.Error("bad response from camera", "status", httpStatusLine)
+		return
+	}
+	statusParts := strings.SplitN(strings.Split(httpStatusLine, "HTTP/1.1 ")[1], " ", 2)
+	statusCode := statusParts[0]
+	statusMessage := statusParts[1]
+
+	// READ HTTP HEADERS
+	var headers = make(map[string]string)
+	for {
+		headerLine, err := textConn.ReadLine()
+		if err == io.EOF {
+			// CONNECTION CLOSED
+			return
+		}
+		if strings.Trim(headerLine, " ") == "" {
+			// END OF HEADERS
 			break
 		}
 
-		// READ AND PARSE HTTP STATUS
-		httpStatusLine, err := textConn.ReadLine()
+		headerKey := strings.SplitN(headerLine, ": ", 2)[0]
+		headerValue := strings.SplitN(headerLine, ": ", 2)[1]
+		headers[headerKey] = headerValue
+	}
+	logger.Debug("response headers", "headers", headers)
+
+	// PRINT ERROR
+	if statusCode != "200" {
+		contentLen, err := strconv.Atoi(headers["Content-Length"])
 		if err != nil {
-			fmt.Println("HIK-TCP: Could not get status header")
-			fmt.Println(err)
-			return
-		}
-		if !strings.Contains(httpStatusLine, "HTTP/1.1") {
-			fmt.Printf("HIK-TCP: Bad response from camera %s: %s", camera.Name, httpStatusLine)
+			logger.Error("error reading error message, dammit", "status", statusCode)
 			return
 		}
-		statusParts := strings.SplitN(strings.Split(httpStatusLine, "HTTP/1.1 ")[1], " ", 2)
-		statusCode := statusParts[0]
-		statusMessage := statusParts[1]
-
-		// READ HTTP HEADERS
-		var headers = make(map[string]string)
-		for {
-			headerLine, err := textConn.ReadLine()
-			if err == io.EOF {
-				// CONNECTION CLOSED
-				return
-			}
-			if strings.Trim(headerLine, " ") == "" {
-				// END OF HEADERS
-				break
-			}
+		errorBody := make([]byte, contentLen)
+		_, _ = io.ReadFull(textConn.R, errorBody)
+		logger.Error("HTTP error authenticating with camera", "status", statusCode, "message", statusMessage, "body", string(errorBody))
+		return
+	}
 
-			if eventReader.Debug {
-				fmt.Println("  " + headerLine)
-			}
+	onConnect()
 
-			headerKey := strings.SplitN(headerLine, ": ", 2)[0]
-			headerValue := strings.SplitN(headerLine, ": ", 2)[1]
-			headers[headerKey] = headerValue
-		}
-		if eventReader.Debug {
-			fmt.Println("HIK-TCP: HEADERS:")
-			fmt.Println(headers)
+	// READ ACTUAL EVENTS
+	var eventString string
+	for {
+		line, err := textConn.ReadLine()
+		if err == io.EOF { // CONNECTION CLOSED
+			return
 		}
-
-		// PRINT ERROR
-		if statusCode != "200" {
-			contentLen, err := strconv.Atoi(headers["Content-Length"])
-			if err != nil {
-				fmt.Println("HIK-TCP: Error reading error message, dammit")
-				return
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Warn("error reading from connection", "error", err)
 			}
-			errorBody := make([]byte, contentLen)
-			_, _ = io.ReadFull(textConn.R, errorBody)
-			fmt.Printf("HIK-TCP: HTTP Error authenticating with camera %s: %s - %s\n", camera.Name, statusCode, statusMessage)
-			fmt.Println(string(errorBody))
 			return
 		}
+		watchdog.Kick()
 
-		// READ ACTUAL EVENTS
-		var eventString string
-		xmlEvent := XmlEvent{}
-		for {
-			line, err := textConn.ReadLine()
-			if err == io.EOF { // CONNECTION CLOSED
-				return
+		if strings.Trim(line, " ") == "" {
+			// FOUND END OF ONE EVENT IN STREAM
+			if strings.Contains(eventString, ">HTTP/1.1 ") {
+				// PART OF THE LAST PACKET IS STUCK TO THE NEXT PACKET
+				eventString = strings.SplitN(eventString, "HTTP/1.1", 2)[0]
 			}
+
+			xmlEvent := XmlEvent{}
+			err = xml.Unmarshal([]byte(eventString), &xmlEvent)
+			xmlEvent.Camera = camera
 			if err != nil {
-				fmt.Println("ERROR READING FROM CONNECTION")
-				fmt.Println(err)
-				break
+				logger.Warn("error unmarshalling xml event", "error", err)
+				continue
 			}
+			logger.Debug("camera event", "event", xmlEvent.Type, "state", xmlEvent.State, "id", xmlEvent.Id, "description", xmlEvent.Description)
 
-			if strings.Trim(line, " ") == "" {
-				// FOUND END OF ONE EVENT IN STREAM
-				if strings.Contains(eventString, ">HTTP/1.1 ") {
-					// PART OF THE LAST PACKET IS STUCK TO THE NEXT PACKET
-					eventString = strings.SplitN(eventString, "HTTP/1.1", 2)[0]
-				}
-
-				err = xml.Unmarshal([]byte(eventString), &xmlEvent)
-				xmlEvent.Camera = camera
-				if err != nil {
-					fmt.Println("HIK-TCP: Error unmarshalling xml event!")
-					continue
-				}
-				if eventReader.Debug {
-					log.Printf("%s event: %s (%s - %d), %s", xmlEvent.Camera.Name, xmlEvent.Type, xmlEvent.State, xmlEvent.Id, xmlEvent.Description)
-				}
-
-				switch xmlEvent.State {
-				case "active":
-					if !xmlEvent.Active {
-						if eventReader.Debug {
-							fmt.Println("HIK-TCP: SENDING CAMERA EVENT!")
-						}
-						event := HikEvent{Camera: camera}
-						event.Type = xmlEvent.Type
-						event.Message = xmlEvent.Description
-						channel <- event
-					}
-					xmlEvent.Active = true
-				case "inactive":
-					xmlEvent.Active = false
-				}
-
-				eventString = ""
-			} else {
-				eventString += line
-			}
+			processXmlEvent(&xmlEvent, eventString, &eventReader.states, eventReader.AlarmEnd, channel)
+
+			eventString = ""
+		} else {
+			eventString += line
 		}
 	}
 }
@@ -0,0 +1,58 @@
+package hisilicon
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Device is a HiSilicon camera that has sent at least one alarm. These cameras dial in, so there is no connection to track
+type Device struct {
+	SerialID      string    `json:"serialId"`
+	IpAddress     string    `json:"ipAddress,omitempty"`
+	RemoteAddress string    `json:"remoteAddress"`
+	FirstSeen     time.Time `json:"firstSeen"`
+	LastSeen      time.Time `json:"lastSeen"`
+	LastEvent     string    `json:"lastEvent"`
+	Events        int       `json:"events"`
+}
+
+type deviceTracker struct {
+	lock    sync.RWMutex
+	devices map[string]*Device
+}
+
+func (tracker *deviceTracker) seen(serialID string, ipAddress string, remoteAddress string, eventType string) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if tracker.devices == nil {
+		tracker.devices = make(map[string]*Device)
+	}
+	now := time.Now()
+	device, exists := tracker.devices[serialID]
+	if !exists {
+		device = &Device{SerialID: serialID, FirstSeen: now}
+		tracker.devices[serialID] = device
+	}
+	if ipAddress != "" {
+		device.IpAddress = ipAddress
+	}
+	device.RemoteAddress = remoteAddress
+	device.LastSeen = now
+	device.LastEvent = eventType
+	device.Events++
+}
+
+// list returns copies of devices sorted by serial ID
+func (tracker *deviceTracker) list() []Device {
+	tracker.lock.RLock()
+	defer tracker.lock.RUnlock()
+	devices := make([]Device, 0, len(tracker.devices))
+	for _, device := range tracker.devices {
+		devices = append(devices, *device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].SerialID < devices[j].SerialID
+	})
+	return devices
+}
@@ -2,15 +2,23 @@ package hisilicon
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/logging"
+	"github.com/toxuin/alarmserver/servers"
 	"io"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+var log = logging.For("hisilicon")
+
 // Converts 0x1704A8C0 to 192.168.4.23
 func hexIpToCIDR(hexAddr string) string {
 	hexAddrStr := fmt.Sprintf("%v", hexAddr)[2:]
@@ -37,42 +45,55 @@ func hexIpToCIDR(hexAddr string) string {
 	return ipAddr
 }
 
+const shutdownGracePeriod = 1 * time.Second
+
 type Server struct {
-	Debug          bool
-	WaitGroup      *sync.WaitGroup
+	servers.StatusHolder
 	Port           string
-	MessageHandler func(cameraName string, eventType string, extra string)
+	AlarmEnd       bool
+	AlarmTimeout   time.Duration
+	MessageHandler events.Handler
+	alarmTimer     *events.AlarmTimer
+	devices        deviceTracker
+	cancel         context.CancelFunc
+	waitGroup      sync.WaitGroup
 }
 
-func (server *Server) handleTcpConnection(conn net.Conn) {
+func (server *Server) handleTcpConnection(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 
-	if server.Debug {
-		fmt.Printf("HISI: DEVICE CONNECTED: %s\n", conn.RemoteAddr().String())
-	}
+	// ON SHUTDOWN, GIVE DEVICE A MOMENT TO FINISH SENDING INSTEAD OF WAITING FOR IT TO HANG UP
+	stopDeadline := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now().Add(shutdownGracePeriod))
+	})
+	defer stopDeadline()
+
+	logger := log.With("remoteAddress", conn.RemoteAddr().String())
+	logger.Debug("device connected")
 	var buf bytes.Buffer
 
 	_, err := io.Copy(&buf, conn)
 	if err != nil {
-		fmt.Printf("HISI: TCP READ ERROR: %s\n", err)
-		return
+		var netErr net.Error
+		if ctx.Err() == nil || !errors.As(err, &netErr) || !netErr.Timeout() || buf.Len() == 0 {
+			logger.Error("TCP read error", "error", err)
+			return
+		}
 	}
 	bufString := buf.String()
 	resultString := bufString[strings.IndexByte(bufString, '{'):]
-	if server.Debug {
-		fmt.Printf("HISI: DEVICE ALERT: %s\n", resultString)
-	}
+	logger.Debug("device alert", "alert", resultString)
 
 	var dataMap map[string]interface{}
 
 	if err := json.Unmarshal([]byte(resultString), &dataMap); err != nil {
-		fmt.Printf("HISI: JSON PARSE ERROR: %s\n", err)
+		logger.Error("JSON parse error", "error", err)
 		return
 	}
 	if dataMap["Address"] != nil {
 		hexAddrStr := fmt.Sprintf("%v", dataMap["Address"])
 		if len(hexAddrStr) < 2 {
-			fmt.Printf("HISI: BAD DEVICE ADDRESS: %s\n", hexAddrStr)
+			logger.Error("bad device address", "address", hexAddrStr)
 			return
 		}
 		dataMap["ipAddr"] = hexIpToCIDR(hexAddrStr)
@@ -80,50 +101,118 @@ func (server *Server) handleTcpConnection(conn net.Conn) {
 
 	jsonBytes, err := json.Marshal(dataMap)
 	if err != nil {
-		fmt.Printf("HISI: JSON STRINGIFY ERROR: %s\n", err)
+		logger.Error("JSON stringify error", "error", err)
 		return
 	}
 
 	if dataMap["SerialID"] == nil {
-		fmt.Println("HISI: UNKNOWN DEVICE SERIAL ID")
-		fmt.Println(dataMap)
+		logger.Error("unknown device serial ID", "alert", resultString)
 		return
 	}
 
-	serialId := fmt.Sprintf("%v", dataMap["SerialID"])
-	event := fmt.Sprintf("%v", dataMap["Event"])
+	event := events.Event{
+		Source:  events.SourceHisilicon,
+		Camera:  fmt.Sprintf("%v", dataMap["SerialID"]),
+		Type:    fmt.Sprintf("%v", dataMap["Event"]),
+		State:   events.StateActive,
+		Time:    time.Now(),
+		Message: string(jsonBytes),
+		Raw:     resultString,
+	}
+	if dataMap["Channel"] != nil {
+		event.Channel = fmt.Sprintf("%v", dataMap["Channel"])
+	}
+	if dataMap["Status"] == "Stop" {
+		event.State = events.StateInactive
+	}
+	if dataMap["ipAddr"] != nil {
+		event.SetMeta("ipAddress", fmt.Sprintf("%v", dataMap["ipAddr"]))
+	}
+	if dataMap["Descrip"] != nil {
+		event.SetMeta("description", fmt.Sprintf("%v", dataMap["Descrip"]))
+	}
+	if dataMap["Type"] != nil {
+		event.SetMeta("type", fmt.Sprintf("%v", dataMap["Type"]))
+	}
+	event.SetMeta("remoteAddress", conn.RemoteAddr().String())
+	server.devices.seen(event.Camera, event.Metadata["ipAddress"], conn.RemoteAddr().String(), event.Type)
+
+	if server.alarmTimer != nil {
+		server.alarmTimer.Touch(&event)
+	}
+	server.MessageHandler(event)
+}
 
-	server.MessageHandler(serialId, event, string(jsonBytes))
+// Details lists devices that sent alarms since alarm server started
+func (server *Server) Details() interface{} {
+	return map[string]interface{}{"devices": server.devices.list()}
 }
 
-func (server *Server) Start() {
+func (server *Server) Start(ctx context.Context) error {
 	if server.Port == "" {
 		server.Port = "15002" // DEFAULT PORT
 	}
 	if server.MessageHandler == nil {
-		fmt.Println("HISI: Message handler is not set for HiSilicon cams - that's probably not what you want")
-		server.MessageHandler = func(cameraName string, eventType string, extra string) {
-			fmt.Printf("HISI: Lost alarm: %s - %s: %s\n", cameraName, eventType, extra)
+		log.Warn("message handler is not set for HiSilicon cams - that's probably not what you want")
+		server.MessageHandler = func(event events.Event) {
+			log.Warn("lost alarm", "camera", event.Camera, "event", event.Type, "message", event.Message)
+		}
+	}
+	if server.AlarmEnd {
+		if server.AlarmTimeout == 0 {
+			server.AlarmTimeout = 30 * time.Second // DEFAULT ALARM TIMEOUT
 		}
+		server.alarmTimer = &events.AlarmTimer{Timeout: server.AlarmTimeout, Handler: server.MessageHandler}
 	}
+	server.SetStatus(servers.StateStarting, nil)
 
-	go func() {
-		defer server.WaitGroup.Done()
-		server.WaitGroup.Add(1)
+	// START TCP SERVER
+	tcpListener, err := net.Listen("tcp4", ":"+server.Port)
+	if err != nil {
+		server.SetStatus(servers.StateFailed, err)
+		return err
+	}
+	ctx, server.cancel = context.WithCancel(ctx)
 
-		// START TCP SERVER
-		tcpListener, err := net.Listen("tcp4", ":"+server.Port)
-		if err != nil {
-			panic(err)
-		}
-		defer tcpListener.Close()
+	// STOP ACCEPTING CONNECTIONS WHEN CONTEXT IS CANCELLED
+	context.AfterFunc(ctx, func() {
+		_ = tcpListener.Close()
+	})
 
+	server.waitGroup.Add(1)
+	go func() {
+		defer server.waitGroup.Done()
 		for {
 			conn, err := tcpListener.Accept()
 			if err != nil {
-				panic(err)
+				if ctx.Err() != nil {
+					return
+				}
+				log.Error("TCP accept error", "error", err)
+				server.SetStatus(servers.StateFailed, err)
+				return
 			}
-			go server.handleTcpConnection(conn)
+			server.waitGroup.Add(1)
+			go func() {
+				defer server.waitGroup.Done()
+				server.handleTcpConnection(ctx, conn)
+			}()
 		}
 	}()
+
+	server.SetStatus(servers.StateRunning, nil)
+	return nil
+}
+
+func (server *Server) Stop() {
+	if server.cancel == nil {
+		return
+	}
+	server.cancel()
+	server.waitGroup.Wait()
+	if server.alarmTimer != nil {
+		server.alarmTimer.Flush()
+	}
+	server.cancel = nil
+	server.SetStatus(servers.StateStopped, nil)
 }
@@ -0,0 +1,60 @@
+package servers
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type State string
+
+const (
+	StateStopped  State = "stopped"
+	StateStarting State = "starting"
+	StateRunning  State = "running"
+	StateFailed   State = "failed"
+)
+
+type Status struct {
+	State   State          `json:"state"`
+	Since   time.Time      `json:"since"`
+	Error   string         `json:"error,omitempty"`
+	Cameras []CameraStatus `json:"cameras,omitempty"`
+}
+
+// Source is an alarm server that produces events until its context is cancelled or it is stopped
+type Source interface {
+	Start(ctx context.Context) error
+	Stop()
+	Status() Status
+}
+
+// Inspector is implemented by sources that know more about what connects to them than Status tells,
+// like devices seen or FTP sessions. Details must be safe to marshal to JSON
+type Inspector interface {
+	Details() interface{}
+}
+
+// StatusHolder is meant to be embedded into sources to give them thread-safe Status()
+type StatusHolder struct {
+	lock   sync.RWMutex
+	status Status
+}
+
+func (holder *StatusHolder) SetStatus(state State, err error) {
+	holder.lock.Lock()
+	defer holder.lock.Unlock()
+	holder.status = Status{State: state, Since: time.Now()}
+	if err != nil {
+		holder.status.Error = err.Error()
+	}
+}
+
+func (holder *StatusHolder) Status() Status {
+	holder.lock.RLock()
+	defer holder.lock.RUnlock()
+	if holder.status.State == "" {
+		return Status{State: StateStopped}
+	}
+	return holder.status
+}
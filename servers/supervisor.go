@@ -0,0 +1,195 @@
+package servers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/toxuin/alarmserver/logging"
+	"sync"
+)
+
+var log = logging.For("supervisor")
+
+var ErrAlreadyStarted = errors.New("already started")
+
+type namedSource struct {
+	name    string
+	source  Source
+	running bool // SET BEFORE SOURCE STARTS, SO THAT NOTHING ELSE STARTS IT MEANWHILE
+}
+
+// Supervisor starts, stops and restarts all configured sources uniformly
+type Supervisor struct {
+	lock    sync.Mutex
+	ctx     context.Context
+	sources []*namedSource
+}
+
+func (supervisor *Supervisor) Add(name string, source Source) {
+	supervisor.lock.Lock()
+	defer supervisor.lock.Unlock()
+	supervisor.sources = append(supervisor.sources, &namedSource{name: name, source: source})
+}
+
+func (supervisor *Supervisor) find(name string) *namedSource {
+	for _, item := range supervisor.sources {
+		if item.name == name {
+			return item
+		}
+	}
+	return nil
+}
+
+// Get returns source added under name, nil if there is none
+func (supervisor *Supervisor) Get(name string) Source {
+	supervisor.lock.Lock()
+	defer supervisor.lock.Unlock()
+	if item := supervisor.find(name); item != nil {
+		return item.source
+	}
+	return nil
+}
+
+// start starts source of item, unless it is running already or was replaced in the meantime
+func (supervisor *Supervisor) start(ctx context.Context, item *namedSource) error {
+	supervisor.lock.Lock()
+	if item.running {
+		supervisor.lock.Unlock()
+		return fmt.Errorf("%s: %w", item.name, ErrAlreadyStarted)
+	}
+	if supervisor.find(item.name) != item {
+		supervisor.lock.Unlock()
+		return fmt.Errorf("%s was replaced", item.name)
+	}
+	item.running = true
+	supervisor.lock.Unlock()
+
+	if err := item.source.Start(ctx); err != nil {
+		supervisor.lock.Lock()
+		item.running = false
+		supervisor.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// stop stops source of item. Sources that did not start are stopped too, they might have got halfway
+func (supervisor *Supervisor) stop(item *namedSource) {
+	item.source.Stop()
+	supervisor.lock.Lock()
+	item.running = false
+	supervisor.lock.Unlock()
+}
+
+// StartAll starts every source with given context. Sources that fail to start are reported and skipped
+func (supervisor *Supervisor) StartAll(ctx context.Context) {
+	supervisor.lock.Lock()
+	supervisor.ctx = ctx
+	sources := append([]*namedSource{}, supervisor.sources...)
+	supervisor.lock.Unlock()
+
+	for _, item := range sources {
+		if err := supervisor.start(ctx, item); err != nil {
+			log.Error("error starting server", "server", item.name, "error", err)
+			continue
+		}
+		log.Debug("started server", "server", item.name)
+	}
+}
+
+// StopAll stops sources in reverse order and waits for their in-flight events to be handled, until ctx is done
+func (supervisor *Supervisor) StopAll(ctx context.Context) {
+	supervisor.lock.Lock()
+	sources := append([]*namedSource{}, supervisor.sources...)
+	supervisor.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := len(sources) - 1; i >= 0; i-- {
+			supervisor.stop(sources[i])
+			log.Debug("stopped server", "server", sources[i].name)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn("shutdown deadline reached before all servers stopped")
+	}
+}
+
+func (supervisor *Supervisor) Stop(name string) error {
+	supervisor.lock.Lock()
+	item := supervisor.find(name)
+	supervisor.lock.Unlock()
+	if item == nil {
+		return fmt.Errorf("unknown server %s", name)
+	}
+	supervisor.stop(item)
+	return nil
+}
+
+func (supervisor *Supervisor) Restart(name string) error {
+	supervisor.lock.Lock()
+	item := supervisor.find(name)
+	ctx := supervisor.ctx
+	supervisor.lock.Unlock()
+	if item == nil {
+		return fmt.Errorf("unknown server %s", name)
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	supervisor.stop(item)
+	return supervisor.start(ctx, item)
+}
+
+// Replace stops source added under name and puts source in its place, started if supervisor is running.
+// Nil source just removes it, unknown name adds it
+func (supervisor *Supervisor) Replace(name string, source Source) error {
+	supervisor.lock.Lock()
+	old := supervisor.find(name)
+	ctx := supervisor.ctx
+	var replacement *namedSource
+	if source != nil {
+		replacement = &namedSource{name: name, source: source}
+	}
+	// REPLACED SOURCE KEEPS ITS PLACE IN START AND STOP ORDER
+	sources := make([]*namedSource, 0, len(supervisor.sources)+1)
+	for _, item := range supervisor.sources {
+		if item != old {
+			sources = append(sources, item)
+		} else if replacement != nil {
+			sources = append(sources, replacement)
+		}
+	}
+	if old == nil && replacement != nil {
+		sources = append(sources, replacement)
+	}
+	supervisor.sources = sources
+	supervisor.lock.Unlock()
+
+	if old != nil {
+		supervisor.stop(old)
+		log.Debug("stopped server", "server", name)
+	}
+	if replacement == nil || ctx == nil {
+		return nil
+	}
+	if err := supervisor.start(ctx, replacement); err != nil {
+		return fmt.Errorf("error starting %s: %w", name, err)
+	}
+	log.Debug("started server", "server", name)
+	return nil
+}
+
+func (supervisor *Supervisor) Statuses() map[string]Status {
+	supervisor.lock.Lock()
+	defer supervisor.lock.Unlock()
+	statuses := make(map[string]Status, len(supervisor.sources))
+	for _, item := range supervisor.sources {
+		statuses[item.name] = item.source.Status()
+	}
+	return statuses
+}
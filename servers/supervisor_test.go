@@ -0,0 +1,87 @@
+package servers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// countingSource counts how many times it runs at once
+type countingSource struct {
+	lock    sync.Mutex
+	running int
+	starts  int
+}
+
+func (source *countingSource) Start(ctx context.Context) error {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	source.running++
+	source.starts++
+	return nil
+}
+
+func (source *countingSource) Stop() {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	if source.running > 0 {
+		source.running--
+	}
+}
+
+func (source *countingSource) Status() Status {
+	return Status{}
+}
+
+func TestSupervisorStartsSourceOnce(t *testing.T) {
+	source := &countingSource{}
+	supervisor := &Supervisor{}
+	supervisor.Add("test", source)
+
+	supervisor.StartAll(context.Background())
+	supervisor.StartAll(context.Background())
+	if source.running != 1 {
+		t.Fatalf("source runs %d times, want once", source.running)
+	}
+	if err := supervisor.start(context.Background(), supervisor.find("test")); !errors.Is(err, ErrAlreadyStarted) {
+		t.Errorf("second start returned %v, want ErrAlreadyStarted", err)
+	}
+
+	if err := supervisor.Restart("test"); err != nil {
+		t.Fatal(err)
+	}
+	if source.running != 1 || source.starts != 2 {
+		t.Errorf("after restart source runs %d times and started %d times, want 1 and 2", source.running, source.starts)
+	}
+
+	if err := supervisor.Stop("test"); err != nil {
+		t.Fatal(err)
+	}
+	supervisor.StartAll(context.Background())
+	if source.running != 1 {
+		t.Errorf("source runs %d times after stop and start, want once", source.running)
+	}
+}
+
+func TestSupervisorDoesNotStartReplacedSource(t *testing.T) {
+	old, replacement := &countingSource{}, &countingSource{}
+	supervisor := &Supervisor{}
+	supervisor.Add("test", old)
+	supervisor.StartAll(context.Background())
+	item := supervisor.find("test")
+
+	if err := supervisor.Replace("test", replacement); err != nil {
+		t.Fatal(err)
+	}
+	if old.running != 0 || replacement.running != 1 {
+		t.Fatalf("old source runs %d times and new one %d, want 0 and 1", old.running, replacement.running)
+	}
+	// LIKE StartAll THAT TOOK ITS LIST BEFORE RELOAD
+	if err := supervisor.start(context.Background(), item); err == nil {
+		t.Error("replaced source was started")
+	}
+	if old.running != 0 {
+		t.Errorf("old source runs %d times, want 0", old.running)
+	}
+}
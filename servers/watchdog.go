@@ -0,0 +1,33 @@
+package servers
+
+import (
+	"time"
+)
+
+// Watchdog calls onIdle when it was not kicked for timeout. Streams use it to notice half-open connections
+// that would otherwise stay silent forever. Zero timeout disables it
+type Watchdog struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func NewWatchdog(timeout time.Duration, onIdle func()) *Watchdog {
+	watchdog := &Watchdog{timeout: timeout}
+	if timeout > 0 {
+		watchdog.timer = time.AfterFunc(timeout, onIdle)
+	}
+	return watchdog
+}
+
+// Kick postpones onIdle for another timeout, call it on every heartbeat or event
+func (watchdog *Watchdog) Kick() {
+	if watchdog.timer != nil {
+		watchdog.timer.Reset(watchdog.timeout)
+	}
+}
+
+func (watchdog *Watchdog) Stop() {
+	if watchdog.timer != nil {
+		watchdog.timer.Stop()
+	}
+}
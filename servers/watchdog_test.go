@@ -0,0 +1,55 @@
+package servers
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchdogFiresWhenIdle(t *testing.T) {
+	fired := make(chan struct{}, 1)
+	watchdog := NewWatchdog(20*time.Millisecond, func() { fired <- struct{}{} })
+	defer watchdog.Stop()
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchdog did not fire")
+	}
+}
+
+func TestWatchdogKickPostponesIt(t *testing.T) {
+	var fired atomic.Int32
+	watchdog := NewWatchdog(100*time.Millisecond, func() { fired.Add(1) })
+	defer watchdog.Stop()
+	// TRAFFIC EVERY 20MS KEEPS IT QUIET, FOR LONGER THAN TIMEOUT
+	for i := 0; i < 15; i++ {
+		time.Sleep(20 * time.Millisecond)
+		watchdog.Kick()
+	}
+	if count := fired.Load(); count != 0 {
+		t.Fatalf("watchdog fired %d times while kicked, want never", count)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for fired.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("watchdog did not fire after traffic stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchdogStop(t *testing.T) {
+	var fired atomic.Int32
+	watchdog := NewWatchdog(20*time.Millisecond, func() { fired.Add(1) })
+	watchdog.Stop()
+	time.Sleep(60 * time.Millisecond)
+	if count := fired.Load(); count != 0 {
+		t.Errorf("stopped watchdog fired %d times, want never", count)
+	}
+}
+
+func TestWatchdogWithoutTimeout(t *testing.T) {
+	watchdog := NewWatchdog(0, func() { t.Error("disabled watchdog fired") })
+	watchdog.Kick()
+	watchdog.Stop()
+}
@@ -0,0 +1,283 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/logging"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var log = logging.For("store")
+
+var eventsBucket = []byte("events")
+
+const pruneInterval = 1 * time.Hour
+
+var ErrBadID = errors.New("event ID must be a positive number")
+
+// Options of the event store, see "store" section of config
+type Options struct {
+	Path      string
+	MaxAge    time.Duration // EVENTS RECEIVED EARLIER ARE DELETED, 0 KEEPS THEM FOREVER
+	MaxEvents int           // OLDEST EVENTS ARE DELETED PAST THIS, 0 MEANS NO LIMIT
+}
+
+// Record is an event as it was stored, with what buses did with it
+type Record struct {
+	events.Event
+	Received   time.Time         `json:"received"`
+	Deliveries []events.Delivery `json:"deliveries,omitempty"`
+}
+
+// Query filters records. Zero values match everything
+type Query struct {
+	Source string
+	Camera string
+	Type   string
+	Since  time.Time // RECEIVED AT OR AFTER
+	Until  time.Time // RECEIVED BEFORE
+	Before uint64    // ONLY IDS BELOW THIS, FOR PAGING
+	Limit  int
+}
+
+// Store keeps every event and its deliveries in a bbolt file. Events are keyed by sequential ID,
+// so they are in the order they were received
+type Store struct {
+	options   Options
+	db        *bolt.DB
+	cancel    context.CancelFunc
+	waitGroup sync.WaitGroup
+}
+
+// Open opens or creates store file and starts pruning it in background until Close
+func Open(options Options) (*Store, error) {
+	if dir := filepath.Dir(options.Path); dir != "" {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(options.Path, 0640, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(eventsBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	store := &Store{options: options, db: db}
+	var ctx context.Context
+	ctx, store.cancel = context.WithCancel(context.Background())
+	store.waitGroup.Add(1)
+	go func() {
+		defer store.waitGroup.Done()
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+		for {
+			store.prune()
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	log.Info("opened event store", "path", options.Path)
+	return store, nil
+}
+
+func (store *Store) Close() error {
+	store.cancel()
+	store.waitGroup.Wait()
+	return store.db.Close()
+}
+
+// Add stores event and sets its ID
+func (store *Store) Add(event *events.Event) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(eventsBucket)
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		event.ID = strconv.FormatUint(sequence, 10)
+		value, err := json.Marshal(Record{Event: *event, Received: time.Now()})
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key(sequence), value)
+	})
+}
+
+// AddDelivery records delivery of stored event. Events that were pruned already are skipped
+func (store *Store) AddDelivery(eventID string, delivery events.Delivery) error {
+	id, err := parseID(eventID)
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(eventsBucket)
+		value := bucket.Get(key(id))
+		if value == nil {
+			return nil
+		}
+		var record Record
+		if err := json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+		record.Deliveries = append(record.Deliveries, delivery)
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key(id), value)
+	})
+}
+
+// ReportDelivery is an events.DeliveryReporter that logs errors instead of returning them
+func (store *Store) ReportDelivery(eventID string, delivery events.Delivery) {
+	if err := store.AddDelivery(eventID, delivery); err != nil {
+		log.Error("error storing delivery", "id", eventID, "bus", delivery.Bus, "error", err)
+	}
+}
+
+// Get returns stored event by ID, false if there is none
+func (store *Store) Get(eventID string) (Record, bool, error) {
+	var record Record
+	id, err := parseID(eventID)
+	if err != nil {
+		return record, false, err
+	}
+	found := false
+	err = store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(eventsBucket).Get(key(id))
+		if value == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(value, &record)
+	})
+	return record, found, err
+}
+
+// Find returns records matching query, newest first
+func (store *Store) Find(query Query) ([]Record, error) {
+	records := make([]Record, 0)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(eventsBucket).Cursor()
+		var k, value []byte
+		if query.Before > 0 {
+			// SEEK LANDS ON Before OR THE NEXT ONE, EITHER WAY PREVIOUS IS WHERE TO START
+			if k, _ = cursor.Seek(key(query.Before)); k == nil {
+				k, value = cursor.Last()
+			} else {
+				k, value = cursor.Prev()
+			}
+		} else {
+			k, value = cursor.Last()
+		}
+		for ; k != nil; k, value = cursor.Prev() {
+			var record Record
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			if !query.Until.IsZero() && !record.Received.Before(query.Until) {
+				continue
+			}
+			if !query.Since.IsZero() && record.Received.Before(query.Since) {
+				break // RECORDS ARE IN ORDER OF RECEIVING, THE REST ARE OLDER
+			}
+			if !query.Matches(record.Event) {
+				continue
+			}
+			records = append(records, record)
+			if query.Limit > 0 && len(records) >= query.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Matches checks source, camera and type of event, but not time range or paging
+func (query Query) Matches(event events.Event) bool {
+	return (query.Source == "" || query.Source == event.Source) &&
+		(query.Camera == "" || query.Camera == event.Camera) &&
+		(query.Type == "" || query.Type == event.Type)
+}
+
+// prune deletes events that are older than MaxAge or beyond MaxEvents
+func (store *Store) prune() {
+	if store.options.MaxAge <= 0 && store.options.MaxEvents <= 0 {
+		return
+	}
+	deleted := 0
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(eventsBucket)
+		excess := 0
+		if store.options.MaxEvents > 0 {
+			excess = bucket.Stats().KeyN - store.options.MaxEvents
+		}
+		cutoff := time.Time{}
+		if store.options.MaxAge > 0 {
+			cutoff = time.Now().Add(-store.options.MaxAge)
+		}
+
+		// COLLECT FIRST, BBOLT CURSOR SKIPS KEYS WHEN DELETING WHILE ITERATING
+		var keys [][]byte
+		cursor := bucket.Cursor()
+		for k, value := cursor.First(); k != nil; k, value = cursor.Next() {
+			if len(keys) >= excess {
+				var record Record
+				if err := json.Unmarshal(value, &record); err != nil {
+					return err
+				}
+				if !record.Received.Before(cutoff) {
+					break
+				}
+			}
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		deleted = len(keys)
+		return nil
+	})
+	if err != nil {
+		log.Error("error pruning event store", "error", err)
+		return
+	}
+	if deleted > 0 {
+		log.Debug("pruned event store", "deleted", deleted)
+	}
+}
+
+func parseID(eventID string) (uint64, error) {
+	id, err := strconv.ParseUint(eventID, 10, 64)
+	if err != nil || id == 0 {
+		return 0, ErrBadID
+	}
+	return id, nil
+}
+
+func key(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
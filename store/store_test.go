@@ -0,0 +1,236 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/toxuin/alarmserver/events"
+	bolt "go.etcd.io/bbolt"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, options Options) *Store {
+	t.Helper()
+	options.Path = filepath.Join(t.TempDir(), "events.db")
+	store, err := Open(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+// addReceived stores event as if it came at received
+func addReceived(t *testing.T, store *Store, event events.Event, received time.Time) string {
+	t.Helper()
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(eventsBucket)
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		event.ID = strconv.FormatUint(sequence, 10)
+		value, err := json.Marshal(Record{Event: event, Received: received})
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key(sequence), value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event.ID
+}
+
+func ids(records []Record) []string {
+	result := make([]string, 0, len(records))
+	for _, record := range records {
+		result = append(result, record.ID)
+	}
+	return result
+}
+
+func TestStoreAddAndGet(t *testing.T) {
+	store := openTestStore(t, Options{})
+	event := events.Event{Source: events.SourceHikvision, Camera: "porch", Type: "VMD", State: events.StateActive}
+	if err := store.Add(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.ID != "1" {
+		t.Errorf("ID is %q, want 1", event.ID)
+	}
+	record, found, err := store.Get(event.ID)
+	if err != nil || !found {
+		t.Fatalf("get returned found %v and %v", found, err)
+	}
+	if record.Camera != "porch" || record.Type != "VMD" || record.Received.IsZero() {
+		t.Errorf("record is %+v", record)
+	}
+	if _, found, err := store.Get("2"); found || err != nil {
+		t.Errorf("get of missing event returned found %v and %v", found, err)
+	}
+}
+
+func TestStoreBadID(t *testing.T) {
+	store := openTestStore(t, Options{})
+	for _, id := range []string{"", "0", "-1", "abc", "1.5"} {
+		if _, _, err := store.Get(id); !errors.Is(err, ErrBadID) {
+			t.Errorf("get of %q returned %v, want ErrBadID", id, err)
+		}
+		if err := store.AddDelivery(id, events.Delivery{Bus: "mqtt"}); !errors.Is(err, ErrBadID) {
+			t.Errorf("delivery of %q returned %v, want ErrBadID", id, err)
+		}
+	}
+}
+
+func TestStoreFind(t *testing.T) {
+	store := openTestStore(t, Options{})
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	stored := []events.Event{
+		{Source: events.SourceHikvision, Camera: "porch", Type: "VMD"},
+		{Source: events.SourceDahua, Camera: "garage", Type: "VideoMotion"},
+		{Source: events.SourceHikvision, Camera: "porch", Type: "linedetection"},
+		{Source: events.SourceHikvision, Camera: "garage", Type: "VMD"},
+		{Source: events.SourceFtp, Camera: "porch", Type: "ftpUpload"},
+	}
+	for index, event := range stored {
+		addReceived(t, store, event, start.Add(time.Duration(index)*time.Minute))
+	}
+
+	tests := []struct {
+		name  string
+		query Query
+		ids   []string
+	}{
+		{"all, newest first", Query{}, []string{"5", "4", "3", "2", "1"}},
+		{"source", Query{Source: events.SourceHikvision}, []string{"4", "3", "1"}},
+		{"camera", Query{Camera: "garage"}, []string{"4", "2"}},
+		{"type", Query{Type: "VMD"}, []string{"4", "1"}},
+		{"camera and type", Query{Camera: "porch", Type: "VMD"}, []string{"1"}},
+		{"nothing matches", Query{Camera: "attic"}, []string{}},
+		{"since", Query{Since: start.Add(3 * time.Minute)}, []string{"5", "4"}},
+		{"until", Query{Until: start.Add(2 * time.Minute)}, []string{"2", "1"}},
+		{"since and until", Query{Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}, []string{"3", "2"}},
+		{"limit", Query{Limit: 2}, []string{"5", "4"}},
+		{"before", Query{Before: 4, Limit: 2}, []string{"3", "2"}},
+		{"before past last", Query{Before: 100, Limit: 1}, []string{"5"}},
+		{"before first", Query{Before: 1}, []string{}},
+		{"before with filter", Query{Before: 4, Camera: "garage"}, []string{"2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records, err := store.Find(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(records); !reflect.DeepEqual(got, test.ids) {
+				t.Errorf("found %v, want %v", got, test.ids)
+			}
+		})
+	}
+}
+
+func TestStorePagingCoversAll(t *testing.T) {
+	store := openTestStore(t, Options{})
+	for i := 0; i < 7; i++ {
+		addReceived(t, store, events.Event{Camera: "porch"}, time.Now())
+	}
+	var seen []string
+	query := Query{Limit: 3}
+	for {
+		page, err := store.Find(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		seen = append(seen, ids(page)...)
+		last, _ := strconv.ParseUint(page[len(page)-1].ID, 10, 64)
+		query.Before = last
+	}
+	if want := []string{"7", "6", "5", "4", "3", "2", "1"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("pages have %v, want %v", seen, want)
+	}
+}
+
+func TestStorePrunesByMaxAge(t *testing.T) {
+	store := openTestStore(t, Options{MaxAge: time.Hour})
+	addReceived(t, store, events.Event{Camera: "old"}, time.Now().Add(-2*time.Hour))
+	addReceived(t, store, events.Event{Camera: "old"}, time.Now().Add(-90*time.Minute))
+	addReceived(t, store, events.Event{Camera: "new"}, time.Now().Add(-time.Minute))
+	store.prune()
+	records, _ := store.Find(Query{})
+	if got := ids(records); !reflect.DeepEqual(got, []string{"3"}) {
+		t.Errorf("left %v after pruning, want [3]", got)
+	}
+}
+
+func TestStorePrunesByMaxEvents(t *testing.T) {
+	store := openTestStore(t, Options{MaxEvents: 3})
+	for i := 0; i < 5; i++ {
+		addReceived(t, store, events.Event{Camera: "porch"}, time.Now())
+	}
+	store.prune()
+	records, _ := store.Find(Query{})
+	if got := ids(records); !reflect.DeepEqual(got, []string{"5", "4", "3"}) {
+		t.Errorf("left %v after pruning, want [5 4 3]", got)
+	}
+	store.prune()
+	if records, _ := store.Find(Query{}); len(records) != 3 {
+		t.Errorf("second prune left %d, want 3", len(records))
+	}
+}
+
+func TestStoreDeliveries(t *testing.T) {
+	store := openTestStore(t, Options{})
+	event := events.Event{Camera: "porch"}
+	if err := store.Add(&event); err != nil {
+		t.Fatal(err)
+	}
+	first := events.Delivery{Bus: "webhooks", Target: "http://example.com/", Status: 503, Attempt: 1, Error: "bad status code 503"}
+	second := events.Delivery{Bus: "webhooks", Target: "http://example.com/", Status: 200, Attempt: 2}
+	if err := store.AddDelivery(event.ID, first); err != nil {
+		t.Fatal(err)
+	}
+	store.ReportDelivery(event.ID, second)
+	// PRUNED EVENTS ARE SKIPPED
+	if err := store.AddDelivery("42", second); err != nil {
+		t.Errorf("delivery of missing event returned %v", err)
+	}
+
+	record, _, _ := store.Get(event.ID)
+	if len(record.Deliveries) != 2 {
+		t.Fatalf("record has %d deliveries, want 2", len(record.Deliveries))
+	}
+	if record.Deliveries[0].Status != 503 || record.Deliveries[1].Status != 200 {
+		t.Errorf("deliveries are %+v", record.Deliveries)
+	}
+}
+
+func TestStoreKeepsEventsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	store, err := Open(Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Add(&events.Event{Camera: "porch"})
+	_ = store.Close()
+
+	store, err = Open(Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	event := events.Event{Camera: "garage"}
+	_ = store.Add(&event)
+	if event.ID != "2" {
+		t.Errorf("ID after reopen is %q, want 2", event.ID)
+	}
+	if _, found, _ := store.Get("1"); !found {
+		t.Error("event is gone after reopen")
+	}
+}
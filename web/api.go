@@ -0,0 +1,423 @@
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/toxuin/alarmserver/buses"
+	"github.com/toxuin/alarmserver/control"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/servers"
+	"github.com/toxuin/alarmserver/store"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiPrefix = "/api/"
+
+// API is the admin REST API. Every request needs Token, sent as "Authorization: Bearer <token>" or "X-Api-Token" header.
+// Unless ReadOnly is off, it only lets you look
+type API struct {
+	Token    string
+	ReadOnly bool
+	Servers  *servers.Supervisor
+	Buses    *buses.Manager
+	History  *events.History
+	Store    *store.Store // NIL IF EVENT STORE IS NOT ENABLED
+	Arming   *control.Router
+}
+
+// maxModeBody is plenty for {"mode": "..."}
+const maxModeBody = 1024
+
+const (
+	defaultEventLimit = 100
+	maxEventLimit     = 1000
+)
+
+type serverReport struct {
+	Name string `json:"name"`
+	servers.Status
+	Details interface{} `json:"details,omitempty"`
+}
+
+type cameraReport struct {
+	Server string `json:"server"`
+	servers.CameraStatus
+}
+
+func (api *API) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if !api.authorized(request) {
+		writer.Header().Set("WWW-Authenticate", `Bearer realm="alarmserver"`)
+		writeError(writer, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(request.URL.Path, apiPrefix), "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "servers":
+		api.get(writer, request, api.listServers)
+	case len(path) == 2 && path[0] == "servers":
+		api.get(writer, request, func(request *http.Request) (interface{}, int) {
+			return api.getServer(path[1])
+		})
+	case len(path) == 3 && path[0] == "servers" && path[2] == "restart":
+		api.restartServer(writer, request, path[1])
+	case len(path) == 1 && path[0] == "cameras":
+		api.get(writer, request, api.listCameras)
+	case len(path) == 1 && path[0] == "events":
+		api.get(writer, request, api.listEvents)
+	case len(path) == 2 && path[0] == "events":
+		api.get(writer, request, func(request *http.Request) (interface{}, int) {
+			return api.getEvent(path[1])
+		})
+	case len(path) == 1 && path[0] == "buses":
+		api.get(writer, request, func(request *http.Request) (interface{}, int) {
+			return api.Buses.Health(), http.StatusOK
+		})
+	case len(path) == 3 && path[0] == "buses" && path[2] == "outbox":
+		api.get(writer, request, func(request *http.Request) (interface{}, int) {
+			return api.getOutbox(path[1])
+		})
+	case len(path) == 4 && path[0] == "buses" && path[2] == "dead" && path[3] == "replay":
+		api.change(writer, request, http.MethodPost, func() (interface{}, int) {
+			return api.replayAll(path[1])
+		})
+	case len(path) == 5 && path[0] == "buses" && path[2] == "dead" && path[4] == "replay":
+		api.change(writer, request, http.MethodPost, func() (interface{}, int) {
+			return api.changeDeadLetter(path[1], path[3], buses.Outbox.Replay)
+		})
+	case len(path) == 4 && path[0] == "buses" && path[2] == "dead":
+		api.change(writer, request, http.MethodDelete, func() (interface{}, int) {
+			return api.changeDeadLetter(path[1], path[3], buses.Outbox.Discard)
+		})
+	case len(path) == 1 && path[0] == "arming" && request.Method == http.MethodPut:
+		api.change(writer, request, http.MethodPut, func() (interface{}, int) {
+			return api.setMode(request, control.AllCameras)
+		})
+	case len(path) == 1 && path[0] == "arming":
+		api.get(writer, request, func(request *http.Request) (interface{}, int) {
+			return api.Arming.State(), http.StatusOK
+		})
+	case len(path) == 3 && path[0] == "arming" && path[1] == "cameras" && request.Method == http.MethodDelete:
+		api.change(writer, request, http.MethodDelete, func() (interface{}, int) {
+			return api.changedMode(api.Arming.ResetMode(path[2]))
+		})
+	case len(path) == 3 && path[0] == "arming" && path[1] == "cameras":
+		api.change(writer, request, http.MethodPut, func() (interface{}, int) {
+			return api.setMode(request, path[2])
+		})
+	default:
+		writeError(writer, http.StatusNotFound, "not found")
+	}
+}
+
+func (api *API) authorized(request *http.Request) bool {
+	token := request.Header.Get("X-Api-Token")
+	if bearer, found := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer "); found {
+		token = bearer
+	}
+	return api.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(api.Token)) == 1
+}
+
+func (api *API) get(writer http.ResponseWriter, request *http.Request, handler func(*http.Request) (interface{}, int)) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		writer.Header().Set("Allow", "GET, HEAD")
+		writeError(writer, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	body, statusCode := handler(request)
+	writeJson(writer, statusCode, body)
+}
+
+// change runs handler that changes something, if request has the right method and API is not read-only
+func (api *API) change(writer http.ResponseWriter, request *http.Request, method string, handler func() (interface{}, int)) {
+	if request.Method != method {
+		writer.Header().Set("Allow", method)
+		writeError(writer, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if api.ReadOnly {
+		writeError(writer, http.StatusForbidden, "API is read-only")
+		return
+	}
+	body, statusCode := handler()
+	writeJson(writer, statusCode, body)
+}
+
+func (api *API) listServers(*http.Request) (interface{}, int) {
+	statuses := api.Servers.Statuses()
+	reports := make([]serverReport, 0, len(statuses))
+	for name, status := range statuses {
+		reports = append(reports, serverReport{Name: name, Status: status})
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Name < reports[j].Name
+	})
+	return reports, http.StatusOK
+}
+
+func (api *API) getServer(name string) (interface{}, int) {
+	source := api.Servers.Get(name)
+	if source == nil {
+		return apiError("unknown server " + name), http.StatusNotFound
+	}
+	report := serverReport{Name: name, Status: source.Status()}
+	if inspector, ok := source.(servers.Inspector); ok {
+		report.Details = inspector.Details()
+	}
+	return report, http.StatusOK
+}
+
+func (api *API) restartServer(writer http.ResponseWriter, request *http.Request, name string) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", "POST")
+		writeError(writer, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if api.ReadOnly {
+		writeError(writer, http.StatusForbidden, "API is read-only")
+		return
+	}
+	source := api.Servers.Get(name)
+	if source == nil {
+		writeError(writer, http.StatusNotFound, "unknown server "+name)
+		return
+	}
+	if _, isSelf := source.(*Server); isSelf {
+		// SHUTDOWN WOULD WAIT FOR THIS VERY REQUEST TO FINISH
+		writeError(writer, http.StatusBadRequest, "HTTP server cannot restart itself")
+		return
+	}
+	log.Info("restarting server on API request", "server", name, "remoteAddress", request.RemoteAddr)
+	if err := api.Servers.Restart(name); err != nil {
+		writeError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	body, statusCode := api.getServer(name)
+	writeJson(writer, statusCode, body)
+}
+
+func (api *API) listCameras(*http.Request) (interface{}, int) {
+	cameras := make([]cameraReport, 0)
+	for name, status := range api.Servers.Statuses() {
+		for _, camera := range status.Cameras {
+			cameras = append(cameras, cameraReport{Server: name, CameraStatus: camera})
+		}
+	}
+	sort.Slice(cameras, func(i, j int) bool {
+		if cameras[i].Server != cameras[j].Server {
+			return cameras[i].Server < cameras[j].Server
+		}
+		return cameras[i].Name < cameras[j].Name
+	})
+	return cameras, http.StatusOK
+}
+
+// outbox returns bus with key if it keeps an outbox, or error response if it does not
+func (api *API) outbox(key string) (buses.Outbox, interface{}, int) {
+	bus := api.Buses.Get(key)
+	if bus == nil {
+		return nil, apiError("unknown bus " + key), http.StatusNotFound
+	}
+	outbox, ok := bus.(buses.Outbox)
+	if !ok {
+		return nil, apiError(key + " bus has no outbox"), http.StatusNotFound
+	}
+	return outbox, nil, http.StatusOK
+}
+
+func (api *API) getOutbox(key string) (interface{}, int) {
+	outbox, body, statusCode := api.outbox(key)
+	if outbox == nil {
+		return body, statusCode
+	}
+	pending, err := outbox.Pending()
+	if err != nil {
+		log.Error("error reading outbox", "bus", key, "error", err)
+		return apiError("error reading outbox"), http.StatusInternalServerError
+	}
+	dead, err := outbox.DeadLetters()
+	if err != nil {
+		log.Error("error reading dead letters", "bus", key, "error", err)
+		return apiError("error reading dead letters"), http.StatusInternalServerError
+	}
+	return map[string][]buses.OutboxItem{"pending": pending, "dead": dead}, http.StatusOK
+}
+
+func (api *API) replayAll(key string) (interface{}, int) {
+	outbox, body, statusCode := api.outbox(key)
+	if outbox == nil {
+		return body, statusCode
+	}
+	replayed, err := outbox.ReplayAll()
+	if err != nil {
+		log.Error("error replaying dead letters", "bus", key, "error", err)
+		return apiError("error replaying dead letters"), http.StatusInternalServerError
+	}
+	log.Info("replaying dead letters on API request", "bus", key, "count", replayed)
+	return map[string]int{"replayed": replayed}, http.StatusOK
+}
+
+// changeDeadLetter replays or discards one dead letter
+func (api *API) changeDeadLetter(key string, id string, action func(buses.Outbox, string) error) (interface{}, int) {
+	outbox, body, statusCode := api.outbox(key)
+	if outbox == nil {
+		return body, statusCode
+	}
+	err := action(outbox, id)
+	if errors.Is(err, buses.ErrUnknownItem) {
+		return apiError("unknown dead letter " + id), http.StatusNotFound
+	}
+	if err != nil {
+		log.Error("error changing dead letter", "bus", key, "id", id, "error", err)
+		return apiError(err.Error()), http.StatusInternalServerError
+	}
+	return map[string]string{"id": id}, http.StatusOK
+}
+
+// setMode takes {"mode": "home"} and switches camera to it
+func (api *API) setMode(request *http.Request, camera string) (interface{}, int) {
+	body := struct {
+		Mode string `json:"mode"`
+	}{}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, request.Body, maxModeBody)).Decode(&body); err != nil {
+		return apiError("body must be JSON like {\"mode\": \"home\"}"), http.StatusBadRequest
+	}
+	if body.Mode == "" {
+		return apiError("no mode given"), http.StatusBadRequest
+	}
+	log.Info("changing arming mode on API request", "camera", camera, "mode", body.Mode, "remoteAddress", request.RemoteAddr)
+	return api.changedMode(api.Arming.SetMode(camera, body.Mode))
+}
+
+// changedMode responds with arming state after change, or what went wrong with it
+func (api *API) changedMode(err error) (interface{}, int) {
+	if errors.Is(err, control.ErrUnknownMode) {
+		return apiError(err.Error()), http.StatusBadRequest
+	}
+	if err != nil {
+		return apiError(err.Error()), http.StatusInternalServerError
+	}
+	return api.Arming.State(), http.StatusOK
+}
+
+// listEvents returns latest events, newest first. They come from event store if it is enabled,
+// otherwise from recent events kept in memory
+func (api *API) listEvents(request *http.Request) (interface{}, int) {
+	query, err := parseEventQuery(request.URL.Query())
+	if err != nil {
+		return apiError(err.Error()), http.StatusBadRequest
+	}
+	if api.Store != nil {
+		records, err := api.Store.Find(query)
+		if err != nil {
+			log.Error("error querying event store", "error", err)
+			return apiError("error querying event store"), http.StatusInternalServerError
+		}
+		return records, http.StatusOK
+	}
+
+	result := make([]events.Event, 0)
+	if api.History == nil {
+		return result, http.StatusOK
+	}
+	for _, event := range api.History.Recent(0) {
+		if !query.Matches(event) ||
+			(!query.Since.IsZero() && event.Time.Before(query.Since)) ||
+			(!query.Until.IsZero() && !event.Time.Before(query.Until)) {
+			continue
+		}
+		result = append(result, event)
+		if len(result) >= query.Limit {
+			break
+		}
+	}
+	return result, http.StatusOK
+}
+
+// getEvent returns stored event with its deliveries
+func (api *API) getEvent(id string) (interface{}, int) {
+	if api.Store == nil {
+		return apiError("event store is not enabled"), http.StatusNotFound
+	}
+	record, found, err := api.Store.Get(id)
+	if errors.Is(err, store.ErrBadID) {
+		return apiError(err.Error()), http.StatusBadRequest
+	}
+	if err != nil {
+		log.Error("error reading event store", "id", id, "error", err)
+		return apiError("error reading event store"), http.StatusInternalServerError
+	}
+	if !found {
+		return apiError("unknown event " + id), http.StatusNotFound
+	}
+	return record, http.StatusOK
+}
+
+func parseEventQuery(values url.Values) (store.Query, error) {
+	query := store.Query{
+		Source: values.Get("source"),
+		Camera: values.Get("camera"),
+		Type:   values.Get("type"),
+		Limit:  defaultEventLimit,
+	}
+	var err error
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit <= 0 {
+			return query, errors.New("limit must be a positive number")
+		}
+		if query.Limit > maxEventLimit {
+			query.Limit = maxEventLimit
+		}
+	}
+	if before := values.Get("before"); before != "" {
+		if query.Before, err = strconv.ParseUint(before, 10, 64); err != nil {
+			return query, errors.New("before must be an event ID")
+		}
+	}
+	if query.Since, err = parseTime(values.Get("since")); err != nil {
+		return query, fmt.Errorf("since: %w", err)
+	}
+	if query.Until, err = parseTime(values.Get("until")); err != nil {
+		return query, fmt.Errorf("until: %w", err)
+	}
+	return query, nil
+}
+
+// parseTime accepts RFC 3339 time, or duration meaning that long ago, like 24h
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New("use RFC 3339 time or duration like 24h")
+	}
+	return parsed, nil
+}
+
+func apiError(message string) map[string]string {
+	return map[string]string{"error": message}
+}
+
+func writeError(writer http.ResponseWriter, statusCode int, message string) {
+	writeJson(writer, statusCode, apiError(message))
+}
+
+func writeJson(writer http.ResponseWriter, statusCode int, body interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(statusCode)
+	if err := json.NewEncoder(writer).Encode(body); err != nil {
+		log.Warn("error writing API response", "error", err)
+	}
+}
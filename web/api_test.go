@@ -0,0 +1,265 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/toxuin/alarmserver/events"
+	"github.com/toxuin/alarmserver/servers"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testToken = "secret"
+
+// stubSource counts how many times it was started
+type stubSource struct {
+	servers.StatusHolder
+	starts int
+}
+
+func (source *stubSource) Start(ctx context.Context) error {
+	source.starts++
+	source.SetStatus(servers.StateRunning, nil)
+	return nil
+}
+
+func (source *stubSource) Stop() {
+	source.SetStatus(servers.StateStopped, nil)
+}
+
+// serveAPI sends request with token through api and returns response
+func serveAPI(api *API, method string, target string, token string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		request.Header.Set("X-Api-Token", token)
+	}
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestAPIToken(t *testing.T) {
+	api := &API{Token: testToken}
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"no token", nil, http.StatusUnauthorized},
+		{"wrong token", map[string]string{"X-Api-Token": "guess"}, http.StatusUnauthorized},
+		{"wrong bearer", map[string]string{"Authorization": "Bearer guess"}, http.StatusUnauthorized},
+		{"token without bearer", map[string]string{"Authorization": testToken}, http.StatusUnauthorized},
+		{"header token", map[string]string{"X-Api-Token": testToken}, http.StatusOK},
+		{"bearer token", map[string]string{"Authorization": "Bearer " + testToken}, http.StatusOK},
+		{"bearer wins over header", map[string]string{"Authorization": "Bearer guess", "X-Api-Token": testToken}, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/events", nil)
+			for name, value := range test.headers {
+				request.Header.Set(name, value)
+			}
+			recorder := httptest.NewRecorder()
+			api.ServeHTTP(recorder, request)
+			if recorder.Code != test.want {
+				t.Errorf("status is %d, want %d", recorder.Code, test.want)
+			}
+			if test.want == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") == "" {
+				t.Error("unauthorized response has no WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestAPIWithoutTokenDeniesEverything(t *testing.T) {
+	api := &API{}
+	if recorder := serveAPI(api, http.MethodGet, "/api/events", ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("status is %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+	request := httptest.NewRequest(http.MethodGet, "/api/events", nil)
+	request.Header.Set("Authorization", "Bearer ")
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("status with empty bearer is %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAPIReadOnly(t *testing.T) {
+	source := &stubSource{}
+	supervisor := &servers.Supervisor{}
+	supervisor.Add("test", source)
+	api := &API{Token: testToken, ReadOnly: true, Servers: supervisor}
+
+	tests := []struct {
+		method string
+		target string
+	}{
+		{http.MethodPost, "/api/servers/test/restart"},
+		{http.MethodPost, "/api/buses/webhooks/dead/replay"},
+		{http.MethodPost, "/api/buses/webhooks/dead/1/replay"},
+		{http.MethodDelete, "/api/buses/webhooks/dead/1"},
+		{http.MethodPut, "/api/arming"},
+		{http.MethodPut, "/api/arming/cameras/porch"},
+		{http.MethodDelete, "/api/arming/cameras/porch"},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.target, func(t *testing.T) {
+			if recorder := serveAPI(api, test.method, test.target, testToken); recorder.Code != http.StatusForbidden {
+				t.Errorf("status is %d, want %d", recorder.Code, http.StatusForbidden)
+			}
+		})
+	}
+	if source.starts != 0 {
+		t.Errorf("read-only API started server %d times", source.starts)
+	}
+	if recorder := serveAPI(api, http.MethodGet, "/api/servers", testToken); recorder.Code != http.StatusOK {
+		t.Errorf("read-only GET status is %d, want %d", recorder.Code, http.StatusOK)
+	}
+}
+
+func TestAPIWrongMethod(t *testing.T) {
+	api := &API{Token: testToken}
+	if recorder := serveAPI(api, http.MethodPost, "/api/events", testToken); recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST to events status is %d, want %d", recorder.Code, http.StatusMethodNotAllowed)
+	}
+	if recorder := serveAPI(api, http.MethodGet, "/api/servers/test/restart", testToken); recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET to restart status is %d, want %d", recorder.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAPIRestartServer(t *testing.T) {
+	source := &stubSource{}
+	supervisor := &servers.Supervisor{}
+	supervisor.Add("test", source)
+	supervisor.Add("http", &Server{})
+	api := &API{Token: testToken, Servers: supervisor}
+
+	if recorder := serveAPI(api, http.MethodPost, "/api/servers/test/restart", testToken); recorder.Code != http.StatusOK {
+		t.Errorf("restart status is %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if source.starts != 1 {
+		t.Errorf("server started %d times, want once", source.starts)
+	}
+	if recorder := serveAPI(api, http.MethodPost, "/api/servers/nope/restart", testToken); recorder.Code != http.StatusNotFound {
+		t.Errorf("restart of unknown server status is %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+	if recorder := serveAPI(api, http.MethodPost, "/api/servers/http/restart", testToken); recorder.Code != http.StatusBadRequest {
+		t.Errorf("restart of HTTP server status is %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+}
+
+func TestParseEventQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{"defaults", "", false},
+		{"filters", "source=hikvision&camera=porch&type=VMD", false},
+		{"limit", "limit=5", false},
+		{"zero limit", "limit=0", true},
+		{"negative limit", "limit=-1", true},
+		{"non-numeric limit", "limit=many", true},
+		{"before", "before=42", false},
+		{"non-numeric before", "before=last", true},
+		{"negative before", "before=-1", true},
+		{"since duration", "since=24h", false},
+		{"since time", "since=2024-01-02T03:04:05Z", false},
+		{"bad since", "since=yesterday", true},
+		{"until time", "until=2024-01-02T03:04:05Z", false},
+		{"bad until", "until=2024-01-02", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, _ := url.ParseQuery(test.query)
+			_, err := parseEventQuery(values)
+			if (err != nil) != test.wantErr {
+				t.Errorf("error is %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseEventQueryValues(t *testing.T) {
+	values, _ := url.ParseQuery("camera=porch&limit=5000&before=42&since=1h&until=2024-01-02T03:04:05Z")
+	query, err := parseEventQuery(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Camera != "porch" {
+		t.Errorf("camera is %q, want porch", query.Camera)
+	}
+	if query.Limit != maxEventLimit {
+		t.Errorf("limit is %d, want %d", query.Limit, maxEventLimit)
+	}
+	if query.Before != 42 {
+		t.Errorf("before is %d, want 42", query.Before)
+	}
+	if since := time.Since(query.Since); since < time.Hour || since > time.Hour+time.Minute {
+		t.Errorf("since is %v ago, want an hour", since)
+	}
+	if want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC); !query.Until.Equal(want) {
+		t.Errorf("until is %v, want %v", query.Until, want)
+	}
+
+	query, _ = parseEventQuery(url.Values{})
+	if query.Limit != defaultEventLimit {
+		t.Errorf("default limit is %d, want %d", query.Limit, defaultEventLimit)
+	}
+}
+
+func TestAPIEventsFromHistory(t *testing.T) {
+	now := time.Now()
+	history := &events.History{}
+	history.Add(events.Event{Source: "hikvision", Camera: "porch", Type: "VMD", Message: "old", Time: now.Add(-3 * time.Hour)})
+	history.Add(events.Event{Source: "hikvision", Camera: "porch", Type: "VMD", Message: "middle", Time: now.Add(-90 * time.Minute)})
+	history.Add(events.Event{Source: "hikvision", Camera: "porch", Type: "linedetection", Message: "line", Time: now.Add(-time.Hour)})
+	history.Add(events.Event{Source: "dahua", Camera: "garage", Type: "VMD", Message: "garage", Time: now.Add(-30 * time.Minute)})
+	history.Add(events.Event{Source: "hikvision", Camera: "porch", Type: "VMD", Message: "new", Time: now.Add(-time.Minute)})
+	api := &API{Token: testToken, History: history}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"new", "garage", "line", "middle", "old"}},
+		{"camera=porch&type=VMD", []string{"new", "middle", "old"}},
+		{"source=dahua", []string{"garage"}},
+		{"limit=2", []string{"new", "garage"}},
+		{"since=2h", []string{"new", "garage", "line", "middle"}},
+		{"until=" + now.Add(-time.Hour).Format(time.RFC3339Nano), []string{"middle", "old"}},
+		{"camera=porch&since=2h&limit=2", []string{"new", "line"}},
+		{"camera=attic", []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			recorder := serveAPI(api, http.MethodGet, "/api/events?"+test.query, testToken)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status is %d, want %d", recorder.Code, http.StatusOK)
+			}
+			var got []events.Event
+			if err := json.NewDecoder(recorder.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			messages := make([]string, 0, len(got))
+			for _, event := range got {
+				messages = append(messages, event.Message)
+			}
+			if !reflect.DeepEqual(messages, test.want) {
+				t.Errorf("events are %v, want %v", messages, test.want)
+			}
+		})
+	}
+
+	if recorder := serveAPI(api, http.MethodGet, "/api/events?limit=0", testToken); recorder.Code != http.StatusBadRequest {
+		t.Errorf("bad query status is %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+	if recorder := serveAPI(&API{Token: testToken}, http.MethodGet, "/api/events", testToken); recorder.Body.String() != "[]\n" {
+		t.Errorf("events without history are %q, want []", recorder.Body.String())
+	}
+}
@@ -0,0 +1,184 @@
+package web
+
+import (
+	"crypto/subtle"
+	"embed"
+	"github.com/toxuin/alarmserver/events"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dashboardPrefix = "/dashboard/"
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// Dashboard is the web UI for technicians setting up cameras. It shows cameras, buses, live events
+// and FTP snapshots. Username and Password turn on basic auth, which browsers handle on their own
+type Dashboard struct {
+	Username     string
+	Password     string
+	Servers      StatusProvider
+	Buses        HealthProvider
+	History      *events.History
+	Stream       http.Handler // LIVE EVENTS, NIL IF STREAM BUS IS NOT ENABLED
+	StreamToken  string
+	SnapshotRoot string // FTP ROOT, EMPTY IF FTP DOES NOT KEEP FILES
+}
+
+type dashboardStatus struct {
+	HealthReport
+	Live bool `json:"live"` // WHETHER /dashboard/events IS THERE
+}
+
+type snapshot struct {
+	Camera      string    `json:"camera"`
+	Time        time.Time `json:"time"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"contentType"`
+	Url         string    `json:"url"`
+	path        string    // UNDER SnapshotRoot, WITH SLASHES
+}
+
+// Handler serves everything under /dashboard/
+func (dashboard *Dashboard) Handler() http.Handler {
+	static, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err) // EMBEDDED AT BUILD TIME, CANNOT HAPPEN
+	}
+	mux := http.NewServeMux()
+	mux.Handle(dashboardPrefix, http.StripPrefix(dashboardPrefix, http.FileServer(http.FS(static))))
+	mux.HandleFunc(dashboardPrefix+"api/status", dashboard.serveStatus)
+	mux.HandleFunc(dashboardPrefix+"api/events", dashboard.serveEvents)
+	mux.HandleFunc(dashboardPrefix+"api/snapshots", dashboard.serveSnapshots)
+	if dashboard.SnapshotRoot != "" {
+		mux.HandleFunc(dashboardPrefix+"snapshots/", dashboard.serveSnapshot)
+	}
+	if dashboard.Stream != nil {
+		mux.HandleFunc(dashboardPrefix+"events", dashboard.serveStream)
+	}
+	return dashboard.authenticate(mux)
+}
+
+// RedirectHandler sends visitors of / to the dashboard
+func (dashboard *Dashboard) RedirectHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/" {
+			http.NotFound(writer, request)
+			return
+		}
+		http.Redirect(writer, request, dashboardPrefix, http.StatusFound)
+	})
+}
+
+func (dashboard *Dashboard) authenticate(next http.Handler) http.Handler {
+	if dashboard.Username == "" && dashboard.Password == "" {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		username, password, ok := request.BasicAuth()
+		usernameMatches := subtle.ConstantTimeCompare([]byte(username), []byte(dashboard.Username)) == 1
+		passwordMatches := subtle.ConstantTimeCompare([]byte(password), []byte(dashboard.Password)) == 1
+		if !ok || !usernameMatches || !passwordMatches {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="alarmserver", charset="UTF-8"`)
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func (dashboard *Dashboard) serveStatus(writer http.ResponseWriter, request *http.Request) {
+	writeJson(writer, http.StatusOK, dashboardStatus{
+		HealthReport: HealthReport{
+			Status:  "ok",
+			Servers: dashboard.Servers.Statuses(),
+			Buses:   dashboard.Buses.Health(),
+		},
+		Live: dashboard.Stream != nil,
+	})
+}
+
+func (dashboard *Dashboard) serveEvents(writer http.ResponseWriter, request *http.Request) {
+	limit, err := strconv.Atoi(request.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100 // DEFAULT FEED LENGTH
+	}
+	writeJson(writer, http.StatusOK, dashboard.History.Recent(limit))
+}
+
+// serveSnapshots lists images uploaded over FTP that are still in recent events
+func (dashboard *Dashboard) serveSnapshots(writer http.ResponseWriter, request *http.Request) {
+	writeJson(writer, http.StatusOK, dashboard.snapshots())
+}
+
+// serveSnapshot serves one of listed snapshots. Anything else under FTP root stays hidden,
+// it is not meant for anyone who gets past dashboard login
+func (dashboard *Dashboard) serveSnapshot(writer http.ResponseWriter, request *http.Request) {
+	name := strings.TrimPrefix(request.URL.Path, dashboardPrefix+"snapshots/")
+	for _, snapshot := range dashboard.snapshots() {
+		if snapshot.path != name {
+			continue
+		}
+		file, err := os.Open(filepath.Join(dashboard.SnapshotRoot, filepath.FromSlash(snapshot.path)))
+		if err != nil {
+			break
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			break
+		}
+		writer.Header().Set("Content-Type", snapshot.ContentType)
+		http.ServeContent(writer, request, snapshot.Name, info.ModTime(), file)
+		return
+	}
+	http.NotFound(writer, request)
+}
+
+// snapshots returns image attachments of recent events that are kept under FTP root, newest first
+func (dashboard *Dashboard) snapshots() []snapshot {
+	snapshots := make([]snapshot, 0)
+	if dashboard.SnapshotRoot == "" {
+		return snapshots
+	}
+	for _, event := range dashboard.History.Recent(0) {
+		for _, attachment := range event.Attachments {
+			if attachment.Path == "" || !strings.HasPrefix(attachment.ContentType, "image/") {
+				continue
+			}
+			relativePath, err := filepath.Rel(dashboard.SnapshotRoot, attachment.Path)
+			if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+				continue
+			}
+			relativePath = filepath.ToSlash(relativePath)
+			snapshotUrl := url.URL{Path: dashboardPrefix + "snapshots/" + relativePath}
+			snapshots = append(snapshots, snapshot{
+				Camera:      event.Camera,
+				Time:        event.Time,
+				Name:        attachment.Name,
+				ContentType: attachment.ContentType,
+				Url:         snapshotUrl.String(),
+				path:        relativePath,
+			})
+		}
+	}
+	return snapshots
+}
+
+// serveStream passes dashboard users on to the stream bus. They have already logged in here,
+// so they get stream token instead of having to know it
+func (dashboard *Dashboard) serveStream(writer http.ResponseWriter, request *http.Request) {
+	request = request.Clone(request.Context())
+	request.Header.Del("Authorization")
+	if dashboard.StreamToken != "" {
+		request.Header.Set("Authorization", "Bearer "+dashboard.StreamToken)
+	}
+	dashboard.Stream.ServeHTTP(writer, request)
+}
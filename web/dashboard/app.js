@@ -0,0 +1,189 @@
+"use strict";
+
+const STATUS_INTERVAL = 5000;
+const POLL_INTERVAL = 5000;
+const SNAPSHOT_INTERVAL = 15000;
+const MAX_EVENTS = 200;
+
+let feed = [];
+let stream = null;
+let pollTimer = null;
+
+function element(tag, className, text) {
+  const node = document.createElement(tag);
+  if (className) node.className = className;
+  if (text !== undefined) node.textContent = text;
+  return node;
+}
+
+function badge(state) {
+  return element("span", "badge " + state, state);
+}
+
+function since(time) {
+  if (!time || time.startsWith("0001-")) return "";
+  const seconds = Math.round((Date.now() - new Date(time)) / 1000);
+  if (seconds < 60) return seconds + "s ago";
+  if (seconds < 3600) return Math.floor(seconds / 60) + "m ago";
+  if (seconds < 86400) return Math.floor(seconds / 3600) + "h ago";
+  return new Date(time).toLocaleString();
+}
+
+async function fetchJson(path) {
+  const response = await fetch(path, { cache: "no-store" });
+  if (!response.ok) throw new Error(path + " returned " + response.status);
+  return response.json();
+}
+
+function setConnection(state) {
+  const node = document.getElementById("connection");
+  node.className = "badge " + state;
+  node.textContent = state;
+}
+
+function renderCameras(servers) {
+  const rows = [];
+  for (const [server, status] of Object.entries(servers).sort()) {
+    for (const camera of status.cameras || []) {
+      const row = element("tr");
+      row.append(
+        element("td", "", camera.name),
+        element("td", "", server),
+        element("td"),
+        element("td", "", since(camera.since)),
+        element("td", "", camera.reconnects),
+        element("td", "", camera.authMethod || ""),
+      );
+      row.children[2].append(badge(camera.state));
+      if (camera.error) row.title = camera.error;
+      rows.push(row);
+    }
+  }
+  document.getElementById("cameras").replaceChildren(...rows);
+  document.getElementById("no-cameras").hidden = rows.length > 0;
+}
+
+function renderCards(id, items, stateOf, detailOf) {
+  const cards = Object.entries(items).sort().map(([name, item]) => {
+    const card = element("li");
+    card.append(element("strong", "", name + " "), badge(stateOf(item)));
+    const detail = detailOf(item);
+    if (detail) card.append(element("div", "detail", detail));
+    return card;
+  });
+  document.getElementById(id).replaceChildren(...cards);
+}
+
+function busDetail(health) {
+  const parts = [health.status];
+  if (health.stats) {
+    parts.push(health.stats.delivered + " delivered", health.stats.failed + " failed");
+    if (health.stats.lastError) parts.push("last error " + since(health.stats.lastErrorAt) + ": " + health.stats.lastError);
+  }
+  return parts.join(", ");
+}
+
+async function refreshStatus() {
+  try {
+    const status = await fetchJson("api/status");
+    renderCameras(status.servers);
+    renderCards("servers", status.servers, server => server.state, server => server.error || since(server.since));
+    renderCards("buses", status.buses, bus => bus.healthy ? "healthy" : "unhealthy", busDetail);
+    if (status.live && !stream) {
+      openStream();
+    } else if (!status.live && !pollTimer) {
+      setConnection("polling");
+      pollTimer = setInterval(loadEvents, POLL_INTERVAL);
+    }
+  } catch (error) {
+    setConnection("offline");
+    console.error(error);
+  }
+}
+
+function matchesFilter(event) {
+  const filter = document.getElementById("filter").value.trim().toLowerCase();
+  if (!filter) return true;
+  return [event.camera, event.type, event.source].some(value => (value || "").toLowerCase().includes(filter));
+}
+
+function eventItem(event, fresh) {
+  const item = element("li", fresh ? "fresh" : "");
+  item.append(
+    element("span", "time", new Date(event.time).toLocaleTimeString()),
+    element("strong", "", event.camera + " "),
+    element("span", "", event.type + (event.channel ? " #" + event.channel : "") + " "),
+    badge(event.state),
+  );
+  if (event.message) item.append(element("span", "message", event.message));
+  item.title = event.source;
+  return item;
+}
+
+function renderEvents() {
+  if (document.getElementById("pause").checked) return;
+  const items = feed.filter(matchesFilter).map(event => eventItem(event, false));
+  document.getElementById("events").replaceChildren(...items);
+  document.getElementById("no-events").hidden = feed.length > 0;
+}
+
+async function loadEvents() {
+  try {
+    feed = await fetchJson("api/events?limit=" + MAX_EVENTS);
+    renderEvents();
+  } catch (error) {
+    console.error(error);
+  }
+}
+
+function addEvent(event) {
+  feed.unshift(event);
+  feed.length = Math.min(feed.length, MAX_EVENTS);
+  document.getElementById("no-events").hidden = true;
+  if (document.getElementById("pause").checked || !matchesFilter(event)) return;
+  const list = document.getElementById("events");
+  list.prepend(eventItem(event, true));
+  while (list.children.length > MAX_EVENTS) list.lastChild.remove();
+  if ((event.attachments || []).some(attachment => (attachment.contentType || "").startsWith("image/"))) {
+    // FILE IS STILL UPLOADING WHEN EVENT ARRIVES
+    setTimeout(refreshSnapshots, 2000);
+  }
+}
+
+function openStream() {
+  stream = new EventSource("events");
+  stream.onopen = () => setConnection("live");
+  stream.onmessage = message => addEvent(JSON.parse(message.data));
+  stream.onerror = () => setConnection("connecting"); // EVENTSOURCE RECONNECTS ON ITS OWN
+}
+
+async function refreshSnapshots() {
+  try {
+    const snapshots = await fetchJson("api/snapshots");
+    const figures = snapshots.map(snapshot => {
+      const figure = element("figure");
+      const link = element("a");
+      link.href = snapshot.url;
+      link.target = "_blank";
+      const image = element("img");
+      image.src = snapshot.url;
+      image.alt = snapshot.name;
+      image.loading = "lazy";
+      link.append(image);
+      figure.append(link, element("figcaption", "", snapshot.camera + ", " + since(snapshot.time)));
+      return figure;
+    });
+    document.getElementById("snapshots").replaceChildren(...figures);
+    document.getElementById("no-snapshots").hidden = figures.length > 0;
+  } catch (error) {
+    console.error(error);
+  }
+}
+
+document.getElementById("filter").addEventListener("input", renderEvents);
+document.getElementById("pause").addEventListener("change", renderEvents);
+
+loadEvents().then(refreshStatus);
+refreshSnapshots();
+setInterval(refreshStatus, STATUS_INTERVAL);
+setInterval(refreshSnapshots, SNAPSHOT_INTERVAL);
@@ -0,0 +1,95 @@
+package web
+
+import (
+	"encoding/json"
+	"github.com/toxuin/alarmserver/events"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDashboardServesOnlySnapshotsOfRecentEvents(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"porch/alarm.jpg":  "snapshot",
+		"porch/other.jpg":  "not in any event",
+		"porch/notes.txt":  "attachment, but not an image",
+		"private/keys.txt": "secret",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outside := filepath.Join(t.TempDir(), "outside.jpg")
+	if err := os.WriteFile(outside, []byte("outside"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	history := &events.History{}
+	history.Add(events.Event{Camera: "porch", Time: time.Now(), Attachments: []events.Attachment{
+		{Name: "alarm.jpg", ContentType: "image/jpeg", Path: filepath.Join(root, "porch", "alarm.jpg")},
+		{Name: "notes.txt", ContentType: "text/plain", Path: filepath.Join(root, "porch", "notes.txt")},
+		{Name: "outside.jpg", ContentType: "image/jpeg", Path: outside},
+	}})
+	dashboard := &Dashboard{History: history, SnapshotRoot: root}
+	handler := dashboard.Handler()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/dashboard/api/snapshots", nil))
+	var snapshots []snapshot
+	if err := json.NewDecoder(recorder.Body).Decode(&snapshots); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Url != "/dashboard/snapshots/porch/alarm.jpg" {
+		t.Fatalf("snapshots are %+v, want just porch/alarm.jpg", snapshots)
+	}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/dashboard/snapshots/porch/alarm.jpg", http.StatusOK},
+		{"/dashboard/snapshots/porch/other.jpg", http.StatusNotFound},
+		{"/dashboard/snapshots/porch/notes.txt", http.StatusNotFound},
+		{"/dashboard/snapshots/private/keys.txt", http.StatusNotFound},
+		{"/dashboard/snapshots/porch/", http.StatusNotFound},
+		{"/dashboard/snapshots/", http.StatusNotFound},
+		{"/dashboard/snapshots/outside.jpg", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.URL.Path = test.path
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != test.want {
+				t.Fatalf("status is %d, want %d", recorder.Code, test.want)
+			}
+			if test.want == http.StatusOK {
+				if body := recorder.Body.String(); body != "snapshot" {
+					t.Errorf("body is %q, want snapshot", body)
+				}
+				if contentType := recorder.Header().Get("Content-Type"); contentType != "image/jpeg" {
+					t.Errorf("content type is %q, want image/jpeg", contentType)
+				}
+			}
+		})
+	}
+}
+
+func TestDashboardWithoutSnapshotRoot(t *testing.T) {
+	dashboard := &Dashboard{History: &events.History{}}
+	recorder := httptest.NewRecorder()
+	dashboard.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/dashboard/snapshots/alarm.jpg", nil))
+	if recorder.Code == http.StatusOK {
+		t.Errorf("snapshot served without FTP root")
+	}
+}
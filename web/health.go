@@ -0,0 +1,93 @@
+package web
+
+import (
+	"fmt"
+	"github.com/toxuin/alarmserver/buses"
+	"github.com/toxuin/alarmserver/servers"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type StatusProvider interface {
+	Statuses() map[string]servers.Status
+}
+
+type HealthProvider interface {
+	Health() map[string]buses.Health
+}
+
+type HealthReport struct {
+	Status  string                    `json:"status"`
+	Servers map[string]servers.Status `json:"servers"`
+	Buses   map[string]buses.Health   `json:"buses"`
+}
+
+// Health checks what orchestrators need to know about the instance. Live means no server has failed,
+// restarting the instance won't help otherwise. Ready means all servers run and all buses are connected
+type Health struct {
+	Servers StatusProvider
+	Buses   HealthProvider
+}
+
+func (health *Health) report() (HealthReport, bool, bool) {
+	report := HealthReport{
+		Status:  "ok",
+		Servers: health.Servers.Statuses(),
+		Buses:   health.Buses.Health(),
+	}
+	live, ready := true, true
+	for _, status := range report.Servers {
+		if status.State == servers.StateFailed {
+			live = false
+		}
+		if status.State != servers.StateRunning {
+			ready = false
+		}
+	}
+	for _, busHealth := range report.Buses {
+		if !busHealth.Healthy {
+			ready = false
+		}
+	}
+	return report, live, ready
+}
+
+// LiveHandler serves /healthz
+func (health *Health) LiveHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		report, live, _ := health.report()
+		writeReport(writer, report, live)
+	})
+}
+
+// ReadyHandler serves /readyz
+func (health *Health) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		report, _, ready := health.report()
+		writeReport(writer, report, ready)
+	})
+}
+
+func writeReport(writer http.ResponseWriter, report HealthReport, ok bool) {
+	statusCode := http.StatusOK
+	if !ok {
+		report.Status = "unavailable"
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeJson(writer, statusCode, report)
+}
+
+// CheckHealth asks instance listening on port whether it is alive, for HEALTHCHECK of docker images without curl
+func CheckHealth(port int) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/healthz")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package web
+
+import (
+	"github.com/toxuin/alarmserver/buses"
+	"github.com/toxuin/alarmserver/servers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fixedStatuses map[string]servers.Status
+
+func (statuses fixedStatuses) Statuses() map[string]servers.Status {
+	return statuses
+}
+
+type fixedHealth map[string]buses.Health
+
+func (health fixedHealth) Health() map[string]buses.Health {
+	return health
+}
+
+func TestHealthReport(t *testing.T) {
+	running := servers.Status{State: servers.StateRunning}
+	healthy := buses.Health{Healthy: true}
+	tests := []struct {
+		name      string
+		servers   fixedStatuses
+		buses     fixedHealth
+		wantLive  bool
+		wantReady bool
+	}{
+		{"all good", fixedStatuses{"hikvision": running, "ftp": running}, fixedHealth{"mqtt": healthy}, true, true},
+		{"nothing configured", fixedStatuses{}, fixedHealth{}, true, true},
+		{"failed server", fixedStatuses{"hikvision": running, "ftp": {State: servers.StateFailed}}, fixedHealth{"mqtt": healthy}, false, false},
+		{"stopped server", fixedStatuses{"hikvision": {State: servers.StateStopped}}, fixedHealth{"mqtt": healthy}, true, false},
+		{"starting server", fixedStatuses{"hikvision": {State: servers.StateStarting}}, fixedHealth{"mqtt": healthy}, true, false},
+		{"unhealthy bus", fixedStatuses{"hikvision": running}, fixedHealth{"mqtt": healthy, "webhooks": {}}, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			health := &Health{Servers: test.servers, Buses: test.buses}
+			report, live, ready := health.report()
+			if live != test.wantLive || ready != test.wantReady {
+				t.Errorf("live is %v and ready is %v, want %v and %v", live, ready, test.wantLive, test.wantReady)
+			}
+			if len(report.Servers) != len(test.servers) || len(report.Buses) != len(test.buses) {
+				t.Errorf("report has %d servers and %d buses, want %d and %d",
+					len(report.Servers), len(report.Buses), len(test.servers), len(test.buses))
+			}
+
+			for path, handler := range map[string]http.Handler{"live": health.LiveHandler(), "ready": health.ReadyHandler()} {
+				want := http.StatusOK
+				if (path == "live" && !test.wantLive) || (path == "ready" && !test.wantReady) {
+					want = http.StatusServiceUnavailable
+				}
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+				if recorder.Code != want {
+					t.Errorf("%s status is %d, want %d", path, recorder.Code, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"github.com/toxuin/alarmserver/logging"
+	"github.com/toxuin/alarmserver/servers"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var log = logging.For("http")
+
+const shutdownTimeout = 5 * time.Second
+
+// Server is the optional HTTP listener that metrics, health checks and API share.
+// It is a Source, so that supervisor starts and stops it with everything else
+type Server struct {
+	servers.StatusHolder
+	Port      int
+	mux       *http.ServeMux
+	server    *http.Server
+	waitGroup sync.WaitGroup
+}
+
+// Handle registers handler for pattern, call it before Start
+func (server *Server) Handle(pattern string, handler http.Handler) {
+	if server.mux == nil {
+		server.mux = http.NewServeMux()
+	}
+	server.mux.Handle(pattern, handler)
+}
+
+func (server *Server) Start(ctx context.Context) error {
+	if server.Port == 0 {
+		server.Port = 8080 // DEFAULT PORT
+	}
+	if server.mux == nil {
+		server.mux = http.NewServeMux()
+	}
+	server.SetStatus(servers.StateStarting, nil)
+
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(server.Port))
+	if err != nil {
+		server.SetStatus(servers.StateFailed, err)
+		return err
+	}
+	server.server = &http.Server{
+		Handler:           server.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	server.waitGroup.Add(1)
+	go func() {
+		defer server.waitGroup.Done()
+		log.Info("listening", "port", server.Port)
+		err := server.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("server failed", "port", server.Port, "error", err)
+			server.SetStatus(servers.StateFailed, err)
+		}
+	}()
+
+	server.SetStatus(servers.StateRunning, nil)
+	return nil
+}
+
+func (server *Server) Stop() {
+	if server.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.server.Shutdown(ctx); err != nil {
+		log.Warn("error shutting down", "error", err)
+		_ = server.server.Close()
+	}
+	server.waitGroup.Wait()
+	server.server = nil
+	server.SetStatus(servers.StateStopped, nil)
+}